@@ -0,0 +1,11 @@
+// Package api embeds the AsyncAPI document and the JSON schemas of the
+// messages it describes, so they can be used at runtime as well as for code
+// generation.
+package api
+
+import "embed"
+
+// FS holds gemini.json and the message schemas under models/gemini.
+//
+//go:embed gemini.json models/gemini/*.json
+var FS embed.FS
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+
+	"jig.sx/twinspeak/pkg/audio"
+	"jig.sx/twinspeak/pkg/client"
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/srv"
+)
+
+// resumeAttempts bounds how often a resume step retries while the server
+// has not yet noticed that the previous connection is gone.
+const resumeAttempts = 5
+
+var (
+	errTimeout = errors.New("step timed out")
+	errDropped = errors.New("connection dropped")
+)
+
+var benchFlags struct {
+	clientFlags
+	sessions int
+	rampUp   time.Duration
+	duration time.Duration
+	script   string
+	timeout  time.Duration
+	json     string
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Load a server with concurrent scripted sessions",
+	Long: `Start --sessions concurrent sessions, spread evenly over --ramp-up, each running the
+conversation in --script and starting a new one until --duration has passed after the
+ramp-up, or running it once if --duration is zero. The script is a YAML or JSON file
+with a list of steps, each one of:
+
+  text: Hello                    send input_text
+  audio: {seconds: 1}            send synthetic silence as input_audio chunks
+  toolResult: {result: {}}       answer the next function_call
+  resume: true                   drop the connection and resume the session
+  pause: 500ms                   wait
+
+A step may set replies to the number of final outputs it waits for, by default one
+per text or audio chunk and none for a tool result. The report lists throughput,
+latency percentiles per kind of step, error codes and dropped connections; --json
+writes it as JSON as well.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		script := defaultBenchScript
+		if benchFlags.script != "" {
+			var err error
+			if script, err = loadBenchScript(benchFlags.script); err != nil {
+				return err
+			}
+		}
+		if benchFlags.sessions <= 0 || benchFlags.timeout <= 0 || benchFlags.rampUp < 0 || benchFlags.duration < 0 {
+			return errors.New("--sessions and --timeout must be positive, --ramp-up and --duration not negative")
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+		b := &bencher{
+			flags:    benchFlags.clientFlags,
+			script:   script,
+			sessions: benchFlags.sessions,
+			rampUp:   benchFlags.rampUp,
+			duration: benchFlags.duration,
+			timeout:  benchFlags.timeout,
+		}
+		report := b.run(ctx)
+		if err := report.writeTable(cmd.OutOrStdout()); err != nil {
+			return err
+		}
+		return writeBenchJSON(cmd.OutOrStdout(), benchFlags.json, report)
+	},
+}
+
+// benchScript is the conversation every bench session runs.
+type benchScript struct {
+	Steps []benchStep `json:"steps" yaml:"steps"`
+}
+
+// benchStep is one action of a bench script; exactly one of its action
+// fields is set.
+type benchStep struct {
+	Text       string           `json:"text,omitempty" yaml:"text,omitempty"`
+	Audio      *benchAudio      `json:"audio,omitempty" yaml:"audio,omitempty"`
+	ToolResult *benchToolResult `json:"toolResult,omitempty" yaml:"toolResult,omitempty"`
+	Resume     bool             `json:"resume,omitempty" yaml:"resume,omitempty"`
+	Pause      srv.Duration     `json:"pause,omitempty" yaml:"pause,omitempty"`
+	Replies    *int             `json:"replies,omitempty" yaml:"replies,omitempty"`
+}
+
+// benchAudio is synthetic silence in the speech format.
+type benchAudio struct {
+	Seconds  float64      `json:"seconds" yaml:"seconds"`
+	Chunk    srv.Duration `json:"chunk,omitempty" yaml:"chunk,omitempty"`
+	Format   string       `json:"format,omitempty" yaml:"format,omitempty"`
+	Realtime bool         `json:"realtime,omitempty" yaml:"realtime,omitempty"`
+}
+
+// benchToolResult answers a function_call, optionally only one with Name.
+type benchToolResult struct {
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+	Result any    `json:"result" yaml:"result"`
+}
+
+var defaultBenchScript = benchScript{Steps: []benchStep{
+	{Text: "Hello"},
+	{Audio: &benchAudio{Seconds: 1}},
+	{Resume: true},
+	{Text: "Still there?"},
+}}
+
+// loadBenchScript reads and validates a script file. YAML is a superset
+// of JSON, so one decoder serves both.
+func loadBenchScript(path string) (benchScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return benchScript{}, fmt.Errorf("read script: %w", err)
+	}
+	var s benchScript
+	if err := yaml.UnmarshalWithOptions(data, &s, yaml.Strict()); err != nil {
+		return benchScript{}, fmt.Errorf("parse script %s: %w", path, err)
+	}
+	return s, s.validate()
+}
+
+func (s benchScript) validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("script has no steps")
+	}
+	for i, step := range s.Steps {
+		actions := 0
+		for _, set := range []bool{step.Text != "", step.Audio != nil, step.ToolResult != nil, step.Resume,
+			step.Pause != 0} {
+			if set {
+				actions++
+			}
+		}
+		if actions != 1 {
+			return fmt.Errorf("step %d must have exactly one of text, audio, toolResult, resume and pause", i+1)
+		}
+		if step.Replies != nil && *step.Replies < 0 {
+			return fmt.Errorf("step %d: replies must not be negative", i+1)
+		}
+		if a := step.Audio; a != nil {
+			if a.Seconds <= 0 || a.Chunk < 0 {
+				return fmt.Errorf("step %d: audio needs positive seconds and a non-negative chunk", i+1)
+			}
+			if f := a.Format; f != "" && f != string(g.ClientInputAudioJsonFormatPcm16) &&
+				f != string(g.ClientInputAudioJsonFormatWav) {
+				return fmt.Errorf("step %d: audio format must be pcm16 or wav, got %q", i+1, f)
+			}
+		}
+	}
+	return nil
+}
+
+func writeBenchJSON(stdout io.Writer, path string, report benchReport) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// bencher runs the sessions of one benchmark.
+type bencher struct {
+	flags    clientFlags
+	script   benchScript
+	sessions int
+	rampUp   time.Duration
+	duration time.Duration
+	timeout  time.Duration
+}
+
+// run starts the sessions and waits for them to finish.
+func (b *bencher) run(ctx context.Context) benchReport {
+	stats := newBenchStats()
+	start := time.Now()
+	deadline := start.Add(b.rampUp + b.duration)
+	var wg sync.WaitGroup
+	for i := range b.sessions {
+		delay := b.rampUp * time.Duration(i) / time.Duration(b.sessions)
+		wg.Go(func() {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			s := &benchSession{bencher: b, stats: stats}
+			for ctx.Err() == nil {
+				if err := s.conversation(ctx); err != nil && ctx.Err() == nil {
+					// Don't let a failing server turn the loop into a busy one.
+					time.Sleep(100 * time.Millisecond)
+				}
+				if b.duration == 0 || time.Now().After(deadline) {
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return stats.report(b.sessions, time.Since(start))
+}
+
+// benchSession runs conversations one after another. outstanding counts
+// the final outputs the current step still waits for.
+type benchSession struct {
+	*bencher
+	stats       *benchStats
+	c           *client.Client
+	calls       []g.FunctionCallJson
+	outstanding int
+}
+
+// conversation sets up a session, runs the script and ends the session.
+func (s *benchSession) conversation(ctx context.Context) error {
+	s.calls, s.outstanding = nil, 0
+	if err := s.connect(ctx, ""); err != nil {
+		s.stats.error("connect")
+		return err
+	}
+	defer func() { _ = s.c.Close() }()
+
+	for _, step := range s.script.Steps {
+		if err := s.step(ctx, step); err != nil {
+			return err
+		}
+	}
+	return s.end(ctx)
+}
+
+func (s *benchSession) connect(ctx context.Context, handle string) error {
+	flags := s.flags
+	if handle != "" {
+		flags.resume = handle
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	// Reconnecting would hide the drops the benchmark is meant to count.
+	c, err := flags.connect(ctx, client.WithReconnect(0, 0))
+	if err != nil {
+		return err
+	}
+	s.c = c
+	return nil
+}
+
+// step performs one step and records its latency: the time from its last
+// message until the replies it waits for have arrived.
+func (s *benchSession) step(ctx context.Context, step benchStep) error {
+	var kind string
+	var sent time.Time
+	var err error
+	switch {
+	case step.Text != "":
+		kind, sent = "text", time.Now()
+		err = s.send(step.replies(1), func() error { return s.c.SendText(ctx, step.Text) })
+	case step.Audio != nil:
+		kind = "audio"
+		sent, err = s.sendAudio(ctx, step)
+	case step.ToolResult != nil:
+		kind = "tool"
+		sent, err = s.answer(ctx, step)
+	case step.Resume:
+		return s.resume(ctx)
+	default:
+		select {
+		case <-time.After(time.Duration(step.Pause)):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.await(ctx, func() bool { return s.outstanding <= 0 }); err != nil {
+		return err
+	}
+	s.stats.latency(kind, time.Since(sent))
+	return nil
+}
+
+// replies returns the number of final outputs the step waits for.
+func (step benchStep) replies(def int) int {
+	if step.Replies != nil {
+		return *step.Replies
+	}
+	return def
+}
+
+// send sends one message that expects replies final outputs. They are
+// counted first so that a fast reply cannot overtake its message.
+func (s *benchSession) send(replies int, send func() error) error {
+	s.outstanding += replies
+	if err := send(); err != nil {
+		return err
+	}
+	s.stats.update(func(st *benchStats) { st.sent++ })
+	return nil
+}
+
+func (s *benchSession) sendAudio(ctx context.Context, step benchStep) (time.Time, error) {
+	a := step.Audio
+	chunk := time.Duration(a.Chunk)
+	if chunk == 0 {
+		chunk = 100 * time.Millisecond
+	}
+	format := g.ClientInputAudioJsonFormat(a.Format)
+	if format == "" {
+		format = g.ClientInputAudioJsonFormatPcm16
+	}
+	chunks := split(make([]byte, audio.Speech.Bytes(time.Duration(a.Seconds*float64(time.Second)))),
+		max(audio.Speech.Bytes(chunk), 2))
+
+	start := time.Now()
+	var offset time.Duration
+	for i, pcm := range chunks {
+		if a.Realtime {
+			select {
+			case <-time.After(time.Until(start.Add(offset))):
+			case <-ctx.Done():
+				return time.Time{}, ctx.Err()
+			}
+		}
+		offset += audio.Speech.Duration(len(pcm))
+		data := pcm
+		if format == g.ClientInputAudioJsonFormatWav {
+			data = audio.EncodeWAV(audio.Speech, pcm)
+		}
+		// Scripted replies are awaited for the step as a whole, after its
+		// final chunk, rather than for every chunk.
+		final := i == len(chunks)-1
+		replies := step.replies(1)
+		if step.Replies != nil && !final {
+			replies = 0
+		}
+		if err := s.send(replies, func() error { return s.c.SendAudio(ctx, format, data, final) }); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Now(), nil
+}
+
+// answer waits for a matching function_call and sends the scripted result.
+func (s *benchSession) answer(ctx context.Context, step benchStep) (time.Time, error) {
+	name := step.ToolResult.Name
+	match := func() int {
+		for i, call := range s.calls {
+			if name == "" || call.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+	if err := s.await(ctx, func() bool { return match() >= 0 }); err != nil {
+		return time.Time{}, err
+	}
+	i := match()
+	call := s.calls[i]
+	s.calls = append(s.calls[:i], s.calls[i+1:]...)
+	sent := time.Now()
+	return sent, s.send(step.replies(0), func() error {
+		return s.c.SendToolResult(ctx, call.CallId, call.Name, step.ToolResult.Result)
+	})
+}
+
+// resume drops the connection and resumes the session on a new one. The
+// server may still hold the old connection for a moment, so failed
+// attempts are retried.
+func (s *benchSession) resume(ctx context.Context) error {
+	handle := s.c.Handle()
+	_ = s.c.Close()
+	start := time.Now()
+	var err error
+	for attempt := range resumeAttempts {
+		if attempt > 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err = s.connect(ctx, handle); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		s.stats.error("resume")
+		return err
+	}
+	s.outstanding = 0
+	s.stats.latency("resume", time.Since(start))
+	return nil
+}
+
+// end ends the session and drains the events that arrive until the server
+// closes the connection.
+func (s *benchSession) end(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.c.End(ctx, "bench finished") }()
+	for ev := range s.c.Events() {
+		s.observe(ev)
+	}
+	if err := <-done; err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.stats.error("timeout")
+		}
+		return err
+	}
+	s.stats.update(func(st *benchStats) { st.conversations++ })
+	return nil
+}
+
+// await handles events until done reports true, the step times out or
+// the connection is lost.
+func (s *benchSession) await(ctx context.Context, done func() bool) error {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	for !done() {
+		select {
+		case ev, ok := <-s.c.Events():
+			if !ok {
+				s.stats.update(func(st *benchStats) { st.dropped++ })
+				return fmt.Errorf("%w: %v", errDropped, s.c.Err())
+			}
+			s.observe(ev)
+		case <-timer.C:
+			s.stats.error("timeout")
+			return errTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// observe counts ev and settles the replies it completes.
+func (s *benchSession) observe(ev client.Event) {
+	s.stats.update(func(st *benchStats) { st.received++ })
+	switch ev := ev.(type) {
+	case g.ServerOutputTextJson:
+		if ev.Final {
+			s.outstanding--
+		}
+	case g.ServerOutputAudioJson:
+		if ev.Final {
+			s.outstanding--
+		}
+	case g.FunctionCallJson:
+		s.calls = append(s.calls, ev)
+	case g.ErrorJson:
+		s.stats.error(ev.Code)
+		s.outstanding--
+	}
+}
+
+func init() {
+	fs := benchCmd.Flags()
+	benchFlags.add(fs)
+	fs.IntVar(&benchFlags.sessions, "sessions", 10, "Number of concurrent sessions")
+	fs.DurationVar(&benchFlags.rampUp, "ramp-up", 0, "Time over which the sessions are started")
+	fs.DurationVar(&benchFlags.duration, "duration", 0,
+		"How long sessions keep repeating the script after the ramp-up; 0 runs it once per session")
+	fs.StringVar(&benchFlags.script, "script", "", "YAML or JSON file with the conversation to run")
+	fs.DurationVar(&benchFlags.timeout, "timeout", 10*time.Second, "How long each step may wait for its replies")
+	fs.StringVar(&benchFlags.json, "json", "", "File the JSON report is written to, - for stdout")
+	rootCmd.AddCommand(benchCmd)
+}
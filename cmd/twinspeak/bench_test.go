@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jig.sx/twinspeak/srv"
+)
+
+// TestBench tests that bench runs the default script in every session and reports its steps
+func TestBench(t *testing.T) {
+	httpServer := httptest.NewServer(srv.New().Handler())
+	defer httpServer.Close()
+
+	b := &bencher{
+		flags: clientFlags{
+			url:   "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak",
+			model: "gemini-1.5-flash",
+		},
+		script:   defaultBenchScript,
+		sessions: 5,
+		rampUp:   50 * time.Millisecond,
+		timeout:  5 * time.Second,
+	}
+	report := b.run(context.Background())
+
+	if report.Conversations != 5 || len(report.Errors) != 0 || report.Dropped != 0 {
+		t.Fatalf("Expected 5 clean conversations, got %d with errors %v and %d dropped",
+			report.Conversations, report.Errors, report.Dropped)
+	}
+	for step, want := range map[string]int{"text": 10, "audio": 5, "resume": 5} {
+		if got := report.Latency[step].Count; got != want {
+			t.Errorf("Expected %d %s latencies, got %d", want, step, got)
+		}
+	}
+	// One text, ten audio chunks and another text per conversation.
+	if report.MessagesSent != 5*12 {
+		t.Errorf("Expected %d messages sent, got %d", 5*12, report.MessagesSent)
+	}
+
+	var table bytes.Buffer
+	if err := report.writeTable(&table); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	for _, want := range []string{"Conversations", "p99 ms", "resume"} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("Expected the table to contain %q, got:\n%s", want, table.String())
+		}
+	}
+}
+
+// TestBenchScriptValidation tests that steps with no or several actions are rejected
+func TestBenchScriptValidation(t *testing.T) {
+	for _, s := range []benchScript{
+		{},
+		{Steps: []benchStep{{}}},
+		{Steps: []benchStep{{Text: "hi", Resume: true}}},
+		{Steps: []benchStep{{Audio: &benchAudio{Seconds: 1, Format: "mp3"}}}},
+	} {
+		if err := s.validate(); err == nil {
+			t.Errorf("Expected script %+v to be rejected", s)
+		}
+	}
+	if err := defaultBenchScript.validate(); err != nil {
+		t.Errorf("Failed to validate the default script: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchStats accumulates the results of all bench sessions.
+type benchStats struct {
+	mu            sync.Mutex
+	conversations int
+	sent          int
+	received      int
+	dropped       int
+	latencies     map[string][]time.Duration
+	errors        map[string]int
+}
+
+func newBenchStats() *benchStats {
+	return &benchStats{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+}
+
+func (s *benchStats) update(f func(*benchStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *benchStats) latency(step string, d time.Duration) {
+	s.update(func(s *benchStats) { s.latencies[step] = append(s.latencies[step], d) })
+}
+
+func (s *benchStats) error(code string) {
+	s.update(func(s *benchStats) { s.errors[code]++ })
+}
+
+// benchReport is the JSON form of the bench results.
+type benchReport struct {
+	Sessions          int                     `json:"sessions"`
+	DurationSeconds   float64                 `json:"durationSeconds"`
+	Conversations     int                     `json:"conversations"`
+	MessagesSent      int                     `json:"messagesSent"`
+	MessagesReceived  int                     `json:"messagesReceived"`
+	MessagesPerSecond float64                 `json:"messagesPerSecond"`
+	TurnsPerSecond    float64                 `json:"turnsPerSecond"`
+	Latency           map[string]latencyStats `json:"latencyMs"`
+	Errors            map[string]int          `json:"errors"`
+	Dropped           int                     `json:"droppedConnections"`
+}
+
+// latencyStats summarises the latencies of one kind of step in milliseconds.
+type latencyStats struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func (s *benchStats) report(sessions int, elapsed time.Duration) benchReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := benchReport{
+		Sessions:          sessions,
+		DurationSeconds:   elapsed.Seconds(),
+		Conversations:     s.conversations,
+		MessagesSent:      s.sent,
+		MessagesReceived:  s.received,
+		MessagesPerSecond: float64(s.sent+s.received) / elapsed.Seconds(),
+		Latency:           make(map[string]latencyStats),
+		Errors:            maps.Clone(s.errors),
+		Dropped:           s.dropped,
+	}
+	turns := 0
+	for step, ds := range s.latencies {
+		sorted := slices.Clone(ds)
+		slices.Sort(sorted)
+		r.Latency[step] = latencyStats{
+			Count: len(sorted),
+			P50:   milliseconds(percentile(sorted, 0.50)),
+			P90:   milliseconds(percentile(sorted, 0.90)),
+			P99:   milliseconds(percentile(sorted, 0.99)),
+			Max:   milliseconds(sorted[len(sorted)-1]),
+		}
+		if step != "resume" {
+			turns += len(sorted)
+		}
+	}
+	r.TurnsPerSecond = float64(turns) / elapsed.Seconds()
+	return r
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+// writeTable prints r for humans.
+func (r benchReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Sessions\t%d\n", r.Sessions)
+	fmt.Fprintf(tw, "Duration\t%.1fs\n", r.DurationSeconds)
+	fmt.Fprintf(tw, "Conversations\t%d\n", r.Conversations)
+	fmt.Fprintf(tw, "Messages sent/received\t%d/%d (%.1f/s)\n", r.MessagesSent, r.MessagesReceived, r.MessagesPerSecond)
+	fmt.Fprintf(tw, "Turns\t%.1f/s\n", r.TurnsPerSecond)
+	fmt.Fprintf(tw, "Dropped connections\t%d\n", r.Dropped)
+
+	fmt.Fprintf(tw, "\nStep\tCount\tp50 ms\tp90 ms\tp99 ms\tmax ms\n")
+	for _, step := range sortedKeys(r.Latency) {
+		l := r.Latency[step]
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\n", step, l.Count, l.P50, l.P90, l.P99, l.Max)
+	}
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(tw, "\nError\tCount\n")
+		for _, code := range sortedKeys(r.Errors) {
+			fmt.Fprintf(tw, "%s\t%d\n", code, r.Errors[code])
+		}
+	}
+	return tw.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := slices.Collect(maps.Keys(m))
+	sort.Strings(keys)
+	return keys
+}
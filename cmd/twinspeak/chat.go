@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/spf13/cobra"
+
+	"jig.sx/twinspeak/pkg/client"
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+var chatFlags struct {
+	clientFlags
+	toolResults string
+}
+
+var chatCmd = &cobra.Command{
+	Use:   "chat",
+	Short: "Chat with a server from the terminal",
+	Long: `Set up a session and send each line read from stdin as input_text, printing the
+server's output as it streams in. Function calls are answered from the --tool-results
+file or, for functions it does not list, by the next line typed, parsed as JSON if it
+is valid and sent as a string otherwise. End of input ends the session; an interrupt
+leaves it resumable with the printed handle.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		var results map[string]any
+		if chatFlags.toolResults != "" {
+			data, err := os.ReadFile(chatFlags.toolResults)
+			if err != nil {
+				return fmt.Errorf("read tool results: %w", err)
+			}
+			if err := json.Unmarshal(data, &results); err != nil {
+				return fmt.Errorf("parse tool results %s: %w", chatFlags.toolResults, err)
+			}
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+		c, err := chatFlags.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return chat(ctx, c, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.ErrOrStderr(), results)
+	},
+}
+
+// chatSession prints server events and answers function calls.
+type chatSession struct {
+	c       *client.Client
+	out     io.Writer
+	diag    io.Writer
+	results map[string]any
+	pending []g.FunctionCallJson
+}
+
+// chat relays lines from in to c and events from c to out and diag until
+// in is exhausted, the connection is lost or ctx is done.
+func chat(ctx context.Context, c *client.Client, in io.Reader, out, diag io.Writer, results map[string]any) error {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	s := &chatSession{c: c, out: out, diag: diag, results: results}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return s.end(ctx)
+			}
+			if err := s.input(ctx, line); err != nil {
+				return err
+			}
+		case ev, ok := <-c.Events():
+			if !ok {
+				return c.Err()
+			}
+			if err := s.event(ctx, ev); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			fmt.Fprintf(diag, "\n[interrupted, resume with --resume %s]\n", c.Handle())
+			return nil
+		}
+	}
+}
+
+// input answers the oldest unanswered function call with line, or sends
+// it as text.
+func (s *chatSession) input(ctx context.Context, line string) error {
+	if len(s.pending) > 0 {
+		call := s.pending[0]
+		s.pending = s.pending[1:]
+		var result any = line
+		if json.Valid([]byte(line)) {
+			result = json.RawMessage(line)
+		}
+		return s.c.SendToolResult(ctx, call.CallId, call.Name, result)
+	}
+	if line == "" {
+		return nil
+	}
+	return s.c.SendText(ctx, line)
+}
+
+// event prints ev, answering function calls that have a scripted result.
+func (s *chatSession) event(ctx context.Context, ev client.Event) error {
+	switch ev := ev.(type) {
+	case g.ServerOutputTextJson:
+		fmt.Fprint(s.out, ev.Text)
+		if ev.Final {
+			fmt.Fprintln(s.out)
+		}
+	case g.ServerOutputAudioJson:
+		fmt.Fprintf(s.diag, "[%s audio, %d base64 bytes, final: %t]\n", ev.Format, len(ev.Chunk), ev.Final)
+	case g.FunctionCallJson:
+		args, _ := json.Marshal(ev.Arguments)
+		if result, ok := s.results[ev.Name]; ok {
+			fmt.Fprintf(s.diag, "[function call %s(%s), answered from script]\n", ev.Name, args)
+			return s.c.SendToolResult(ctx, ev.CallId, ev.Name, result)
+		}
+		fmt.Fprintf(s.diag, "[function call %s(%s), enter the result]\n", ev.Name, args)
+		s.pending = append(s.pending, ev)
+	case g.SessionResumptionUpdateJson:
+		fmt.Fprintf(s.diag, "[resumption handle %s]\n", ev.Handle)
+	case g.GoingAwayJson:
+		fmt.Fprintf(s.diag, "[server going away in %dms]\n", ev.TimeLeftMs)
+	case g.ErrorJson:
+		fmt.Fprintf(s.diag, "[error %s: %s]\n", ev.Code, ev.Message)
+	case client.Reconnected:
+		fmt.Fprintf(s.diag, "[reconnected with handle %s on attempt %d]\n", ev.Handle, ev.Attempt)
+	case client.Unknown:
+		fmt.Fprintf(s.diag, "[unknown message %s]\n", ev.Raw)
+	}
+	return nil
+}
+
+// end ends the session and prints the events that arrive until the server
+// closes the connection.
+func (s *chatSession) end(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.c.End(ctx, "chat finished") }()
+	for ev := range s.c.Events() {
+		if err := s.event(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return <-done
+}
+
+func init() {
+	chatFlags.add(chatCmd.Flags())
+	chatCmd.Flags().StringVar(&chatFlags.toolResults, "tool-results", "",
+		"JSON file mapping function names to the results sent for their calls")
+	rootCmd.AddCommand(chatCmd)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"jig.sx/twinspeak/srv"
+)
+
+// TestChat tests that chat sends stdin lines as text and prints the replies
+func TestChat(t *testing.T) {
+	httpServer := httptest.NewServer(srv.New().Handler())
+	defer httpServer.Close()
+
+	flags := clientFlags{
+		url:   "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak",
+		model: "gemini-1.5-flash",
+	}
+	ctx := context.Background()
+	c, err := flags.connect(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	var out, diag bytes.Buffer
+	if err := chat(ctx, c, strings.NewReader("hello\n\nworld\n"), &out, &diag, nil); err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if want := "[echo] hello\n[echo] world\nGoodbye! Session ended.\n"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+	if !strings.Contains(diag.String(), "[resumption handle session_") {
+		t.Errorf("Expected the resumption handle to be shown, got %q", diag.String())
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"jig.sx/twinspeak/pkg/client"
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// tokenEnv names the environment variable read when --token is not given,
+// which keeps credentials out of the process list.
+const tokenEnv = "TWINSPEAK_TOKEN"
+
+// clientFlags are shared by the subcommands that talk to a server.
+type clientFlags struct {
+	url    string
+	model  string
+	token  string
+	resume string
+}
+
+func (f *clientFlags) add(fs *pflag.FlagSet) {
+	f.addConnection(fs)
+	fs.StringVar(&f.model, "model", "gemini-1.5-flash", "Model to set the session up with")
+	fs.StringVar(&f.resume, "resume", "", "Resumption handle of a session to continue")
+}
+
+// addConnection adds only the flags that locate and authenticate with the
+// server, for subcommands that take the session setup from elsewhere.
+func (f *clientFlags) addConnection(fs *pflag.FlagSet) {
+	fs.StringVar(&f.url, "url", "ws://localhost:8080/v1/speak", "WebSocket URL of the /v1/speak endpoint")
+	fs.StringVar(&f.token, "token", "", "Bearer token or API key (default $"+tokenEnv+")")
+}
+
+// bearer returns the token given by flag or environment.
+func (f *clientFlags) bearer() string {
+	if f.token != "" {
+		return f.token
+	}
+	return os.Getenv(tokenEnv)
+}
+
+// connect dials the server and sets up or resumes the session.
+func (f *clientFlags) connect(ctx context.Context, opts ...client.Option) (*client.Client, error) {
+	if token := f.bearer(); token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+	c, err := client.Dial(ctx, f.url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", f.url, err)
+	}
+
+	req := g.SetupRequestJson{Model: f.model}
+	if f.resume != "" {
+		req.ResumptionHandle = &f.resume
+	}
+	if err := c.Setup(ctx, req); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("set up session: %w", err)
+	}
+	return c, nil
+}
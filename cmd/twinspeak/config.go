@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"jig.sx/twinspeak/srv"
+)
+
+// envPrefix is prepended to a flag name to form its environment variable.
+const envPrefix = "TWINSPEAK_"
+
+// envNames overrides the environment variable of flags whose derived name
+// is already taken.
+var envNames = map[string]string{
+	"api-keys": "TWINSPEAK_API_KEYS_FILE",
+}
+
+// Config is the effective server configuration, merged from defaults, the
+// config file, TWINSPEAK_* environment variables and flags, in that order.
+type Config struct {
+	Addr           string                `json:"addr" yaml:"addr"`
+	AllowedOrigins []string              `json:"allowedOrigins,omitempty" yaml:"allowedOrigins,omitempty"`
+	TLS            TLSConfig             `json:"tls" yaml:"tls"`
+	Auth           AuthConfig            `json:"auth" yaml:"auth"`
+	LimitsFile     string                `json:"limitsFile,omitempty" yaml:"limitsFile,omitempty"`
+	Limits         srv.LimitsConfig      `json:"limits" yaml:"limits"`
+	Messages       srv.MessageLimits     `json:"messages" yaml:"messages"`
+	Sessions       SessionsConfig        `json:"sessions" yaml:"sessions"`
+	Log            srv.LogConfig         `json:"log" yaml:"log"`
+	Tracing        srv.TracingConfig     `json:"tracing" yaml:"tracing"`
+	Recording      srv.RecordingConfig   `json:"recording" yaml:"recording"`
+	Compression    srv.CompressionConfig `json:"compression" yaml:"compression"`
+	Keepalive      srv.KeepaliveConfig   `json:"keepalive" yaml:"keepalive"`
+}
+
+// TLSConfig locates the certificate files for TLS and mutual TLS.
+type TLSConfig struct {
+	CertFile     string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile      string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	ClientCAFile string `json:"clientCAFile,omitempty" yaml:"clientCAFile,omitempty"`
+}
+
+// AuthConfig locates credentials. Secrets are only ever referenced by file.
+type AuthConfig struct {
+	APIKeysFile         string   `json:"apiKeysFile,omitempty" yaml:"apiKeysFile,omitempty"`
+	TokenSecretFile     string   `json:"tokenSecretFile,omitempty" yaml:"tokenSecretFile,omitempty"`
+	EphemeralSecretFile string   `json:"ephemeralSecretFile,omitempty" yaml:"ephemeralSecretFile,omitempty"`
+	JWKSFile            string   `json:"jwksFile,omitempty" yaml:"jwksFile,omitempty"`
+	JWTIssuer           string   `json:"jwtIssuer,omitempty" yaml:"jwtIssuer,omitempty"`
+	JWTAudience         string   `json:"jwtAudience,omitempty" yaml:"jwtAudience,omitempty"`
+	Admins              []string `json:"admins,omitempty" yaml:"admins,omitempty"`
+}
+
+// SessionsConfig controls session persistence and draining.
+type SessionsConfig struct {
+	File        string       `json:"file,omitempty" yaml:"file,omitempty"`
+	DrainPeriod srv.Duration `json:"drainPeriod" yaml:"drainPeriod"`
+	TTL         srv.Duration `json:"ttl" yaml:"ttl"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Addr:      ":8080",
+		Messages:  srv.DefaultMessageLimits,
+		Log:       srv.DefaultLogConfig,
+		Tracing:   srv.TracingConfig{SampleRatio: 1},
+		Keepalive: srv.DefaultKeepalive,
+		Recording: srv.RecordingConfig{MaxBytes: srv.DefaultRecordingMaxBytes},
+		Sessions: SessionsConfig{
+			DrainPeriod: srv.Duration(srv.DefaultDrainPeriod),
+			TTL:         srv.Duration(srv.DefaultSessionTTL),
+		},
+	}
+}
+
+var (
+	cfg        = defaultConfig()
+	configFile string
+	// flagValues holds the flags given on the command line, which take
+	// precedence over the config file and environment on every load.
+	flagValues map[string]func() error
+)
+
+// addServerFlags binds the server flags to cfg.
+func addServerFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&configFile, "config", "", "YAML or JSON config file")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "Address to listen on (default :8080)")
+	fs.StringVar(&cfg.Auth.APIKeysFile, "api-keys", "",
+		"File of principal:key API keys, one per line (also read from "+apiKeysEnv+")")
+	fs.StringVar(&cfg.Auth.TokenSecretFile, "token-secret", "", "File holding the HMAC secret for bearer tokens")
+	fs.StringVar(&cfg.Auth.EphemeralSecretFile, "ephemeral-secret", "",
+		"File holding the HMAC secret for ephemeral client tokens (enables POST /v1/tokens)")
+	fs.StringVar(&cfg.Auth.JWKSFile, "jwks", "", "Local JWKS file used to verify JWTs")
+	fs.StringVar(&cfg.Auth.JWTIssuer, "jwt-issuer", "", "Required JWT issuer (iss)")
+	fs.StringVar(&cfg.Auth.JWTAudience, "jwt-audience", "", "Required JWT audience (aud)")
+	fs.StringVar(&cfg.LimitsFile, "limits", "", "JSON file with default and per-principal rate limits")
+	fs.Int64Var(&cfg.Messages.MaxFrameBytes, "max-frame-bytes", cfg.Messages.MaxFrameBytes,
+		"Maximum size of an inbound WebSocket message in bytes")
+	fs.IntVar(&cfg.Messages.MaxAudioBytes, "max-audio-bytes", cfg.Messages.MaxAudioBytes,
+		"Maximum decoded size of an audio chunk in bytes")
+	fs.IntVar(&cfg.Messages.MaxTextLength, "max-text-length", cfg.Messages.MaxTextLength,
+		"Maximum length of input text in characters")
+	fs.IntVar(&cfg.Messages.MaxDepth, "max-json-depth", cfg.Messages.MaxDepth,
+		"Maximum nesting depth of inbound JSON messages")
+	fs.Int64Var(&cfg.Messages.MaxLogBytes, "max-log-bytes", cfg.Messages.MaxLogBytes,
+		"Maximum size of a session's message log in bytes")
+	fs.StringSliceVar(&cfg.AllowedOrigins, "allowed-origins", nil,
+		"Browser origins allowed besides same-origin: hosts, *.example.com wildcards or full origins, "+
+			"on any port unless one is given")
+	fs.StringVar(&cfg.TLS.CertFile, "tls-cert", "", "TLS certificate file, reloaded when it changes")
+	fs.StringVar(&cfg.TLS.KeyFile, "tls-key", "", "TLS private key file, reloaded when it changes")
+	fs.StringVar(&cfg.TLS.ClientCAFile, "client-ca", "",
+		"PEM bundle of CAs for client certificates; the subject CN becomes the principal")
+	fs.DurationVar((*time.Duration)(&cfg.Sessions.DrainPeriod), "drain-period", srv.DefaultDrainPeriod,
+		"How long live sessions may continue after a shutdown signal")
+	fs.DurationVar((*time.Duration)(&cfg.Sessions.TTL), "session-ttl", srv.DefaultSessionTTL,
+		"How long a disconnected session stays resumable (0 keeps it until ended)")
+	fs.DurationVar((*time.Duration)(&cfg.Keepalive.PingInterval), "ping-interval",
+		time.Duration(cfg.Keepalive.PingInterval), "How often to ping each connection (0 disables keepalive)")
+	fs.DurationVar((*time.Duration)(&cfg.Keepalive.PongTimeout), "pong-timeout",
+		time.Duration(cfg.Keepalive.PongTimeout), "How long a client may take to answer a ping before it is disconnected")
+	fs.DurationVar((*time.Duration)(&cfg.Keepalive.WriteTimeout), "write-timeout",
+		time.Duration(cfg.Keepalive.WriteTimeout), "How long a write to a client may block (0 disables the limit)")
+	fs.StringVar(&cfg.Sessions.File, "session-file", "",
+		"File that unfinished sessions are saved to on shutdown and resumed from on start")
+	fs.StringSliceVar(&cfg.Auth.Admins, "admin", nil,
+		"Principals allowed to use the admin API, as method:id such as api_key:ops")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Log level: debug, info, warn or error")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format: json or text")
+	fs.BoolVar(&cfg.Log.Unredacted, "log-unredacted", false,
+		"Log audio chunks and tool arguments verbatim in debug records")
+	fs.StringVar(&cfg.Tracing.Endpoint, "otlp-endpoint", "",
+		"OTLP/HTTP collector URL that traces are exported to, e.g. http://localhost:4318")
+	fs.Float64Var(&cfg.Tracing.SampleRatio, "trace-sample-ratio", cfg.Tracing.SampleRatio,
+		"Fraction of sessions traced unless the client's trace context decides")
+	fs.StringVar(&cfg.Recording.Dir, "record-dir", "",
+		"Directory that recorded sessions are archived to for twinspeak replay")
+	fs.BoolVar(&cfg.Recording.All, "record-all", false,
+		"Record every session, not only those whose setup sets sessionConfig.record")
+	fs.StringSliceVar(&cfg.Recording.OptIn, "record-opt-in", nil,
+		"Principals whose setup may ask for recording with sessionConfig.record (anonymous for unauthenticated clients)")
+	fs.Int64Var(&cfg.Recording.MaxBytes, "record-max-bytes", cfg.Recording.MaxBytes,
+		"Maximum size of a session archive in bytes; recording stops once it is reached")
+	fs.BoolVar(&cfg.Compression.Enabled, "compression", false,
+		"Accept permessage-deflate from clients that offer it")
+	fs.IntVar(&cfg.Compression.Level, "compression-level", 0,
+		"Deflate level from 1 (fastest) to 9 (smallest); 0 uses the default")
+	fs.BoolVar(&cfg.Compression.ContextTakeover, "compression-context-takeover", false,
+		"Keep the deflate window between messages: better compression for 32 KiB per direction and connection")
+	fs.IntVar(&cfg.Compression.MinSize, "compression-min-size", 0,
+		"Send messages smaller than this many bytes uncompressed")
+}
+
+// envName returns the environment variable that overrides flag name.
+func envName(name string) string {
+	if env, ok := envNames[name]; ok {
+		return env
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// captureFlags records the flags set on the command line so that loadConfig
+// can apply them on top of the file and environment.
+func captureFlags(fs *pflag.FlagSet) {
+	flagValues = make(map[string]func() error)
+	fs.Visit(func(f *pflag.Flag) {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			values := sv.GetSlice()
+			flagValues[f.Name] = func() error { return sv.Replace(values) }
+			return
+		}
+		value := f.Value.String()
+		flagValues[f.Name] = func() error { return f.Value.Set(value) }
+	})
+}
+
+// loadConfig rebuilds cfg from defaults, the config file, the environment
+// and the captured flags, then validates it.
+func loadConfig(fs *pflag.FlagSet) error {
+	cfg = defaultConfig()
+
+	path := configFile
+	if v := os.Getenv(envName("config")); path == "" && v != "" {
+		path = v
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read config: %w", err)
+		}
+		if err := yaml.UnmarshalWithOptions(data, &cfg, yaml.Strict()); err != nil {
+			return fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if _, ok := flagValues[f.Name]; ok || f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	for name, apply := range flagValues {
+		if err := apply(); err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %w", name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if cfg.LimitsFile != "" {
+		limits, err := srv.LoadLimits(cfg.LimitsFile)
+		if err != nil {
+			return err
+		}
+		cfg.Limits = limits
+	}
+	return cfg.Validate()
+}
+
+// Validate reports every inconsistency in the configuration.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr must not be empty"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.certFile and tls.keyFile must be given together"))
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		errs = append(errs, errors.New("tls.clientCAFile requires tls.certFile and tls.keyFile"))
+	}
+	if c.Auth.EphemeralSecretFile != "" && c.Auth.EphemeralSecretFile == c.Auth.TokenSecretFile {
+		errs = append(errs, errors.New("auth.ephemeralSecretFile and auth.tokenSecretFile must differ"))
+	}
+	if c.Sessions.DrainPeriod < 0 || c.Sessions.TTL < 0 {
+		errs = append(errs, errors.New("sessions.drainPeriod and sessions.ttl must not be negative"))
+	}
+	if _, err := srv.NewLogger(io.Discard, c.Log); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, srv.ValidateAdmins(c.Auth.Admins...))
+	errs = append(errs, c.Tracing.Validate(), c.Recording.Validate(), c.Compression.Validate(),
+		c.Keepalive.Validate())
+	m := c.Messages
+	if m.MaxFrameBytes <= 0 || m.MaxAudioBytes <= 0 || m.MaxTextLength <= 0 || m.MaxDepth <= 0 || m.MaxLogBytes <= 0 {
+		errs = append(errs, errors.New("messages limits must be positive"))
+	}
+	for id, l := range c.Limits.Principals {
+		errs = append(errs, validateLimits("limits.principals."+id, l))
+	}
+	errs = append(errs, validateLimits("limits.default", c.Limits.Default))
+	return errors.Join(errs...)
+}
+
+func validateLimits(name string, l srv.Limits) error {
+	if l.MaxSessions < 0 || l.MessagesPerSecond < 0 || l.MessageBurst < 0 ||
+		l.AudioSecondsPerMinute < 0 || l.MaxSessionDuration < 0 {
+		return fmt.Errorf("%s must not be negative", name)
+	}
+	return nil
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the server configuration",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration as YAML",
+	Long: `Print the configuration the server would run with after merging the config file, ` +
+		envPrefix + `* environment variables and flags.`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		captureFlags(cmd.Flags())
+		if err := loadConfig(cmd.Flags()); err != nil {
+			return err
+		}
+		data, err := yaml.MarshalWithOptions(cfg, yaml.IndentSequence(true))
+		if err != nil {
+			return err
+		}
+		_, err = cmd.OutOrStdout().Write(data)
+		return err
+	},
+}
+
+func init() {
+	addServerFlags(configPrintCmd.Flags())
+	configCmd.AddCommand(configPrintCmd)
+	rootCmd.AddCommand(configCmd)
+}
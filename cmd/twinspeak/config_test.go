@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"jig.sx/twinspeak/srv"
+)
+
+// parseFlags binds the server flags to a fresh flag set and parses args
+func parseFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	t.Helper()
+	fs := pflag.NewFlagSet("twinspeak", pflag.ContinueOnError)
+	addServerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	captureFlags(fs)
+	return fs
+}
+
+// writeFile writes data to name in a temporary directory and returns its path
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// TestConfigPrecedence tests that flags override the environment, which overrides the file
+func TestConfigPrecedence(t *testing.T) {
+	path := writeFile(t, "twinspeak.yaml", `
+addr: ":9000"
+allowedOrigins: [file.example.com]
+messages:
+  maxDepth: 8
+limits:
+  default:
+    maxSessions: 2
+    maxSessionDuration: 30m
+sessions:
+  drainPeriod: 20s
+`)
+	t.Setenv("TWINSPEAK_ADDR", ":9100")
+	t.Setenv("TWINSPEAK_ALLOWED_ORIGINS", "env.example.com,*.env.example.com")
+	t.Setenv("TWINSPEAK_MAX_JSON_DEPTH", "12")
+
+	fs := parseFlags(t, "--config", path, "--max-json-depth", "16")
+	if err := loadConfig(fs); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Addr != ":9100" {
+		t.Errorf("Expected addr from the environment, got %s", cfg.Addr)
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[0] != "env.example.com" {
+		t.Errorf("Expected origins from the environment, got %v", cfg.AllowedOrigins)
+	}
+	if cfg.Messages.MaxDepth != 16 {
+		t.Errorf("Expected max depth from the flag, got %d", cfg.Messages.MaxDepth)
+	}
+	if cfg.Messages.MaxFrameBytes != srv.DefaultMessageLimits.MaxFrameBytes {
+		t.Errorf("Expected default frame limit, got %d", cfg.Messages.MaxFrameBytes)
+	}
+	if cfg.Limits.Default.MaxSessions != 2 || time.Duration(cfg.Limits.Default.MaxSessionDuration) != 30*time.Minute {
+		t.Errorf("Expected limits from the file, got %+v", cfg.Limits.Default)
+	}
+	if time.Duration(cfg.Sessions.DrainPeriod) != 20*time.Second {
+		t.Errorf("Expected drain period from the file, got %s", time.Duration(cfg.Sessions.DrainPeriod))
+	}
+}
+
+// TestConfigValidation tests that invalid configurations are rejected on load
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+	}{
+		{name: "Unknown field", config: `{"adress": ":9000"}`},
+		{name: "Certificate without key", config: `{"tls": {"certFile": "tls.crt"}}`},
+		{name: "Client CA without TLS", args: []string{"--client-ca", "ca.pem"}},
+		{name: "Negative limit", config: `{"limits": {"default": {"maxSessions": -1}}}`},
+		{name: "Zero message limit", config: `{"messages": {"maxTextLength": 0}}`},
+		{name: "Invalid duration", config: `{"sessions": {"drainPeriod": "soon"}}`},
+		{name: "Unknown log level", args: []string{"--log-level", "verbose"}},
+		{name: "Unknown log format", config: `{"log": {"format": "xml"}}`},
+		{name: "Tracing endpoint without scheme", args: []string{"--otlp-endpoint", "localhost:4318"}},
+		{name: "Sample ratio above one", config: `{"tracing": {"sampleRatio": 2}}`},
+		{name: "Missing recording directory", args: []string{"--record-dir", "/nonexistent/recordings"}},
+		{name: "Negative recording limit", args: []string{"--record-max-bytes", "-1"}},
+		{name: "Compression level above nine", args: []string{"--compression", "--compression-level", "10"}},
+		{name: "Negative compression threshold", config: `{"compression": {"minSize": -1}}`},
+		{name: "Ping interval without pong timeout", args: []string{"--pong-timeout", "0"}},
+		{name: "Admin without method", args: []string{"--admin", "ops"}},
+		{name: "Ephemeral admin", args: []string{"--admin", "ephemeral:ops"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.config != "" {
+				args = append(args, "--config", writeFile(t, "twinspeak.json", tt.config))
+			}
+			if err := loadConfig(parseFlags(t, args...)); err == nil {
+				t.Error("Expected the configuration to be rejected")
+			}
+		})
+	}
+}
+
+// TestReload tests that a reload swaps API keys and keeps the old config when the new one is invalid
+func TestReload(t *testing.T) {
+	keysFile := writeFile(t, "keys", "alice:first-key\n")
+	configPath := writeFile(t, "twinspeak.yaml", "auth:\n  apiKeysFile: "+keysFile+"\n")
+	fs := parseFlags(t, "--config", configPath)
+	if err := loadConfig(fs); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	opts, apiKeys, err := authOptions(cfg.Auth)
+	if err != nil {
+		t.Fatalf("Failed to configure authentication: %v", err)
+	}
+	server := srv.New(opts...)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	status := func(key string) int {
+		req, _ := http.NewRequest(http.MethodGet, httpServer.URL+"/v1/admin/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if err := os.WriteFile(keysFile, []byte("alice:second-key\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	reload(fs, server, apiKeys)
+	if got := status("first-key"); got != http.StatusUnauthorized {
+		t.Errorf("Expected the old key to be rejected, got %d", got)
+	}
+	if got := status("second-key"); got == http.StatusUnauthorized {
+		t.Errorf("Expected the new key to be accepted, got %d", got)
+	}
+
+	if err := os.WriteFile(configPath, []byte("addr: [broken"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	reload(fs, server, apiKeys)
+	if cfg.Auth.APIKeysFile != keysFile {
+		t.Errorf("Expected the previous config to be kept, got %+v", cfg.Auth)
+	}
+}
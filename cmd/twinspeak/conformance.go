@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"jig.sx/twinspeak/pkg/conformance"
+)
+
+var conformanceFlags struct {
+	clientFlags
+	timeout time.Duration
+}
+
+var conformanceCmd = &cobra.Command{
+	Use:   "conformance",
+	Short: "Check that a server or proxy follows the /v1/speak protocol",
+	Long: `Run the protocol conformance checks against the endpoint at --url and print the
+outcome of each. The checks cover setup ordering, error codes, the session lifecycle,
+resumption, tool results and binary frames, and every server message is checked
+against the spec. The command fails if any check does.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+		h := make(http.Header)
+		if token := conformanceFlags.bearer(); token != "" {
+			h.Set("Authorization", "Bearer "+token)
+		}
+		results := conformance.Run(ctx, conformance.Config{
+			URL:     conformanceFlags.url,
+			Model:   conformanceFlags.model,
+			Header:  h,
+			Timeout: conformanceFlags.timeout,
+		})
+
+		out := cmd.OutOrStdout()
+		failed := 0
+		for _, r := range results {
+			if r.Err != nil {
+				failed++
+				fmt.Fprintf(out, "FAIL  %s: %v\n", r.Name, r.Err)
+				continue
+			}
+			fmt.Fprintf(out, "ok    %s\n", r.Name)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		fmt.Fprintf(out, "All %d checks passed\n", len(results))
+		return nil
+	},
+}
+
+func init() {
+	fs := conformanceCmd.Flags()
+	conformanceFlags.addConnection(fs)
+	fs.StringVar(&conformanceFlags.model, "model", "gemini-1.5-flash", "Model to set sessions up with")
+	fs.DurationVar(&conformanceFlags.timeout, "timeout", conformance.DefaultTimeout,
+		"How long to wait for each server message")
+	rootCmd.AddCommand(conformanceCmd)
+}
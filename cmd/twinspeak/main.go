@@ -2,45 +2,287 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
+	"jig.sx/twinspeak/pkg/session"
 	"jig.sx/twinspeak/srv"
 )
 
-var (
-	addr string
-)
+// shutdownGrace is the time allowed after the drain period for closing
+// connections and persisting sessions.
+const shutdownGrace = 5 * time.Second
+
+// apiKeysEnv names the environment variable holding "principal:key" pairs.
+const apiKeysEnv = "TWINSPEAK_API_KEYS"
 
 var rootCmd = &cobra.Command{
 	Use:   "twinspeak",
 	Short: "Twinspeak - Real-time conversational AI over WebSocket connections",
 	Long: `Twinspeak provides real-time conversational AI capabilities over WebSocket connections ` +
 		`with support for text and audio communication.`,
-	Run: func(_ *cobra.Command, _ []string) {
-		server := srv.New()
+	// Errors are returned rather than exited on, so that deferred calls
+	// such as flushing traces still run; main reports them.
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		captureFlags(cmd.Flags())
+		if err := loadConfig(cmd.Flags()); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+		logger, err := srv.NewLogger(os.Stderr, cfg.Log)
+		if err != nil {
+			return fmt.Errorf("invalid log configuration: %w", err)
+		}
+		slog.SetDefault(logger)
+		tlsConfig, certAuth, err := tlsOptions(cfg.TLS)
+		if err != nil {
+			return fmt.Errorf("configure TLS: %w", err)
+		}
+		opts, apiKeys, err := authOptions(cfg.Auth, certAuth...)
+		if err != nil {
+			return fmt.Errorf("configure authentication: %w", err)
+		}
+		opts = append(opts,
+			srv.WithLogger(logger),
+			srv.WithLimits(cfg.Limits),
+			srv.WithMessageLimits(cfg.Messages),
+			srv.WithAllowedOrigins(cfg.AllowedOrigins...),
+			srv.WithDrainPeriod(time.Duration(cfg.Sessions.DrainPeriod)),
+			srv.WithSessionTTL(time.Duration(cfg.Sessions.TTL)),
+			srv.WithRecording(cfg.Recording),
+			srv.WithCompression(cfg.Compression),
+			srv.WithKeepalive(cfg.Keepalive))
+		if cfg.Log.Unredacted {
+			opts = append(opts, srv.WithUnredactedPayloads())
+		}
+		if cfg.Log.Level == "debug" {
+			opts = append(opts, srv.WithOutboundValidation())
+		}
+		tp, err := srv.NewTracerProvider(context.Background(), cfg.Tracing)
+		if err != nil {
+			return fmt.Errorf("configure tracing: %w", err)
+		}
+		if tp != nil {
+			opts = append(opts, srv.WithTracerProvider(tp))
+			defer flushTraces(tp)
+		}
+		if cfg.Sessions.File != "" {
+			opts = append(opts, srv.WithPersister(session.NewFilePersister(cfg.Sessions.File)))
+		}
+		server := srv.New(opts...)
+		if n, err := server.Restore(context.Background()); err != nil {
+			return fmt.Errorf("restore sessions: %w", err)
+		} else if n > 0 {
+			slog.Info("Restored sessions", "sessions", n, "file", cfg.Sessions.File)
+		}
 
-		fmt.Printf("Starting Twinspeak server on %s\n", addr)
-		log.Printf("Server listening on %s", addr)
+		fmt.Printf("Starting Twinspeak server on %s\n", cfg.Addr)
+		slog.Info("Server listening", "addr", cfg.Addr)
 
 		httpServer := &http.Server{
-			Addr:              addr,
+			Addr:              cfg.Addr,
 			Handler:           server.Handler(),
 			ReadHeaderTimeout: 30 * time.Second,
+			TLSConfig:         tlsConfig,
 		}
-		if err := httpServer.ListenAndServe(); err != nil {
-			log.Fatalf("Server failed to start: %v", err)
+		drainPeriod := time.Duration(cfg.Sessions.DrainPeriod)
+		if err := serve(server, httpServer, drainPeriod, func() { reload(cmd.Flags(), server, apiKeys) }); err != nil {
+			return fmt.Errorf("server failed: %w", err)
 		}
+		return nil
 	},
 }
 
+// serve runs httpServer until SIGINT or SIGTERM, then drains live sessions
+// before shutting the HTTP server down. SIGHUP calls onReload.
+func serve(server *srv.Server, httpServer *http.Server, drainPeriod time.Duration, onReload func()) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	errc := make(chan error, 1)
+	go func() {
+		if httpServer.TLSConfig != nil {
+			errc <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			errc <- httpServer.ListenAndServe()
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case err := <-errc:
+			return err
+		case <-hup:
+			onReload()
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	stop()
+
+	slog.Info("Shutting down, draining sessions", "drain_period", drainPeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainPeriod+shutdownGrace)
+	defer cancel()
+	drainErr := server.Shutdown(shutdownCtx)
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if drainErr != nil {
+		return fmt.Errorf("drain sessions: %w", drainErr)
+	}
+	slog.Info("Server stopped")
+	return nil
+}
+
+// reload re-reads the configuration and applies the sections that are safe
+// to change on a running server: limits, allowed origins and API keys.
+func reload(fs *pflag.FlagSet, server *srv.Server, apiKeys *srv.APIKeys) {
+	previous := cfg
+	if err := loadConfig(fs); err != nil {
+		cfg = previous
+		slog.Error("Keeping previous configuration", "error", err)
+		return
+	}
+
+	server.SetLimits(cfg.Limits)
+	server.SetAllowedOrigins(cfg.AllowedOrigins...)
+	switch keys, err := srv.LoadAPIKeys(cfg.Auth.APIKeysFile, apiKeysEnv); {
+	case err != nil:
+		slog.Error("Keeping previous API keys", "error", err)
+	case apiKeys != nil:
+		apiKeys.Replace(keys)
+	case len(keys) > 0:
+		slog.Warn("API keys were not configured at startup; restart to enable them")
+	}
+
+	if !reflect.DeepEqual(withoutReloadable(previous), withoutReloadable(cfg)) {
+		slog.Warn("Configuration changes outside limits, allowedOrigins and auth.apiKeysFile need a restart")
+	}
+	slog.Info("Reloaded configuration")
+}
+
+// withoutReloadable clears the sections that reload applies.
+func withoutReloadable(c Config) Config {
+	c.Limits, c.LimitsFile = srv.LimitsConfig{}, ""
+	c.AllowedOrigins = nil
+	c.Auth.APIKeysFile = ""
+	return c
+}
+
+// tlsOptions builds the TLS configuration and, with a client CA, an
+// authenticator for verified client certificates.
+func tlsOptions(c TLSConfig) (*tls.Config, []srv.Authenticator, error) {
+	if c.CertFile == "" {
+		return nil, nil, nil
+	}
+
+	reloader, err := srv.NewCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.ClientCAFile == "" {
+		return srv.TLSConfig(reloader, nil), nil, nil
+	}
+	pool, err := srv.LoadClientCAs(c.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srv.TLSConfig(reloader, pool), []srv.Authenticator{srv.ClientCertificates{}}, nil
+}
+
+// authOptions builds the authenticators from c. The API key authenticator is
+// returned separately so that reload can replace its keys.
+func authOptions(c AuthConfig, authenticators ...srv.Authenticator) ([]srv.Option, *srv.APIKeys, error) {
+	var tokenSecret []byte
+	var apiKeys *srv.APIKeys
+
+	keys, err := srv.LoadAPIKeys(c.APIKeysFile, apiKeysEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) > 0 {
+		apiKeys = srv.NewAPIKeys(keys)
+		authenticators = append(authenticators, apiKeys)
+	}
+
+	if c.TokenSecretFile != "" {
+		secret, err := readSecret(c.TokenSecretFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokenSecret = secret
+		authenticators = append(authenticators, srv.NewHMACTokens(secret))
+	}
+
+	if c.JWKSFile != "" {
+		keySet, err := srv.LoadJWKS(c.JWKSFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		authenticators = append(authenticators, srv.NewJWTVerifier(keySet, c.JWTIssuer, c.JWTAudience))
+	}
+
+	opts := []srv.Option{srv.WithAuthenticators(authenticators...), srv.WithAdmins(c.Admins...)}
+	if c.EphemeralSecretFile != "" {
+		if len(authenticators) == 0 {
+			return nil, nil, fmt.Errorf("ephemeral tokens require server-side credentials to mint them")
+		}
+		secret, err := readSecret(c.EphemeralSecretFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if bytes.Equal(secret, tokenSecret) {
+			return nil, nil, fmt.Errorf("token and ephemeral token secrets must differ")
+		}
+		opts = append(opts, srv.WithEphemeralTokens(srv.NewEphemeralTokens(secret)))
+	}
+	if len(authenticators) == 0 {
+		slog.Warn("No credentials configured, authentication is disabled")
+	}
+	return opts, apiKeys, nil
+}
+
+// flushTraces exports the spans still buffered in tp.
+func flushTraces(tp *sdktrace.TracerProvider) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if err := tp.Shutdown(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+}
+
+func readSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read secret: %w", err)
+	}
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("secret in %s must be at least 32 bytes", path)
+	}
+	return secret, nil
+}
+
 func init() {
-	rootCmd.Flags().StringVar(&addr, "addr", ":8080", "Address to listen on (default :8080)")
+	addServerFlags(rootCmd.Flags())
 }
 
 func main() {
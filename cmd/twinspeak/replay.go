@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/spf13/cobra"
+
+	"jig.sx/twinspeak/pkg/recording"
+	"jig.sx/twinspeak/srv"
+)
+
+// replaySettle is how long replay waits for unexpected frames after the
+// last recorded one.
+const replaySettle = 200 * time.Millisecond
+
+var replayFlags struct {
+	clientFlags
+	speed   float64
+	timeout time.Duration
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay ARCHIVE",
+	Short: "Replay a recorded session against a server and compare the replies",
+	Long: `Send the client frames of an archive recorded with --record-dir to a server, paced
+as recorded unless --speed says otherwise, and compare every server frame with the
+recorded one. Resumption handles and call IDs are matched up rather than compared, and
+a recording that starts by resuming a session replays as a new session. Every
+divergence is printed and makes the command fail.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		header, frames, err := recording.Read(f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+		conn, err := replayFlags.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(cmd.ErrOrStderr(), "Replaying session %s (%s) recorded %s\n",
+			header.SessionID, header.Model, header.Started.Format(time.RFC3339))
+		r := &replayer{conn: conn, speed: replayFlags.speed, timeout: replayFlags.timeout, diag: cmd.ErrOrStderr()}
+		return r.replay(ctx, frames, cmd.OutOrStdout())
+	},
+}
+
+// dial opens a raw WebSocket connection, as replay sends frames verbatim
+// rather than through a client.
+func (f *clientFlags) dial(ctx context.Context) (net.Conn, error) {
+	h := make(http.Header)
+	if token := f.bearer(); token != "" {
+		h.Set("Authorization", "Bearer "+token)
+	}
+	d := ws.Dialer{Protocols: []string{srv.Subprotocol}, Header: ws.HandshakeHeaderHTTP(h)}
+	conn, br, _, err := d.Dial(ctx, f.url)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", f.url, err)
+	}
+	if br != nil {
+		// The server has nothing to say before the first client frame.
+		ws.PutReader(br)
+	}
+	return conn, nil
+}
+
+// replayer sends recorded client frames and checks the server's replies.
+type replayer struct {
+	conn    net.Conn
+	speed   float64
+	timeout time.Duration
+	diag    io.Writer
+	matcher *recording.Matcher
+	// received delivers server frames; readErr is why it was closed.
+	received chan []byte
+	readErr  error
+}
+
+// replay runs through frames and returns an error if the server diverged.
+func (r *replayer) replay(ctx context.Context, frames []recording.Frame, out io.Writer) error {
+	r.matcher = recording.NewMatcher()
+	r.received = make(chan []byte, 16)
+	go r.read()
+
+	start := time.Now()
+	var sent, matched, diverged int
+	for i, f := range frames {
+		if f.Direction == recording.Inbound {
+			if err := r.send(ctx, start, f); err != nil {
+				return fmt.Errorf("send frame %d: %w", i+1, err)
+			}
+			sent++
+			continue
+		}
+		err := r.expect(ctx, f)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Fprintf(r.diag, "Frame %d: %v\n", i+1, err)
+			diverged++
+			if errors.Is(err, errMissingFrame) {
+				break
+			}
+			continue
+		}
+		matched++
+	}
+	select {
+	case data, ok := <-r.received:
+		if ok {
+			fmt.Fprintf(r.diag, "After the last frame: unexpected %s\n", data)
+			diverged++
+		}
+	case <-time.After(replaySettle):
+	}
+
+	fmt.Fprintf(out, "Sent %d frames, %d server frames matched, %d diverged\n", sent, matched, diverged)
+	if diverged > 0 {
+		return fmt.Errorf("replay diverged from the recording in %d frames", diverged)
+	}
+	return nil
+}
+
+var errMissingFrame = errors.New("missing server frame")
+
+// send waits until f is due and sends it with its IDs rewritten.
+func (r *replayer) send(ctx context.Context, start time.Time, f recording.Frame) error {
+	if r.speed > 0 {
+		select {
+		case <-time.After(time.Until(start.Add(time.Duration(float64(f.Offset()) / r.speed)))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.Binary != nil {
+		return wsutil.WriteClientBinary(r.conn, f.Binary)
+	}
+	return wsutil.WriteClientText(r.conn, r.matcher.Rewrite([]byte(f.Text)))
+}
+
+// expect compares the next server frame with the recorded f.
+func (r *replayer) expect(ctx context.Context, f recording.Frame) error {
+	select {
+	case data, ok := <-r.received:
+		if !ok {
+			return fmt.Errorf("%w: connection closed (%v), expected %s", errMissingFrame, r.readErr, f.Data())
+		}
+		return r.matcher.Match(f.Data(), data)
+	case <-time.After(r.timeout):
+		return fmt.Errorf("%w: nothing within %s, expected %s", errMissingFrame, r.timeout, f.Data())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *replayer) read() {
+	defer close(r.received)
+	for {
+		data, _, err := wsutil.ReadServerData(r.conn)
+		if err != nil {
+			r.readErr = err
+			return
+		}
+		r.received <- data
+	}
+}
+
+func init() {
+	fs := replayCmd.Flags()
+	replayFlags.addConnection(fs)
+	fs.Float64Var(&replayFlags.speed, "speed", 1, "Pace relative to the recording; 0 sends as fast as possible")
+	fs.DurationVar(&replayFlags.timeout, "timeout", 5*time.Second, "How long to wait for each server frame")
+	rootCmd.AddCommand(replayCmd)
+}
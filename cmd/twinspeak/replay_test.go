@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jig.sx/twinspeak/pkg/recording"
+	"jig.sx/twinspeak/srv"
+)
+
+// TestReplay tests that a recorded session replays cleanly against a new server and that changed replies fail it
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	server := srv.New(srv.WithRecording(srv.RecordingConfig{Dir: dir, All: true}))
+	recorded := httptest.NewServer(server.Handler())
+	defer recorded.Close()
+	flags := clientFlags{url: "ws" + strings.TrimPrefix(recorded.URL, "http") + "/v1/speak", model: "gemini-1.5-flash"}
+	ctx := context.Background()
+	c, err := flags.connect(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	var out, diag bytes.Buffer
+	if err := chat(ctx, c, strings.NewReader("hello\nagain\n"), &out, &diag, nil); err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	// The server closes the archive once the connection is done with.
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one recording, got %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("Failed to open recording: %v", err)
+	}
+	_, frames, err := recording.Read(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+
+	replay := func(frames []recording.Frame) (string, error) {
+		target := httptest.NewServer(srv.New().Handler())
+		defer target.Close()
+		replayFlags := clientFlags{url: "ws" + strings.TrimPrefix(target.URL, "http") + "/v1/speak"}
+		conn, err := replayFlags.dial(ctx)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		var out, diag bytes.Buffer
+		r := &replayer{conn: conn, speed: 10, timeout: time.Second, diag: &diag}
+		err = r.replay(ctx, frames, &out)
+		return out.String() + diag.String(), err
+	}
+
+	if report, err := replay(frames); err != nil {
+		t.Fatalf("Expected the replay to match, got %v:\n%s", err, report)
+	}
+
+	for i, f := range frames {
+		if strings.Contains(f.Text, "[echo] again") {
+			frames[i].Text = strings.Replace(f.Text, "again", "once more", 1)
+		}
+	}
+	report, err := replay(frames)
+	if err == nil {
+		t.Fatal("Expected a changed reply to fail the replay")
+	}
+	if !strings.Contains(report, "1 diverged") || !strings.Contains(report, "once more") {
+		t.Errorf("Expected the divergence to be reported, got:\n%s", report)
+	}
+}
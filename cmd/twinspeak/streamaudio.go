@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"jig.sx/twinspeak/pkg/audio"
+	"jig.sx/twinspeak/pkg/client"
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+var streamFlags struct {
+	clientFlags
+	format     string
+	chunk      time.Duration
+	speed      float64
+	idle       time.Duration
+	sampleRate int
+	channels   int
+	output     string
+	outputRate int
+	report     string
+}
+
+var streamAudioCmd = &cobra.Command{
+	Use:   "stream-audio FILE",
+	Short: "Stream an audio file to a server and report latencies",
+	Long: `Send a 16-bit PCM WAV or raw PCM file as input_audio chunks, paced in real time
+unless --speed says otherwise, with the last chunk marked final. Returned output_audio
+is saved to --output as WAV and a JSON timing report is written to --report: the time
+from the first chunk to the first output and, for each chunk, the time until the next
+output that followed it.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		in, pcm, err := readAudioFile(args[0], audio.Format{SampleRate: streamFlags.sampleRate,
+			Channels: streamFlags.channels})
+		if err != nil {
+			return err
+		}
+		if streamFlags.format == string(g.ClientInputAudioJsonFormatPcm16) && in != audio.Speech {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: servers assume pcm16 is %d Hz mono, the file is %d Hz with %d channels\n",
+				audio.Speech.SampleRate, in.SampleRate, in.Channels)
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+		c, err := streamFlags.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		s := &streamer{
+			c:      c,
+			in:     in,
+			format: g.ClientInputAudioJsonFormat(streamFlags.format),
+			chunk:  streamFlags.chunk,
+			speed:  streamFlags.speed,
+			idle:   streamFlags.idle,
+			out:    audio.Format{SampleRate: streamFlags.outputRate, Channels: 1},
+		}
+		report, err := s.stream(ctx, pcm)
+		if err != nil {
+			return err
+		}
+		if err := c.End(ctx, "stream finished"); err != nil {
+			return fmt.Errorf("end session: %w", err)
+		}
+		return s.save(cmd.OutOrStdout(), report)
+	},
+}
+
+// readAudioFile reads a WAV file, or raw PCM in format raw.
+func readAudioFile(path string, raw audio.Format) (audio.Format, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return audio.Format{}, nil, err
+	}
+	f, pcm, err := audio.DecodeWAV(data)
+	if errors.Is(err, audio.ErrNotWAV) {
+		if raw.SampleRate <= 0 || raw.Channels <= 0 {
+			return audio.Format{}, nil, errors.New("raw PCM needs a positive sample rate and channel count")
+		}
+		return raw, data, nil
+	}
+	return f, pcm, err
+}
+
+// streamReport is the JSON timing report of stream-audio.
+type streamReport struct {
+	Chunks            int       `json:"chunks"`
+	AudioSeconds      float64   `json:"audioSeconds"`
+	DurationMs        float64   `json:"durationMs"`
+	TimeToFirstByteMs float64   `json:"timeToFirstByteMs"`
+	ChunkLatencyMs    []float64 `json:"chunkLatencyMs"`
+	OutputAudioBytes  int       `json:"outputAudioBytes"`
+	Errors            []string  `json:"errors,omitempty"`
+}
+
+// streamer sends audio in chunks while timing the outputs that come back.
+type streamer struct {
+	c      *client.Client
+	in     audio.Format
+	format g.ClientInputAudioJsonFormat
+	chunk  time.Duration
+	speed  float64
+	idle   time.Duration
+	out    audio.Format
+	output []byte
+
+	// unanswered holds the send times of chunks that no output has
+	// followed yet. The sender appends before sending so that a fast
+	// reply cannot overtake its own timestamp.
+	mu         sync.Mutex
+	unanswered []time.Time
+	start      time.Time
+}
+
+// stream sends pcm and collects outputs until the server has answered the
+// final chunk or stayed quiet for the idle period.
+func (s *streamer) stream(ctx context.Context, pcm []byte) (streamReport, error) {
+	if s.format != g.ClientInputAudioJsonFormatPcm16 && s.format != g.ClientInputAudioJsonFormatWav {
+		return streamReport{}, fmt.Errorf("format must be pcm16 or wav, got %q", s.format)
+	}
+	chunks := split(pcm, max(s.in.Bytes(s.chunk), s.in.Channels*2))
+	report := streamReport{Chunks: len(chunks), AudioSeconds: s.in.Duration(len(pcm)).Seconds()}
+
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- s.send(ctx, chunks) }()
+	sending := true
+	idle := time.NewTimer(time.Hour)
+	defer idle.Stop()
+	for {
+		select {
+		case err := <-sendErr:
+			if err != nil {
+				return report, err
+			}
+			sending = false
+			idle.Reset(s.idle)
+		case ev, ok := <-s.c.Events():
+			if !ok {
+				return report, fmt.Errorf("connection lost: %w", s.c.Err())
+			}
+			answered, final := s.observe(ev, &report)
+			if !sending && answered && final {
+				return s.finish(report), nil
+			}
+			if !sending {
+				idle.Reset(s.idle)
+			}
+		case <-idle.C:
+			return s.finish(report), nil
+		case <-ctx.Done():
+			return report, ctx.Err()
+		}
+	}
+}
+
+// send paces chunks at speed times real time; zero sends them back to back.
+func (s *streamer) send(ctx context.Context, chunks [][]byte) error {
+	start := time.Now()
+	var offset time.Duration
+	for i, chunk := range chunks {
+		if s.speed > 0 {
+			select {
+			case <-time.After(time.Until(start.Add(time.Duration(float64(offset) / s.speed)))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		offset += s.in.Duration(len(chunk))
+
+		data := chunk
+		if s.format == g.ClientInputAudioJsonFormatWav {
+			data = audio.EncodeWAV(s.in, chunk)
+		}
+		s.mu.Lock()
+		now := time.Now()
+		if s.start.IsZero() {
+			s.start = now
+		}
+		s.unanswered = append(s.unanswered, now)
+		s.mu.Unlock()
+		if err := s.c.SendAudio(ctx, s.format, data, i == len(chunks)-1); err != nil {
+			return fmt.Errorf("send chunk %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// observe records the timing and audio of an output event. It reports
+// whether every chunk has been answered and whether ev ends a response.
+func (s *streamer) observe(ev client.Event, report *streamReport) (answered, final bool) {
+	switch ev := ev.(type) {
+	case g.ServerOutputTextJson:
+		final = ev.Final
+	case g.ServerOutputAudioJson:
+		final = ev.Final
+		s.collect(ev, report)
+	case g.ErrorJson:
+		report.Errors = append(report.Errors, ev.Code+": "+ev.Message)
+		return false, false
+	default:
+		return false, false
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if report.TimeToFirstByteMs == 0 && !s.start.IsZero() {
+		report.TimeToFirstByteMs = milliseconds(now.Sub(s.start))
+	}
+	if len(s.unanswered) > 0 {
+		report.ChunkLatencyMs = append(report.ChunkLatencyMs, milliseconds(now.Sub(s.unanswered[0])))
+		s.unanswered = s.unanswered[1:]
+	}
+	return len(s.unanswered) == 0, final
+}
+
+// collect appends the samples of an output_audio chunk to the output.
+func (s *streamer) collect(ev g.ServerOutputAudioJson, report *streamReport) {
+	data, err := base64.StdEncoding.DecodeString(ev.Chunk)
+	if err != nil {
+		report.Errors = append(report.Errors, "undecodable output_audio: "+err.Error())
+		return
+	}
+	report.OutputAudioBytes += len(data)
+	switch ev.Format {
+	case g.ServerOutputAudioJsonFormatWav:
+		f, pcm, err := audio.DecodeWAV(data)
+		if err != nil {
+			report.Errors = append(report.Errors, "unreadable WAV output: "+err.Error())
+			return
+		}
+		s.out, s.output = f, append(s.output, pcm...)
+	case g.ServerOutputAudioJsonFormatPcm16:
+		s.output = append(s.output, data...)
+	default:
+		report.Errors = append(report.Errors, fmt.Sprintf("%s output cannot be saved as WAV", ev.Format))
+	}
+}
+
+func (s *streamer) finish(report streamReport) streamReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report.DurationMs = milliseconds(time.Since(s.start))
+	return report
+}
+
+// save writes the output audio and the report as configured by the flags.
+func (s *streamer) save(stdout io.Writer, report streamReport) error {
+	if streamFlags.output != "" {
+		if err := os.WriteFile(streamFlags.output, audio.EncodeWAV(s.out, s.output), 0o644); err != nil {
+			return fmt.Errorf("write output audio: %w", err)
+		}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if streamFlags.report == "-" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(streamFlags.report, data, 0o644)
+}
+
+// split cuts data into chunks of size bytes; the last may be shorter.
+func split(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func init() {
+	fs := streamAudioCmd.Flags()
+	streamFlags.add(fs)
+	fs.StringVar(&streamFlags.format, "format", "pcm16", "Format of the input_audio chunks: pcm16 or wav")
+	fs.DurationVar(&streamFlags.chunk, "chunk", 100*time.Millisecond, "Duration of audio per chunk")
+	fs.Float64Var(&streamFlags.speed, "speed", 1, "Pace relative to real time; 0 sends as fast as possible")
+	fs.DurationVar(&streamFlags.idle, "idle", 2*time.Second,
+		"How long to wait for more output after the last chunk before ending the session")
+	fs.IntVar(&streamFlags.sampleRate, "sample-rate", audio.Speech.SampleRate, "Sample rate of raw PCM input")
+	fs.IntVar(&streamFlags.channels, "channels", audio.Speech.Channels, "Channel count of raw PCM input")
+	fs.StringVar(&streamFlags.output, "output", "", "WAV file that returned output_audio is written to")
+	fs.IntVar(&streamFlags.outputRate, "output-sample-rate", 24000, "Sample rate of pcm16 output_audio")
+	fs.StringVar(&streamFlags.report, "report", "-", "File the JSON timing report is written to, - for stdout")
+	rootCmd.AddCommand(streamAudioCmd)
+}
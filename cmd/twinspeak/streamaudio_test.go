@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jig.sx/twinspeak/pkg/audio"
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/srv"
+)
+
+// TestStreamAudio tests that every chunk of a file is sent and timed
+func TestStreamAudio(t *testing.T) {
+	httpServer := httptest.NewServer(srv.New().Handler())
+	defer httpServer.Close()
+
+	flags := clientFlags{
+		url:   "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak",
+		model: "gemini-1.5-flash",
+	}
+	ctx := context.Background()
+	c, err := flags.connect(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	formats := []g.ClientInputAudioJsonFormat{g.ClientInputAudioJsonFormatPcm16, g.ClientInputAudioJsonFormatWav}
+	for _, format := range formats {
+		s := &streamer{c: c, in: audio.Speech, format: format, chunk: 100 * time.Millisecond, idle: 5 * time.Second}
+		report, err := s.stream(ctx, make([]byte, audio.Speech.Bytes(950*time.Millisecond)))
+		if err != nil {
+			t.Fatalf("Failed to stream %s audio: %v", format, err)
+		}
+		if report.Chunks != 10 || len(report.ChunkLatencyMs) != 10 {
+			t.Errorf("Expected 10 timed chunks, got %d chunks and %d latencies", report.Chunks, len(report.ChunkLatencyMs))
+		}
+		if report.TimeToFirstByteMs <= 0 || report.AudioSeconds != 0.95 || len(report.Errors) > 0 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package audio reads and writes the 16-bit PCM audio exchanged with
+// Twinspeak servers, raw or in WAV files.
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// WAVHeaderSize is the size of the canonical header written by EncodeWAV.
+const WAVHeaderSize = 44
+
+// ErrNotWAV is returned by DecodeWAV for data without a RIFF/WAVE header.
+var ErrNotWAV = errors.New("not a WAV file")
+
+// Format describes 16-bit little-endian PCM audio.
+type Format struct {
+	SampleRate int
+	Channels   int
+}
+
+// Speech is the format servers assume for pcm16 input: 16 kHz mono.
+var Speech = Format{SampleRate: 16000, Channels: 1}
+
+// BytesPerSecond returns the data rate of f.
+func (f Format) BytesPerSecond() int {
+	return f.SampleRate * f.Channels * 2
+}
+
+// Duration returns how long n bytes of f last.
+func (f Format) Duration(n int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(f.BytesPerSecond())
+}
+
+// Bytes returns the size of d of audio in f, rounded down to whole frames.
+func (f Format) Bytes(d time.Duration) int {
+	frame := f.Channels * 2
+	return int(d*time.Duration(f.BytesPerSecond())/time.Second) / frame * frame
+}
+
+// EncodeWAV returns pcm as a WAV file with a canonical 44-byte header.
+func EncodeWAV(f Format, pcm []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(WAVHeaderSize + len(pcm))
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	_ = binary.Write(&buf, binary.LittleEndian, struct {
+		Size          uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{16, 1, uint16(f.Channels), uint32(f.SampleRate), uint32(f.BytesPerSecond()), uint16(f.Channels * 2), 16})
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return buf.Bytes()
+}
+
+// DecodeWAV returns the format and samples of a 16-bit PCM WAV file. Chunks
+// other than fmt and data are skipped.
+func DecodeWAV(data []byte) (Format, []byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return Format{}, nil, ErrNotWAV
+	}
+	var f Format
+	var haveFormat bool
+	r := bytes.NewReader(data[12:])
+	for {
+		var hdr struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return Format{}, nil, errors.New("WAV file has no data chunk")
+			}
+			return Format{}, nil, fmt.Errorf("read WAV chunk: %w", err)
+		}
+		if int64(hdr.Size) > int64(r.Len()) {
+			// Streamed WAV files may not know their length up front.
+			hdr.Size = uint32(r.Len())
+		}
+		body := make([]byte, hdr.Size)
+		_, _ = io.ReadFull(r, body)
+		_, _ = r.Seek(int64(hdr.Size%2), io.SeekCurrent)
+
+		switch string(hdr.ID[:]) {
+		case "fmt ":
+			var err error
+			if f, err = decodeFormat(body); err != nil {
+				return Format{}, nil, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return Format{}, nil, errors.New("WAV data chunk precedes its fmt chunk")
+			}
+			return f, body, nil
+		}
+	}
+}
+
+func decodeFormat(body []byte) (Format, error) {
+	if len(body) < 16 {
+		return Format{}, errors.New("WAV fmt chunk too short")
+	}
+	audioFormat := binary.LittleEndian.Uint16(body[0:])
+	channels := binary.LittleEndian.Uint16(body[2:])
+	rate := binary.LittleEndian.Uint32(body[4:])
+	bits := binary.LittleEndian.Uint16(body[14:])
+	// 0xFFFE is WAVE_FORMAT_EXTENSIBLE, which wraps PCM in a larger header.
+	if (audioFormat != 1 && audioFormat != 0xFFFE) || bits != 16 {
+		return Format{}, fmt.Errorf("WAV file must be 16-bit PCM, got format %d with %d bits", audioFormat, bits)
+	}
+	if channels == 0 || rate == 0 {
+		return Format{}, errors.New("WAV file has no channels or sample rate")
+	}
+	return Format{SampleRate: int(rate), Channels: int(channels)}, nil
+}
@@ -0,0 +1,46 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestWAVRoundTrip tests that encoded WAV files decode to the same format and samples
+func TestWAVRoundTrip(t *testing.T) {
+	f := Format{SampleRate: 24000, Channels: 2}
+	pcm := bytes.Repeat([]byte{1, 2, 3, 4}, f.Bytes(10*time.Millisecond)/4)
+
+	data := EncodeWAV(f, pcm)
+	if len(data) != WAVHeaderSize+len(pcm) {
+		t.Fatalf("Expected %d bytes, got %d", WAVHeaderSize+len(pcm), len(data))
+	}
+	got, samples, err := DecodeWAV(data)
+	if err != nil {
+		t.Fatalf("Failed to decode WAV: %v", err)
+	}
+	if got != f || !bytes.Equal(samples, pcm) {
+		t.Errorf("Expected %v with %d bytes, got %v with %d bytes", f, len(pcm), got, len(samples))
+	}
+	if d := f.Duration(len(samples)); d != 10*time.Millisecond {
+		t.Errorf("Expected 10ms of audio, got %s", d)
+	}
+}
+
+// TestDecodeWAVErrors tests that unsupported files are rejected
+func TestDecodeWAVErrors(t *testing.T) {
+	if _, _, err := DecodeWAV([]byte("not audio at all")); !errors.Is(err, ErrNotWAV) {
+		t.Errorf("Expected ErrNotWAV, got %v", err)
+	}
+
+	float := EncodeWAV(Speech, make([]byte, 4))
+	float[20] = 3 // IEEE float
+	if _, _, err := DecodeWAV(float); err == nil {
+		t.Error("Expected non-PCM audio to be rejected")
+	}
+
+	if _, _, err := DecodeWAV(EncodeWAV(Speech, nil)[:36]); err == nil {
+		t.Error("Expected a file without data to be rejected")
+	}
+}
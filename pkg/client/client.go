@@ -0,0 +1,359 @@
+// Package client provides a Go client for the Twinspeak /v1/speak protocol.
+//
+// A Client is created with Dial, configured with Setup and then used to send
+// text, audio and tool results while server messages arrive on Events. If the
+// connection drops after setup, the client reconnects and resumes the session
+// with its latest resumption handle; sends wait until it has.
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// Reconnection defaults, see WithReconnect.
+const (
+	DefaultReconnectAttempts = 5
+	DefaultReconnectBackoff  = 100 * time.Millisecond
+)
+
+const (
+	// subprotocol is offered so that the server can tell SDK clients apart.
+	subprotocol = "twinspeak"
+	// maxReconnectBackoff caps the doubling delay between reconnect attempts.
+	maxReconnectBackoff = 5 * time.Second
+	// resumeTimeout bounds a single reconnect attempt, from dial to the
+	// server confirming the resumed session.
+	resumeTimeout = 10 * time.Second
+	// eventBuffer is how many events may be queued for a slow reader before
+	// the client stops reading from the connection.
+	eventBuffer = 64
+)
+
+// ErrClosed is returned by operations on a client that was closed or ended.
+var ErrClosed = errors.New("client closed")
+
+// ServerError is an error message the server sent in reply to a request.
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %s: %s", e.Code, e.Message)
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken authenticates with a bearer token, such as an API key or an
+// ephemeral token.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithHeader adds headers to the upgrade request, for example to propagate
+// trace context.
+func WithHeader(h http.Header) Option {
+	return func(c *Client) {
+		for k, v := range h {
+			c.header[k] = append(c.header[k], v...)
+		}
+	}
+}
+
+// WithDialer dials with d, for example to configure TLS. Its Protocols and
+// Header are set by the client.
+func WithDialer(d ws.Dialer) Option {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// WithReconnect sets how often the client tries to resume a dropped session
+// and the delay before the first attempt, which doubles on every failure.
+// Zero attempts disables reconnection.
+func WithReconnect(attempts int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.attempts = attempts
+		c.backoff = backoff
+	}
+}
+
+// Client is a connection to /v1/speak. Its methods are safe for concurrent use.
+type Client struct {
+	url      string
+	dialer   ws.Dialer
+	header   http.Header
+	attempts int
+	backoff  time.Duration
+
+	events    chan Event
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	ending    atomic.Bool
+	// err is why the client stopped and is set before done is closed.
+	err error
+
+	// mu guards the current connection and session. ready is closed while
+	// the connection can be written to and replaced while reconnecting;
+	// awaiting receives the outcome of a pending Setup.
+	mu       sync.Mutex
+	conn     net.Conn
+	ready    chan struct{}
+	handle   string
+	setup    *g.SetupRequestJson
+	awaiting chan error
+	// negotiated is the latest setup_complete, nil until the server sent one.
+	negotiated *g.SetupCompleteJson
+
+	writeMu sync.Mutex
+}
+
+// Dial connects to the /v1/speak endpoint at url, such as
+// wss://example.com/v1/speak. ctx bounds the dial only; the connection lasts
+// until Close or End.
+func Dial(ctx context.Context, url string, opts ...Option) (*Client, error) {
+	c := &Client{
+		url:      url,
+		dialer:   ws.DefaultDialer,
+		header:   make(http.Header),
+		attempts: DefaultReconnectAttempts,
+		backoff:  DefaultReconnectBackoff,
+		events:   make(chan Event, eventBuffer),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	conn, reader, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	close(c.ready)
+	go c.run(reader)
+	return c, nil
+}
+
+// Events returns the messages received from the server. The channel is
+// closed once the client is closed or its connection is lost for good; Err
+// then reports why. Events must be consumed, or the client stops reading.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Err returns why the client stopped, or nil while it is running or after
+// it was closed or ended normally.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Handle returns the latest resumption handle of the session.
+func (c *Client) Handle() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handle
+}
+
+// Protocol returns the protocol version and capabilities negotiated by
+// Setup. A client that did not set req.Version or req.Capabilities, or a
+// server that predates negotiation, speaks version 1.0 without capabilities.
+func (c *Client) Protocol() (string, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.negotiated == nil {
+		return "1.0", nil
+	}
+	return c.negotiated.Version, c.negotiated.Capabilities
+}
+
+// Setup configures the session and waits for the server to accept it. Set
+// req.ResumptionHandle to resume a session from an earlier connection, and
+// req.Version and req.Capabilities to negotiate optional features; Protocol
+// then reports what the server agreed to.
+func (c *Client) Setup(ctx context.Context, req g.SetupRequestJson) error {
+	req.Type = "setup"
+	wait := make(chan error, 1)
+	c.mu.Lock()
+	if c.setup != nil {
+		c.mu.Unlock()
+		return errors.New("session already set up")
+	}
+	c.setup, c.awaiting = &req, wait
+	c.mu.Unlock()
+
+	err := c.send(ctx, req)
+	if err == nil {
+		select {
+		case err = <-wait:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-c.done:
+			err = c.stopped()
+		}
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.setup, c.awaiting = nil, nil
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// SendText sends a text turn.
+func (c *Client) SendText(ctx context.Context, text string) error {
+	return c.send(ctx, g.ClientInputTextJson{Type: g.TypeClientInputText, Text: text})
+}
+
+// SendAudio sends a chunk of audio; final marks the end of the turn.
+func (c *Client) SendAudio(ctx context.Context, format g.ClientInputAudioJsonFormat, chunk []byte, final bool) error {
+	return c.send(ctx, g.ClientInputAudioJson{
+		Type:   g.TypeClientInputAudio,
+		Format: format,
+		Chunk:  base64.StdEncoding.EncodeToString(chunk),
+		Final:  final,
+	})
+}
+
+// SendToolResult answers the function_call identified by callID.
+func (c *Client) SendToolResult(ctx context.Context, callID, name string, result any) error {
+	return c.send(ctx, g.ToolResultJson{Type: g.TypeToolResult, CallId: callID, Name: name, Result: result})
+}
+
+// End ends the session, waits for the server to close the connection and
+// closes the client. Events received until then are still delivered.
+func (c *Client) End(ctx context.Context, reason string) error {
+	c.ending.Store(true)
+	if err := c.send(ctx, g.SessionEndJson{Type: g.TypeSessionEnd, Reason: reason}); err != nil {
+		return err
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		_ = c.Close()
+		return ctx.Err()
+	}
+	return c.Close()
+}
+
+// Close closes the connection without ending the session, which stays
+// resumable with Handle until the server expires it.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.quit)
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		c.writeMu.Lock()
+		_ = ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, ""))))
+		c.writeMu.Unlock()
+		if cerr := conn.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// send writes v once the client is connected, failing if ctx is done first.
+func (c *Client) send(ctx context.Context, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// A stopped client is still ready, so done is checked first to fail
+	// every send after End or Close rather than some of them.
+	select {
+	case <-c.done:
+		return c.stopped()
+	default:
+	}
+	c.mu.Lock()
+	ready := c.ready
+	c.mu.Unlock()
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.stopped()
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	return c.write(ctx, conn, data)
+}
+
+// write sends one text frame on conn, honouring the deadline of ctx.
+func (c *Client) write(ctx context.Context, conn net.Conn, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return wsutil.WriteClientMessage(conn, ws.OpText, data)
+}
+
+// stopped returns the error for operations attempted after done is closed.
+func (c *Client) stopped() error {
+	if c.err != nil {
+		return c.err
+	}
+	return ErrClosed
+}
+
+// connect dials the server and returns a reader for its messages.
+func (c *Client) connect(ctx context.Context) (net.Conn, *wsutil.Reader, error) {
+	d := c.dialer
+	d.Protocols = []string{subprotocol}
+	d.Header = ws.HandshakeHeaderHTTP(c.header)
+	conn, br, _, err := d.Dial(ctx, c.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var source io.Reader = conn
+	if br != nil {
+		source = br
+	}
+	control := wsutil.ControlFrameHandler(conn, ws.StateClientSide)
+	reader := &wsutil.Reader{
+		Source:    source,
+		State:     ws.StateClientSide,
+		CheckUTF8: true,
+		OnIntermediate: func(hdr ws.Header, r io.Reader) error {
+			c.writeMu.Lock()
+			defer c.writeMu.Unlock()
+			return control(hdr, r)
+		},
+	}
+	return conn, reader, nil
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/srv"
+)
+
+// startServer runs a Twinspeak server and returns its /v1/speak URL
+func startServer(t *testing.T) string {
+	t.Helper()
+	httpServer := httptest.NewServer(srv.New().Handler())
+	t.Cleanup(httpServer.Close)
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+}
+
+// nextEvent returns the next event that is not a resumption update
+func nextEvent(t *testing.T, c *Client) Event {
+	t.Helper()
+	for {
+		select {
+		case ev, ok := <-c.Events():
+			if !ok {
+				t.Fatalf("Events closed unexpectedly: %v", c.Err())
+			}
+			if _, ok := ev.(g.SessionResumptionUpdateJson); !ok {
+				return ev
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an event")
+		}
+	}
+}
+
+// expectText fails unless the next event is output_text with text
+func expectText(t *testing.T, c *Client, text string) {
+	t.Helper()
+	ev := nextEvent(t, c)
+	if out, ok := ev.(g.ServerOutputTextJson); !ok || out.Text != text {
+		t.Fatalf("Expected output_text %q, got %#v", text, ev)
+	}
+}
+
+// TestClientSession tests a session from setup to end through the client
+func TestClientSession(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dial(ctx, startServer(t))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Setup(ctx, g.SetupRequestJson{Model: "gemini-1.5-flash"}); err != nil {
+		t.Fatalf("Failed to set up session: %v", err)
+	}
+	if !strings.HasPrefix(c.Handle(), "session_") {
+		t.Errorf("Expected a resumption handle, got %q", c.Handle())
+	}
+	if version, caps := c.Protocol(); version != "1.0" || caps != nil {
+		t.Errorf("Expected protocol 1.0 without negotiation, got %s %q", version, caps)
+	}
+	if err := c.Setup(ctx, g.SetupRequestJson{Model: "gemini-1.5-flash"}); err == nil {
+		t.Error("Expected a second setup to fail")
+	}
+
+	if err := c.SendText(ctx, "hello"); err != nil {
+		t.Fatalf("Failed to send text: %v", err)
+	}
+	expectText(t, c, "[echo] hello")
+
+	if err := c.SendAudio(ctx, g.ClientInputAudioJsonFormatPcm16, make([]byte, 320), true); err != nil {
+		t.Fatalf("Failed to send audio: %v", err)
+	}
+	expectText(t, c, "Received audio chunk in pcm16 format (final: true)")
+
+	if err := c.SendToolResult(ctx, "call_1", "lookup", map[string]any{"ok": true}); err != nil {
+		t.Fatalf("Failed to send tool result: %v", err)
+	}
+
+	if err := c.End(ctx, "done"); err != nil {
+		t.Fatalf("Failed to end session: %v", err)
+	}
+	expectText(t, c, "Goodbye! Session ended.")
+	if _, ok := <-c.Events(); ok {
+		t.Error("Expected events to be closed after End")
+	}
+	if c.Err() != nil {
+		t.Errorf("Expected no error after End, got %v", c.Err())
+	}
+	if err := c.SendText(ctx, "late"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after End, got %v", err)
+	}
+}
+
+// TestClientSetupRejected tests that a rejected setup returns the server's error
+func TestClientSetupRejected(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dial(ctx, startServer(t))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	handle := "session_unknown"
+	err = c.Setup(ctx, g.SetupRequestJson{Model: "gemini-1.5-flash", ResumptionHandle: &handle})
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "invalid_handle" {
+		t.Fatalf("Expected invalid_handle, got %v", err)
+	}
+	if err := c.Setup(ctx, g.SetupRequestJson{Model: "gemini-1.5-flash"}); err != nil {
+		t.Fatalf("Expected setup to succeed after a rejected one: %v", err)
+	}
+}
+
+// TestClientNegotiation tests that Protocol reports what the server agreed to in setup_complete
+func TestClientNegotiation(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dial(ctx, startServer(t))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	version := "1.1"
+	req := g.SetupRequestJson{Model: "gemini-1.5-flash", Version: &version, Capabilities: []string{"streaming_deltas"}}
+	if err := c.Setup(ctx, req); err != nil {
+		t.Fatalf("Failed to set up session: %v", err)
+	}
+	if v, caps := c.Protocol(); v != version || len(caps) != 1 || caps[0] != "streaming_deltas" {
+		t.Errorf("Expected version %s with streaming_deltas, got %s %q", version, v, caps)
+	}
+	if ev, ok := nextEvent(t, c).(g.SetupCompleteJson); !ok {
+		t.Errorf("Expected setup_complete as the first event, got %#v", ev)
+	}
+}
+
+// TestClientReconnect tests that a dropped connection is resumed with the session's handle
+func TestClientReconnect(t *testing.T) {
+	var mu sync.Mutex
+	var conns []net.Conn
+	dialer := ws.Dialer{NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+		return conn, err
+	}}
+
+	ctx := context.Background()
+	c, err := Dial(ctx, startServer(t), WithDialer(dialer), WithReconnect(5, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Setup(ctx, g.SetupRequestJson{Model: "gemini-1.5-flash"}); err != nil {
+		t.Fatalf("Failed to set up session: %v", err)
+	}
+	handle := c.Handle()
+
+	mu.Lock()
+	conns[0].Close()
+	mu.Unlock()
+
+	ev := nextEvent(t, c)
+	if r, ok := ev.(Reconnected); !ok || r.Handle != handle {
+		t.Fatalf("Expected to reconnect with handle %s, got %#v", handle, ev)
+	}
+	if err := c.SendText(ctx, "still there?"); err != nil {
+		t.Fatalf("Failed to send text after reconnecting: %v", err)
+	}
+	expectText(t, c, "[echo] still there?")
+}
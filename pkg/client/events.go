@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/json"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// Event is a message received from the server. It is one of
+// g.SetupCompleteJson, g.ServerOutputTextJson, g.ServerOutputAudioJson,
+// g.FunctionCallJson, g.SessionResumptionUpdateJson, g.ErrorJson or
+// g.GoingAwayJson, Unknown for messages this client does not understand, or
+// Reconnected.
+type Event any
+
+// Unknown is a server message of a type this client does not know or that
+// failed to decode.
+type Unknown struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+// Reconnected is delivered after the client resumed its session on a new
+// connection. Messages sent by the server in between are lost.
+type Reconnected struct {
+	Handle  string
+	Attempt int
+}
+
+// decodeEvent decodes a server message into its generated type.
+func decodeEvent(data []byte) Event {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Unknown{Raw: data}
+	}
+
+	var ev Event
+	var err error
+	switch env.Type {
+	case g.TypeSetupComplete:
+		ev, err = decodeAs[g.SetupCompleteJson](data)
+	case g.TypeServerOutputText:
+		ev, err = decodeAs[g.ServerOutputTextJson](data)
+	case g.TypeServerOutputAudio:
+		ev, err = decodeAs[g.ServerOutputAudioJson](data)
+	case g.TypeFunctionCall:
+		ev, err = decodeAs[g.FunctionCallJson](data)
+	case g.TypeSessionResumptionUpdate:
+		ev, err = decodeAs[g.SessionResumptionUpdateJson](data)
+	case g.TypeError:
+		ev, err = decodeAs[g.ErrorJson](data)
+	case g.TypeGoingAway:
+		ev, err = decodeAs[g.GoingAwayJson](data)
+	default:
+		return Unknown{Type: env.Type, Raw: data}
+	}
+	if err != nil {
+		return Unknown{Type: env.Type, Raw: data}
+	}
+	return ev
+}
+
+func decodeAs[T any](data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// run reads server messages until the connection is lost for good,
+// resuming the session on a new connection whenever it can.
+func (c *Client) run(reader *wsutil.Reader) {
+	for {
+		err := c.receive(reader)
+		if !c.shouldReconnect(err) {
+			c.finish(err)
+			return
+		}
+		if reader, err = c.reconnect(); err != nil {
+			c.finish(err)
+			return
+		}
+	}
+}
+
+// finish records why the client stopped and releases everyone waiting on it.
+func (c *Client) finish(err error) {
+	select {
+	case <-c.quit:
+		err = nil
+	default:
+		if c.ending.Load() {
+			err = nil
+		}
+	}
+	c.err = err
+	close(c.events)
+	close(c.done)
+	_ = c.Close()
+}
+
+// receive delivers the messages read from reader until reading fails.
+func (c *Client) receive(reader *wsutil.Reader) error {
+	for {
+		data, err := readMessage(reader)
+		if err != nil {
+			return err
+		}
+		ev := decodeEvent(data)
+		c.observe(ev)
+		if !c.emit(ev) {
+			return ErrClosed
+		}
+	}
+}
+
+// observe tracks the resumption handle and answers a pending Setup.
+func (c *Client) observe(ev Event) {
+	var handle string
+	var answer error
+	switch ev := ev.(type) {
+	case g.SetupCompleteJson:
+		c.mu.Lock()
+		c.negotiated = &ev
+		c.mu.Unlock()
+		return
+	case g.SessionResumptionUpdateJson:
+		handle = ev.Handle
+	case g.GoingAwayJson:
+		if ev.Handle != nil {
+			c.mu.Lock()
+			c.handle = *ev.Handle
+			c.mu.Unlock()
+		}
+		return
+	case g.ErrorJson:
+		answer = &ServerError{Code: ev.Code, Message: ev.Message}
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	if handle != "" {
+		c.handle = handle
+	}
+	wait := c.awaiting
+	c.awaiting = nil
+	c.mu.Unlock()
+	if wait != nil {
+		wait <- answer
+	}
+}
+
+// emit queues ev for Events unless the client is being closed.
+func (c *Client) emit(ev Event) bool {
+	select {
+	case c.events <- ev:
+		return true
+	case <-c.quit:
+		return false
+	}
+}
+
+// shouldReconnect reports whether the connection was lost in a way that
+// resuming can recover from: a network error or the server going away.
+func (c *Client) shouldReconnect(err error) bool {
+	select {
+	case <-c.quit:
+		return false
+	default:
+	}
+	if c.attempts <= 0 || c.ending.Load() {
+		return false
+	}
+	c.mu.Lock()
+	resumable := c.handle != "" && c.setup != nil && c.awaiting == nil
+	c.mu.Unlock()
+
+	var closed wsutil.ClosedError
+	if errors.As(err, &closed) {
+		return resumable && closed.Code == ws.StatusGoingAway
+	}
+	return resumable
+}
+
+// reconnect resumes the session on a new connection, backing off between
+// attempts, and returns a reader for it.
+func (c *Client) reconnect() (*wsutil.Reader, error) {
+	c.mu.Lock()
+	c.ready = make(chan struct{})
+	req := *c.setup
+	c.mu.Unlock()
+
+	backoff := c.backoff
+	var err error
+	for attempt := 1; attempt <= c.attempts; attempt++ {
+		select {
+		case <-c.quit:
+			return nil, ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxReconnectBackoff)
+
+		var conn net.Conn
+		var reader *wsutil.Reader
+		if conn, reader, err = c.resume(req); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		select {
+		case <-c.quit:
+			// Close ran while dialing and closed the connection before
+			// this one, so this one is closed here.
+			c.mu.Unlock()
+			_ = conn.Close()
+			return nil, ErrClosed
+		default:
+		}
+		c.conn = conn
+		close(c.ready)
+		handle := c.handle
+		c.mu.Unlock()
+		c.emit(Reconnected{Handle: handle, Attempt: attempt})
+		return reader, nil
+	}
+	return nil, fmt.Errorf("resume session after %d attempts: %w", c.attempts, err)
+}
+
+// resume dials a new connection and sets it up with the current handle.
+// The connection is not yet visible to senders, so it is written directly.
+func (c *Client) resume(req g.SetupRequestJson) (net.Conn, *wsutil.Reader, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resumeTimeout)
+	defer cancel()
+	conn, reader, err := c.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	handle := c.Handle()
+	req.ResumptionHandle = &handle
+	data, _ := json.Marshal(req)
+	if err := c.write(ctx, conn, data); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	for {
+		data, err := readMessage(reader)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		ev := decodeEvent(data)
+		c.observe(ev)
+		switch ev := ev.(type) {
+		case g.SessionResumptionUpdateJson:
+			_ = conn.SetReadDeadline(time.Time{})
+			return conn, reader, nil
+		case g.ErrorJson:
+			conn.Close()
+			return nil, nil, &ServerError{Code: ev.Code, Message: ev.Message}
+		}
+		c.emit(ev)
+	}
+}
+
+// readMessage returns the payload of the next data message on reader,
+// answering control frames along the way.
+func readMessage(reader *wsutil.Reader) ([]byte, error) {
+	for {
+		hdr, err := reader.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := reader.OnIntermediate(hdr, reader); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return io.ReadAll(reader)
+	}
+}
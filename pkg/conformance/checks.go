@@ -0,0 +1,432 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// resumeWait bounds how long the resumption check retries while the server
+// has not yet noticed that the previous connection is gone.
+const resumeWait = 2 * time.Second
+
+// concurrentSessions is the number of sessions run at once by the
+// concurrency check.
+const concurrentSessions = 3
+
+var checks = []check{
+	{"setup/required first", checkSetupRequired},
+	{"setup/handle", checkSetupHandle},
+	{"setup/duplicate", checkDuplicateSetup},
+	{"setup/negotiation", checkNegotiation},
+	{"setup/unsupported version", errorAfter(false,
+		`{"type": "setup", "model": "gemini-1.5-flash", "version": "99.0"}`, "bad_setup")},
+	{"setup/missing model", errorAfter(false, `{"type": "setup"}`, "bad_setup")},
+	{"errors/invalid JSON", errorAfter(false, `{"invalid": json}`, "bad_json")},
+	{"errors/unknown type", errorAfter(true, `{"type": "unknown_message"}`, "unknown_type")},
+	{"errors/text without text", errorAfter(true, `{"type": "input_text"}`, "bad_json")},
+	{"errors/audio without chunk", errorAfter(true, `{"type": "input_audio", "format": "wav"}`, "bad_json")},
+	{"errors/audio format", errorAfter(true,
+		`{"type": "input_audio", "format": "invalid", "chunk": "data", "final": true}`, "bad_json")},
+	{"errors/tool result without call", errorAfter(true, `{"type": "tool_result", "name": "test"}`, "bad_json")},
+	{"errors/end without reason", errorAfter(true, `{"type": "end_session"}`, "bad_json")},
+	{"errors/binary frame", checkBinaryFrame},
+	{"input/text", checkText},
+	{"input/audio", checkAudio},
+	{"input/tool result", checkToolResult},
+	{"session/end", checkEnd},
+	{"session/client close", checkClientClose},
+	{"session/lifecycle", checkLifecycle},
+	{"session/resumption", checkResumption},
+	{"session/invalid handle", checkInvalidHandle},
+	{"session/concurrent", checkConcurrent},
+}
+
+// session dials c and sets up a session unless setup is false.
+func session(ctx context.Context, c Config, setup bool) (*peer, string, error) {
+	p, err := dial(ctx, c)
+	if err != nil {
+		return nil, "", err
+	}
+	if !setup {
+		return p, "", nil
+	}
+	handle, err := p.setup(c.Model, "")
+	if err != nil {
+		_ = p.Close()
+		return nil, "", err
+	}
+	return p, handle, nil
+}
+
+// errorAfter checks that msg, sent after setup if setup is true, is
+// answered with an error with code and leaves the connection usable.
+func errorAfter(setup bool, msg, code string) func(context.Context, Config) error {
+	return func(ctx context.Context, c Config) error {
+		p, _, err := session(ctx, c, setup)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		if err := p.sendRaw(ws.OpText, []byte(msg)); err != nil {
+			return err
+		}
+		return p.expectError(code)
+	}
+}
+
+// checkSetupRequired checks that input before setup is refused.
+func checkSetupRequired(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, false)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.send(g.ClientInputTextJson{Type: "input_text", Text: "Hello without setup"}); err != nil {
+		return err
+	}
+	return p.expectError("no_session")
+}
+
+// checkSetupHandle checks that setup is answered with a resumption handle,
+// including setup with a session configuration.
+func checkSetupHandle(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, false)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	req := g.SetupRequestJson{
+		Type:          "setup",
+		Model:         c.Model,
+		SessionConfig: map[string]any{"temperature": 0.7, "maxTokens": 1000},
+	}
+	if err := p.send(req); err != nil {
+		return err
+	}
+	msg, err := p.read()
+	if err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+	if update, ok := msg.(g.SessionResumptionUpdateJson); !ok || update.Handle == "" {
+		return fmt.Errorf("expected session_resumption_update with a handle, got %s", describe(msg))
+	}
+	return nil
+}
+
+// checkDuplicateSetup checks that a second setup on a connection is refused.
+func checkDuplicateSetup(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.send(g.SetupRequestJson{Type: "setup", Model: c.Model}); err != nil {
+		return err
+	}
+	return p.expectError("already_setup")
+}
+
+// checkNegotiation checks that a setup with a version and capabilities is
+// answered with setup_complete before the resumption handle, and that the
+// server agrees to no capability it was not offered.
+func checkNegotiation(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, false)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	version := "1.1"
+	offered := []string{"streaming_deltas", "conformance_unknown_capability"}
+	req := g.SetupRequestJson{Type: g.TypeSetupRequest, Model: c.Model, Version: &version, Capabilities: offered}
+	if err := p.send(req); err != nil {
+		return err
+	}
+	msg, err := p.read()
+	if err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+	complete, ok := msg.(g.SetupCompleteJson)
+	if !ok {
+		return fmt.Errorf("expected setup_complete, got %s", describe(msg))
+	}
+	if complete.Version != version {
+		return fmt.Errorf("expected version %s to be agreed, got %s", version, complete.Version)
+	}
+	for _, capability := range complete.Capabilities {
+		if !slices.Contains(offered[:1], capability) {
+			return fmt.Errorf("server enabled capability %q, which was not offered", capability)
+		}
+	}
+	msg, err = p.read()
+	if err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+	if _, ok := msg.(g.SessionResumptionUpdateJson); !ok {
+		return fmt.Errorf("expected session_resumption_update after setup_complete, got %s", describe(msg))
+	}
+	return nil
+}
+
+// checkBinaryFrame checks that binary frames are refused without closing
+// the connection.
+func checkBinaryFrame(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, false)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.sendRaw(ws.OpBinary, []byte("binary data")); err != nil {
+		return err
+	}
+	if err := p.expectError("bad_json"); err != nil {
+		return err
+	}
+	if _, err := p.setup(c.Model, ""); err != nil {
+		return fmt.Errorf("after a binary frame: %w", err)
+	}
+	return nil
+}
+
+// checkText checks that a text turn is answered with a final output.
+func checkText(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.send(g.ClientInputTextJson{Type: "input_text", Text: "Hello, world!"}); err != nil {
+		return err
+	}
+	return p.expectFinal()
+}
+
+// checkAudio checks that chunks in every format are accepted and the turn
+// they make up is answered. Servers may answer chunks before the final one,
+// so the session is ended and everything up to the close is read.
+func checkAudio(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	formats := []g.ClientInputAudioJsonFormat{
+		g.ClientInputAudioJsonFormatWav,
+		g.ClientInputAudioJsonFormatPcm16,
+		g.ClientInputAudioJsonFormatOpus,
+	}
+	for i, format := range formats {
+		if err := p.send(g.ClientInputAudioJson{
+			Type:   "input_audio",
+			Format: format,
+			Chunk:  "dGVzdCBhdWRpbyBkYXRh",
+			Final:  i == len(formats)-1,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := p.send(g.SessionEndJson{Type: "end_session", Reason: "audio sent"}); err != nil {
+		return err
+	}
+	finals, err := p.expectClose()
+	if err != nil {
+		return err
+	}
+	// One answers the audio and one says goodbye.
+	if finals < 2 {
+		return fmt.Errorf("expected the audio turn and the end of the session to be answered, got %d final outputs",
+			finals)
+	}
+	return nil
+}
+
+// checkToolResult checks that a tool result is accepted and the session
+// carries on.
+func checkToolResult(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.send(g.ToolResultJson{
+		Type:   "tool_result",
+		Name:   "test_tool",
+		CallId: "call_123",
+		Result: map[string]any{"status": "success", "data": "test result"},
+	}); err != nil {
+		return err
+	}
+	if err := p.send(g.ClientInputTextJson{Type: "input_text", Text: "Test after tool result"}); err != nil {
+		return err
+	}
+	return p.expectFinal()
+}
+
+// checkEnd checks that end_session is answered and the connection closed.
+func checkEnd(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.send(g.SessionEndJson{Type: "end_session", Reason: "user_requested"}); err != nil {
+		return err
+	}
+	finals, err := p.expectClose()
+	if err != nil {
+		return err
+	}
+	if finals == 0 {
+		return errors.New("expected a final output before the connection closed")
+	}
+	return p.expectCloseFrame(ws.StatusNormalClosure, "session_ended")
+}
+
+// checkClientClose checks that a close frame of the client is answered
+// with one echoing its code.
+func checkClientClose(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	body := ws.NewCloseFrameBody(ws.StatusNormalClosure, "done")
+	if err := ws.WriteFrame(p.conn, ws.MaskFrame(ws.NewCloseFrame(body))); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	if _, err := p.expectClose(); err != nil {
+		return err
+	}
+	return p.expectCloseFrame(ws.StatusNormalClosure, "")
+}
+
+// checkLifecycle runs a session through every state: configured by setup,
+// active after input, closed after end_session.
+func checkLifecycle(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	turn := "turn_001"
+	steps := []any{
+		g.ClientInputTextJson{Type: "input_text", Text: "What is the weather like?", TurnId: &turn},
+		g.ClientInputAudioJson{Type: "input_audio", Format: g.ClientInputAudioJsonFormatPcm16,
+			Chunk: "dGVzdCBhdWRpbyBkYXRh", Final: true},
+	}
+	for _, step := range steps {
+		if err := p.send(step); err != nil {
+			return err
+		}
+		if err := p.expectFinal(); err != nil {
+			return err
+		}
+	}
+	if err := p.send(g.ToolResultJson{Type: "tool_result", Name: "weather_api", CallId: "call_weather_001",
+		Result: map[string]any{"temperature": 22, "condition": "sunny"}}); err != nil {
+		return err
+	}
+	if err := p.send(g.SessionEndJson{Type: "end_session", Reason: "conversation_complete"}); err != nil {
+		return err
+	}
+	_, err = p.expectClose()
+	return err
+}
+
+// checkResumption checks that a session outlives its connection and can
+// be resumed with its handle.
+func checkResumption(ctx context.Context, c Config) error {
+	p, handle, err := session(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	if err := p.send(g.ClientInputTextJson{Type: "input_text", Text: "Remember me"}); err != nil {
+		_ = p.Close()
+		return err
+	}
+	if err := p.expectFinal(); err != nil {
+		_ = p.Close()
+		return err
+	}
+	_ = p.Close()
+
+	deadline := time.Now().Add(resumeWait)
+	for {
+		p, err := dial(ctx, c)
+		if err != nil {
+			return err
+		}
+		_, err = p.setup(c.Model, handle)
+		if err == nil {
+			defer p.Close()
+			if err := p.send(g.ClientInputTextJson{Type: "input_text", Text: "Still there?"}); err != nil {
+				return err
+			}
+			return p.expectFinal()
+		}
+		_ = p.Close()
+		if time.Now().After(deadline) {
+			return fmt.Errorf("resume with handle %s: %w", handle, err)
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkInvalidHandle checks that resuming an unknown session is refused.
+func checkInvalidHandle(ctx context.Context, c Config) error {
+	p, _, err := session(ctx, c, false)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	handle := "conformance-unknown-handle"
+	if err := p.send(g.SetupRequestJson{Type: "setup", Model: c.Model, ResumptionHandle: &handle}); err != nil {
+		return err
+	}
+	return p.expectError("invalid_handle")
+}
+
+// checkConcurrent checks that sessions on separate connections are served
+// at the same time.
+func checkConcurrent(ctx context.Context, c Config) error {
+	peers := make([]*peer, 0, concurrentSessions)
+	defer func() {
+		for _, p := range peers {
+			_ = p.Close()
+		}
+	}()
+	for range concurrentSessions {
+		p, _, err := session(ctx, c, true)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, p)
+	}
+
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Go(func() {
+			if err := p.send(g.ClientInputTextJson{Type: "input_text", Text: fmt.Sprintf("Hello from %d", i)}); err != nil {
+				errs[i] = err
+				return
+			}
+			if err := p.expectFinal(); err != nil {
+				errs[i] = fmt.Errorf("session %d: %w", i, err)
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
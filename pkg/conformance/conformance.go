@@ -0,0 +1,80 @@
+// Package conformance checks that a /v1/speak endpoint follows the protocol
+// described by the AsyncAPI document in api/gemini.json: setup ordering,
+// error codes, the session lifecycle and its close frames, resumption, tool
+// results and the handling of binary frames.
+//
+// The checks assume nothing about what the model says, only about the shape
+// and order of messages, so they apply to any server implementation or to a
+// proxy in front of one. Every server message is decoded into the types
+// generated from the spec and validated against its JSON schema.
+package conformance
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout is how long a check waits for each server message.
+const DefaultTimeout = 5 * time.Second
+
+// Config locates the endpoint under test.
+type Config struct {
+	// URL is the WebSocket URL of the endpoint, such as
+	// ws://localhost:8080/v1/speak.
+	URL string
+	// Model is used for setup; it defaults to gemini-1.5-flash.
+	Model string
+	// Header is sent with every upgrade request, for example to
+	// authenticate.
+	Header http.Header
+	// Timeout bounds the wait for each server message; it defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.Model == "" {
+		c.Model = "gemini-1.5-flash"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	return c
+}
+
+// Result is the outcome of one check; Err is nil if it passed.
+type Result struct {
+	Name string
+	Err  error
+}
+
+// check is one part of the protocol contract.
+type check struct {
+	name string
+	run  func(ctx context.Context, c Config) error
+}
+
+// Run runs every check against the endpoint in c, one after another.
+func Run(ctx context.Context, c Config) []Result {
+	c = c.withDefaults()
+	results := make([]Result, 0, len(checks))
+	for _, ch := range checks {
+		results = append(results, Result{Name: ch.name, Err: ch.run(ctx, c)})
+	}
+	return results
+}
+
+// Test runs every check as a subtest of t.
+func Test(t *testing.T, c Config) {
+	t.Helper()
+	c = c.withDefaults()
+	for _, ch := range checks {
+		t.Run(ch.name, func(t *testing.T) {
+			if err := ch.run(t.Context(), c); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package conformance
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// TestRunReportsViolations tests that a server answering with messages outside the spec fails the checks
+func TestRunReportsViolations(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+			// output_text requires final.
+			if err := wsutil.WriteServerText(conn, []byte(`{"type": "output_text", "text": "hi"}`)); err != nil {
+				return
+			}
+		}
+	}))
+	defer httpServer.Close()
+
+	results := Run(context.Background(), Config{
+		URL:     "ws" + strings.TrimPrefix(httpServer.URL, "http"),
+		Timeout: time.Second,
+	})
+	if len(results) != len(checks) {
+		t.Fatalf("Expected %d results, got %d", len(checks), len(results))
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			t.Errorf("Expected check %s to fail", r.Name)
+		}
+	}
+	if err := results[0].Err; err == nil || !strings.Contains(err.Error(), "does not match the spec") {
+		t.Errorf("Expected a spec violation, got %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/model/schema"
+)
+
+// subprotocol is offered on every connection, as clients do.
+const subprotocol = "twinspeak"
+
+// errClosed is returned by read once the server has closed the connection.
+var errClosed = errors.New("connection closed")
+
+// peer is the client side of one connection.
+type peer struct {
+	conn    net.Conn
+	reader  *wsutil.Reader
+	timeout time.Duration
+	// closed is the server's close frame, once read returned errClosed
+	// for one.
+	closed *wsutil.ClosedError
+}
+
+func dial(ctx context.Context, c Config) (*peer, error) {
+	d := ws.Dialer{Protocols: []string{subprotocol}, Header: ws.HandshakeHeaderHTTP(c.Header)}
+	conn, br, _, err := d.Dial(ctx, c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", c.URL, err)
+	}
+	var source io.Reader = conn
+	if br != nil {
+		source = br
+	}
+	control := wsutil.ControlFrameHandler(conn, ws.StateClientSide)
+	return &peer{
+		conn:    conn,
+		timeout: c.Timeout,
+		reader: &wsutil.Reader{
+			Source:         source,
+			State:          ws.StateClientSide,
+			CheckUTF8:      true,
+			OnIntermediate: control,
+		},
+	}, nil
+}
+
+func (p *peer) Close() error {
+	return p.conn.Close()
+}
+
+// send writes v as a text frame.
+func (p *peer) send(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.sendRaw(ws.OpText, data)
+}
+
+func (p *peer) sendRaw(op ws.OpCode, data []byte) error {
+	if err := wsutil.WriteClientMessage(p.conn, op, data); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	return nil
+}
+
+// read returns the next server message decoded into its generated type. A
+// message the spec does not describe is an error.
+func (p *peer) read() (any, error) {
+	if err := p.conn.SetReadDeadline(time.Now().Add(p.timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := p.reader.NextFrame()
+		if err == nil && hdr.OpCode.IsControl() {
+			err = p.reader.OnIntermediate(hdr, p.reader)
+			if err == nil {
+				continue
+			}
+		}
+		var closed wsutil.ClosedError
+		if errors.As(err, &closed) {
+			p.closed = &closed
+			return nil, errClosed
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, errClosed
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("no message within %s", p.timeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+
+		data, err := io.ReadAll(p.reader)
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		if hdr.OpCode != ws.OpText {
+			return nil, fmt.Errorf("server sent a %v frame, the protocol only uses text frames", hdr.OpCode)
+		}
+		return decode(data)
+	}
+}
+
+// decode checks a server message against the spec.
+func decode(data []byte) (any, error) {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("server message is not JSON: %s", data)
+	}
+	var msg any
+	var err error
+	switch env.Type {
+	case g.TypeSetupComplete:
+		msg, err = decodeAs[g.SetupCompleteJson](data)
+	case g.TypeServerOutputText:
+		msg, err = decodeAs[g.ServerOutputTextJson](data)
+	case g.TypeServerOutputAudio:
+		msg, err = decodeAs[g.ServerOutputAudioJson](data)
+	case g.TypeFunctionCall:
+		msg, err = decodeAs[g.FunctionCallJson](data)
+	case g.TypeSessionResumptionUpdate:
+		msg, err = decodeAs[g.SessionResumptionUpdateJson](data)
+	case g.TypeError:
+		msg, err = decodeAs[g.ErrorJson](data)
+	case g.TypeGoingAway:
+		msg, err = decodeAs[g.GoingAwayJson](data)
+	default:
+		return nil, fmt.Errorf("server sent a message of unknown type %q: %s", env.Type, data)
+	}
+	if err == nil {
+		err = schema.Validate(env.Type, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("server %s message does not match the spec: %w: %s", env.Type, err, data)
+	}
+	return msg, nil
+}
+
+func decodeAs[T any](data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// setup configures a session, resuming handle unless it is empty, and
+// returns the session's resumption handle.
+func (p *peer) setup(model, handle string) (string, error) {
+	req := g.SetupRequestJson{Type: "setup", Model: model}
+	if handle != "" {
+		req.ResumptionHandle = &handle
+	}
+	if err := p.send(req); err != nil {
+		return "", err
+	}
+	msg, err := p.read()
+	if err != nil {
+		return "", fmt.Errorf("setup: %w", err)
+	}
+	update, ok := msg.(g.SessionResumptionUpdateJson)
+	if !ok {
+		return "", fmt.Errorf("setup: expected session_resumption_update, got %s", describe(msg))
+	}
+	if update.Handle == "" {
+		return "", errors.New("setup: session_resumption_update has an empty handle")
+	}
+	return update.Handle, nil
+}
+
+// expectError reads the next message and checks that it is an error with
+// code and a message.
+func (p *peer) expectError(code string) error {
+	msg, err := p.read()
+	if err != nil {
+		return fmt.Errorf("expected a %s error: %w", code, err)
+	}
+	e, ok := msg.(g.ErrorJson)
+	if !ok {
+		return fmt.Errorf("expected a %s error, got %s", code, describe(msg))
+	}
+	if e.Code != code {
+		return fmt.Errorf("expected error code %s, got %s (%s)", code, e.Code, e.Message)
+	}
+	if e.Message == "" {
+		return fmt.Errorf("%s error has an empty message", code)
+	}
+	return nil
+}
+
+// expectFinal reads messages until a final output, failing on errors.
+// Function calls are left unanswered; a server may not wait for them.
+func (p *peer) expectFinal() error {
+	for {
+		msg, err := p.read()
+		if err != nil {
+			return fmt.Errorf("expected a final output: %w", err)
+		}
+		switch msg := msg.(type) {
+		case g.ServerOutputTextJson:
+			if msg.Final {
+				return nil
+			}
+		case g.ServerOutputAudioJson:
+			if msg.Final {
+				return nil
+			}
+		case g.ErrorJson:
+			return fmt.Errorf("expected a final output, got error %s: %s", msg.Code, msg.Message)
+		}
+	}
+}
+
+// expectClose reads messages until the server closes the connection,
+// failing on errors, and returns the number of final outputs read.
+func (p *peer) expectClose() (int, error) {
+	finals := 0
+	for {
+		msg, err := p.read()
+		if errors.Is(err, errClosed) {
+			return finals, nil
+		}
+		if err != nil {
+			return finals, fmt.Errorf("expected the server to close the connection: %w", err)
+		}
+		switch msg := msg.(type) {
+		case g.ServerOutputTextJson:
+			if msg.Final {
+				finals++
+			}
+		case g.ServerOutputAudioJson:
+			if msg.Final {
+				finals++
+			}
+		case g.ErrorJson:
+			return finals, fmt.Errorf("expected the session to close cleanly, got error %s: %s", msg.Code, msg.Message)
+		}
+	}
+}
+
+// expectCloseFrame checks that the connection ended with a close frame of
+// code and, unless it is empty, reason.
+func (p *peer) expectCloseFrame(code ws.StatusCode, reason string) error {
+	if p.closed == nil {
+		return fmt.Errorf("expected close %d %s, the connection ended without a close frame", code, reason)
+	}
+	if p.closed.Code != code || (reason != "" && p.closed.Reason != reason) {
+		return fmt.Errorf("expected close %d %s, got %d %s", code, reason, p.closed.Code, p.closed.Reason)
+	}
+	return nil
+}
+
+// describe names a decoded message for error messages.
+func describe(msg any) string {
+	data, _ := json.Marshal(msg)
+	return string(data)
+}
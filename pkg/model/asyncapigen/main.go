@@ -0,0 +1,321 @@
+// Command asyncapigen generates the message plumbing of package gemini from
+// the AsyncAPI document, so that the document is the only list of messages.
+//
+// It reads the messages of the send and receive operations, runs
+// go-jsonschema on their payload schemas to generate the message types, and
+// writes a file with a constant for the type field of every message, the
+// lists of client and server types, and a ClientHandler interface with one
+// method per client message together with the functions that decode client
+// messages and dispatch them to it.
+//
+// The document is written from the client's side: the send operation lists
+// what clients send and the receive operation what servers send.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+func main() {
+	spec := flag.String("spec", "../../api/gemini.json", "AsyncAPI document")
+	out := flag.String("out", "gemini/messages.gen.go", "File to write the message plumbing to")
+	models := flag.String("models", "gemini/models.gen.go", "File to write the message types to")
+	jsonschema := flag.String("jsonschema", "go-jsonschema", "go-jsonschema command, with its arguments if any")
+	flag.Parse()
+
+	doc, err := load(*spec)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", *spec, err)
+	}
+	if *models != "" {
+		if err := generateModels(*jsonschema, *models, doc); err != nil {
+			log.Fatalf("Failed to generate %s: %v", *models, err)
+		}
+	}
+	src, err := generate(doc)
+	if err != nil {
+		log.Fatalf("Failed to generate %s: %v", *out, err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// document is what the generator needs from an AsyncAPI document.
+type document struct {
+	Package string
+	Source  string
+	Client  []message
+	Server  []message
+}
+
+// message is a message of the document and the schema of its payload.
+type message struct {
+	// Name is the name of the message in components.messages.
+	Name string
+	// Schema is the path of the payload schema.
+	Schema string
+	// Type is the constant of the schema's type property.
+	Type string
+}
+
+// GoType is the name go-jsonschema gives the payload type.
+func (m message) GoType() string {
+	return strings.TrimSuffix(path.Base(m.Schema), ".json") + "Json"
+}
+
+type ref struct {
+	Ref string `json:"$ref"`
+}
+
+type asyncAPI struct {
+	Operations map[string]struct {
+		Action   string `json:"action"`
+		Messages []ref  `json:"messages"`
+	} `json:"operations"`
+	Channels map[string]struct {
+		Messages map[string]ref `json:"messages"`
+	} `json:"channels"`
+	Components struct {
+		Messages map[string]struct {
+			Payload ref `json:"payload"`
+		} `json:"messages"`
+	} `json:"components"`
+}
+
+// load reads the AsyncAPI document at file and the schemas it refers to.
+func load(file string) (*document, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var spec asyncAPI
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	doc := &document{Package: "gemini", Source: path.Join("api", filepath.Base(file))}
+	for _, name := range []string{"sendMessage", "receiveMessage"} {
+		op, ok := spec.Operations[name]
+		if !ok {
+			return nil, fmt.Errorf("no %s operation", name)
+		}
+		for _, r := range op.Messages {
+			m, err := spec.message(r.Ref, filepath.Dir(file))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if op.Action == "send" {
+				doc.Client = append(doc.Client, m)
+			} else {
+				doc.Server = append(doc.Server, m)
+			}
+		}
+	}
+	if len(doc.Client) == 0 {
+		return nil, errors.New("no client messages")
+	}
+	return doc, nil
+}
+
+// message resolves a reference to a channel message, such as
+// #/channels/~1v1~1speak/messages/SetupRequest, and reads its payload
+// schema relative to dir.
+func (spec *asyncAPI) message(r, dir string) (message, error) {
+	parts := strings.Split(strings.TrimPrefix(r, "#/"), "/")
+	if len(parts) != 4 || parts[0] != "channels" || parts[2] != "messages" {
+		return message{}, fmt.Errorf("unsupported message reference %s", r)
+	}
+	channel := strings.NewReplacer("~1", "/", "~0", "~").Replace(parts[1])
+	msgRef, ok := spec.Channels[channel].Messages[parts[3]]
+	if !ok {
+		return message{}, fmt.Errorf("unresolved reference %s", r)
+	}
+	name := strings.TrimPrefix(msgRef.Ref, "#/components/messages/")
+	component, ok := spec.Components.Messages[name]
+	if !ok || component.Payload.Ref == "" {
+		return message{}, fmt.Errorf("message %s has no payload schema", name)
+	}
+
+	m := message{Name: name, Schema: path.Join(dir, component.Payload.Ref)}
+	data, err := os.ReadFile(m.Schema)
+	if err != nil {
+		return message{}, err
+	}
+	var schema struct {
+		Properties struct {
+			Type struct {
+				Const string `json:"const"`
+			} `json:"type"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return message{}, fmt.Errorf("%s: %w", m.Schema, err)
+	}
+	if schema.Properties.Type.Const == "" {
+		return message{}, fmt.Errorf("%s: the type property has no const", m.Schema)
+	}
+	m.Type = schema.Properties.Type.Const
+	return m, nil
+}
+
+// generateModels runs go-jsonschema on the payload schemas of doc.
+func generateModels(command, out string, doc *document) error {
+	args := strings.Fields(command)
+	args = append(args, "-p", doc.Package, "-o", out)
+	for _, m := range append(doc.Client, doc.Server...) {
+		args = append(args, m.Schema)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return groupImports(out)
+}
+
+// groupImports merges the one-line imports go-jsonschema writes into a
+// single block, as goimports would leave them in a hand-written file.
+func groupImports(file string) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	var block *ast.GenDecl
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		switch {
+		case !ok || gen.Tok != token.IMPORT:
+			decls = append(decls, decl)
+		case block == nil:
+			block = gen
+			block.Lparen = block.Pos()
+			decls = append(decls, decl)
+		default:
+			block.Specs = append(block.Specs, gen.Specs...)
+		}
+	}
+	f.Decls = decls
+	if block == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, src, 0o644)
+}
+
+// generate renders the message plumbing of doc.
+func generate(doc *document) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, doc); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+var tmpl = template.Must(template.New("messages").Parse(`// Code generated by asyncapigen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The values of the type field of every message.
+const (
+{{- range .Client}}
+	// Type{{.Name}} is the type of {{.GoType}}.
+	Type{{.Name}} = "{{.Type}}"
+{{- end}}
+{{- range .Server}}
+	// Type{{.Name}} is the type of {{.GoType}}.
+	Type{{.Name}} = "{{.Type}}"
+{{- end}}
+)
+
+// ClientTypes lists the types of the messages clients send.
+var ClientTypes = []string{
+{{- range .Client}}
+	Type{{.Name}},
+{{- end}}
+}
+
+// ServerTypes lists the types of the messages servers send.
+var ServerTypes = []string{
+{{- range .Server}}
+	Type{{.Name}},
+{{- end}}
+}
+
+// ErrUnknownType is returned by DecodeClient for a type clients do not send.
+var ErrUnknownType = errors.New("unknown message type")
+
+// ClientHandler handles the messages clients send, one method per message.
+// C is passed through DispatchClient to every method, usually to carry the
+// connection the message arrived on; the result is passed back.
+type ClientHandler[C any] interface {
+{{- range .Client}}
+	// {{.Name}} handles {{.Type}} messages.
+	{{.Name}}(c C, msg {{.GoType}}) bool
+{{- end}}
+}
+
+// DecodeClient decodes data, a client message of type msgType, into its
+// generated type. It returns ErrUnknownType for a type clients do not send.
+func DecodeClient(msgType string, data []byte) (any, error) {
+	switch msgType {
+{{- range .Client}}
+	case Type{{.Name}}:
+		return decode[{{.GoType}}](data)
+{{- end}}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, msgType)
+	}
+}
+
+func decode[T any](data []byte) (any, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DispatchClient passes msg, as returned by DecodeClient, to the method of h
+// for its type and returns the method's result.
+func DispatchClient[C any](h ClientHandler[C], c C, msg any) bool {
+	switch msg := msg.(type) {
+{{- range .Client}}
+	case {{.GoType}}:
+		return h.{{.Name}}(c, msg)
+{{- end}}
+	default:
+		panic(fmt.Sprintf("{{.Package}}: %T is not a client message", msg))
+	}
+}
+`))
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+const spec = "../../../api/gemini.json"
+
+// TestGeneratedUpToDate tests that messages.gen.go matches the AsyncAPI document
+func TestGeneratedUpToDate(t *testing.T) {
+	doc, err := load(spec)
+	if err != nil {
+		t.Fatalf("Failed to load the AsyncAPI document: %v", err)
+	}
+	src, err := generate(doc)
+	if err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+	committed, err := os.ReadFile("../gemini/messages.gen.go")
+	if err != nil {
+		t.Fatalf("Failed to read messages.gen.go: %v", err)
+	}
+	if !bytes.Equal(src, committed) {
+		t.Error("messages.gen.go is out of date; run make gen")
+	}
+}
+
+// TestEveryMessageGenerated tests that every message of the AsyncAPI document
+// gets a type constant, and every client message a decoder and dispatcher case
+func TestEveryMessageGenerated(t *testing.T) {
+	data, err := os.ReadFile(spec)
+	if err != nil {
+		t.Fatalf("Failed to read the AsyncAPI document: %v", err)
+	}
+	var raw asyncAPI
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Failed to parse the AsyncAPI document: %v", err)
+	}
+	doc, err := load(spec)
+	if err != nil {
+		t.Fatalf("Failed to load the AsyncAPI document: %v", err)
+	}
+	src, err := generate(doc)
+	if err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+
+	loaded := make(map[string]bool)
+	for _, m := range append(doc.Client, doc.Server...) {
+		loaded[m.Name] = true
+		if !bytes.Contains(src, fmt.Appendf(nil, "Type%s = %q", m.Name, m.Type)) {
+			t.Errorf("Expected a constant for %s of type %q", m.Name, m.Type)
+		}
+	}
+	for name := range raw.Components.Messages {
+		if !loaded[name] {
+			t.Errorf("Expected %s to be a client or server message", name)
+		}
+	}
+	for _, m := range doc.Client {
+		for _, want := range []string{
+			"case Type" + m.Name + ":\n\t\treturn decode[" + m.GoType() + "](data)",
+			"case " + m.GoType() + ":\n\t\treturn h." + m.Name + "(c, msg)",
+		} {
+			if !strings.Contains(string(src), want) {
+				t.Errorf("Expected %s to be handled with %q", m.Name, want)
+			}
+		}
+	}
+}
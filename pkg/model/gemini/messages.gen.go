@@ -0,0 +1,122 @@
+// Code generated by asyncapigen from api/gemini.json. DO NOT EDIT.
+
+package gemini
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The values of the type field of every message.
+const (
+	// TypeSetupRequest is the type of SetupRequestJson.
+	TypeSetupRequest = "setup"
+	// TypeClientInputText is the type of ClientInputTextJson.
+	TypeClientInputText = "input_text"
+	// TypeClientInputAudio is the type of ClientInputAudioJson.
+	TypeClientInputAudio = "input_audio"
+	// TypeToolResult is the type of ToolResultJson.
+	TypeToolResult = "tool_result"
+	// TypeSessionEnd is the type of SessionEndJson.
+	TypeSessionEnd = "end_session"
+	// TypeSetupComplete is the type of SetupCompleteJson.
+	TypeSetupComplete = "setup_complete"
+	// TypeServerOutputText is the type of ServerOutputTextJson.
+	TypeServerOutputText = "output_text"
+	// TypeServerOutputAudio is the type of ServerOutputAudioJson.
+	TypeServerOutputAudio = "output_audio"
+	// TypeFunctionCall is the type of FunctionCallJson.
+	TypeFunctionCall = "function_call"
+	// TypeSessionResumptionUpdate is the type of SessionResumptionUpdateJson.
+	TypeSessionResumptionUpdate = "session_resumption_update"
+	// TypeError is the type of ErrorJson.
+	TypeError = "error"
+	// TypeGoingAway is the type of GoingAwayJson.
+	TypeGoingAway = "going_away"
+)
+
+// ClientTypes lists the types of the messages clients send.
+var ClientTypes = []string{
+	TypeSetupRequest,
+	TypeClientInputText,
+	TypeClientInputAudio,
+	TypeToolResult,
+	TypeSessionEnd,
+}
+
+// ServerTypes lists the types of the messages servers send.
+var ServerTypes = []string{
+	TypeSetupComplete,
+	TypeServerOutputText,
+	TypeServerOutputAudio,
+	TypeFunctionCall,
+	TypeSessionResumptionUpdate,
+	TypeError,
+	TypeGoingAway,
+}
+
+// ErrUnknownType is returned by DecodeClient for a type clients do not send.
+var ErrUnknownType = errors.New("unknown message type")
+
+// ClientHandler handles the messages clients send, one method per message.
+// C is passed through DispatchClient to every method, usually to carry the
+// connection the message arrived on; the result is passed back.
+type ClientHandler[C any] interface {
+	// SetupRequest handles setup messages.
+	SetupRequest(c C, msg SetupRequestJson) bool
+	// ClientInputText handles input_text messages.
+	ClientInputText(c C, msg ClientInputTextJson) bool
+	// ClientInputAudio handles input_audio messages.
+	ClientInputAudio(c C, msg ClientInputAudioJson) bool
+	// ToolResult handles tool_result messages.
+	ToolResult(c C, msg ToolResultJson) bool
+	// SessionEnd handles end_session messages.
+	SessionEnd(c C, msg SessionEndJson) bool
+}
+
+// DecodeClient decodes data, a client message of type msgType, into its
+// generated type. It returns ErrUnknownType for a type clients do not send.
+func DecodeClient(msgType string, data []byte) (any, error) {
+	switch msgType {
+	case TypeSetupRequest:
+		return decode[SetupRequestJson](data)
+	case TypeClientInputText:
+		return decode[ClientInputTextJson](data)
+	case TypeClientInputAudio:
+		return decode[ClientInputAudioJson](data)
+	case TypeToolResult:
+		return decode[ToolResultJson](data)
+	case TypeSessionEnd:
+		return decode[SessionEndJson](data)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, msgType)
+	}
+}
+
+func decode[T any](data []byte) (any, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DispatchClient passes msg, as returned by DecodeClient, to the method of h
+// for its type and returns the method's result.
+func DispatchClient[C any](h ClientHandler[C], c C, msg any) bool {
+	switch msg := msg.(type) {
+	case SetupRequestJson:
+		return h.SetupRequest(c, msg)
+	case ClientInputTextJson:
+		return h.ClientInputText(c, msg)
+	case ClientInputAudioJson:
+		return h.ClientInputAudio(c, msg)
+	case ToolResultJson:
+		return h.ToolResult(c, msg)
+	case SessionEndJson:
+		return h.SessionEnd(c, msg)
+	default:
+		panic(fmt.Sprintf("gemini: %T is not a client message", msg))
+	}
+}
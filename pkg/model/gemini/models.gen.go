@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
 )
 
 // Audio input message from client
@@ -111,6 +112,9 @@ func (j *ClientInputTextJson) UnmarshalJSON(value []byte) error {
 	if err := json.Unmarshal(value, &plain); err != nil {
 		return err
 	}
+	if plain.TurnId != nil && len(*plain.TurnId) > 128 {
+		return fmt.Errorf("field %s length: must be <= %d", "turnId", 128)
+	}
 	*j = ClientInputTextJson(plain)
 	return nil
 }
@@ -189,10 +193,52 @@ func (j *FunctionCallJson) UnmarshalJSON(value []byte) error {
 	if err := json.Unmarshal(value, &plain); err != nil {
 		return err
 	}
+	if len(plain.CallId) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "callId", 1)
+	}
+	if matched, _ := regexp.MatchString(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`, string(plain.Name)); !matched {
+		return fmt.Errorf("field %s pattern match: must match %s", "Name", `^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
+	}
 	*j = FunctionCallJson(plain)
 	return nil
 }
 
+// Notice that the server is shutting down and will close the connection
+type GoingAwayJson struct {
+	// Resumption handle to resume the session on another connection
+	Handle *string `json:"handle,omitempty" yaml:"handle,omitempty" mapstructure:"handle,omitempty"`
+
+	// Milliseconds until the server closes the connection
+	TimeLeftMs int `json:"timeLeftMs" yaml:"timeLeftMs" mapstructure:"timeLeftMs"`
+
+	// Type corresponds to the JSON schema field "type".
+	Type string `json:"type" yaml:"type" mapstructure:"type"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *GoingAwayJson) UnmarshalJSON(value []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(value, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["timeLeftMs"]; raw != nil && !ok {
+		return fmt.Errorf("field timeLeftMs in GoingAwayJson: required")
+	}
+	if _, ok := raw["type"]; raw != nil && !ok {
+		return fmt.Errorf("field type in GoingAwayJson: required")
+	}
+	type Plain GoingAwayJson
+	var plain Plain
+	if err := json.Unmarshal(value, &plain); err != nil {
+		return err
+	}
+	if 0 > plain.TimeLeftMs {
+		return fmt.Errorf("field %s: must be >= %v", "timeLeftMs", 0)
+	}
+	*j = GoingAwayJson(plain)
+	return nil
+}
+
 // Audio output message from server
 type ServerOutputAudioJson struct {
 	// Base64-encoded audio data chunk
@@ -329,6 +375,9 @@ func (j *SessionEndJson) UnmarshalJSON(value []byte) error {
 	if err := json.Unmarshal(value, &plain); err != nil {
 		return err
 	}
+	if len(plain.Reason) > 1024 {
+		return fmt.Errorf("field %s length: must be <= %d", "reason", 1024)
+	}
 	*j = SessionEndJson(plain)
 	return nil
 }
@@ -359,20 +408,76 @@ func (j *SessionResumptionUpdateJson) UnmarshalJSON(value []byte) error {
 	if err := json.Unmarshal(value, &plain); err != nil {
 		return err
 	}
+	if len(plain.Handle) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "handle", 1)
+	}
 	*j = SessionResumptionUpdateJson(plain)
 	return nil
 }
 
+// Outcome of protocol negotiation, sent before the session_resumption_update that
+// answers a setup with a version of 1.1 or later
+type SetupCompleteJson struct {
+	// Capabilities enabled on the connection, those both the client and the server
+	// support
+	Capabilities []string `json:"capabilities" yaml:"capabilities" mapstructure:"capabilities"`
+
+	// Type corresponds to the JSON schema field "type".
+	Type string `json:"type" yaml:"type" mapstructure:"type"`
+
+	// Protocol version of the connection: the lower of the client's and the server's
+	Version string `json:"version" yaml:"version" mapstructure:"version"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *SetupCompleteJson) UnmarshalJSON(value []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(value, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["capabilities"]; raw != nil && !ok {
+		return fmt.Errorf("field capabilities in SetupCompleteJson: required")
+	}
+	if _, ok := raw["type"]; raw != nil && !ok {
+		return fmt.Errorf("field type in SetupCompleteJson: required")
+	}
+	if _, ok := raw["version"]; raw != nil && !ok {
+		return fmt.Errorf("field version in SetupCompleteJson: required")
+	}
+	type Plain SetupCompleteJson
+	var plain Plain
+	if err := json.Unmarshal(value, &plain); err != nil {
+		return err
+	}
+	if matched, _ := regexp.MatchString(`^[0-9]+\.[0-9]+$`, string(plain.Version)); !matched {
+		return fmt.Errorf("field %s pattern match: must match %s", "Version", `^[0-9]+\.[0-9]+$`)
+	}
+	*j = SetupCompleteJson(plain)
+	return nil
+}
+
 // Initial session configuration message
 type SetupRequestJson struct {
+	// Optional features the client supports, such as streaming_deltas, binary_audio,
+	// interruption or compression. Names the server does not know are ignored
+	Capabilities []string `json:"capabilities,omitempty" yaml:"capabilities,omitempty" mapstructure:"capabilities,omitempty"`
+
 	// The model to use for the session
 	Model string `json:"model" yaml:"model" mapstructure:"model"`
 
+	// Handle from a session_resumption_update or going_away message to resume that
+	// session
+	ResumptionHandle *string `json:"resumptionHandle,omitempty" yaml:"resumptionHandle,omitempty" mapstructure:"resumptionHandle,omitempty"`
+
 	// Optional session configuration parameters
 	SessionConfig map[string]interface{} `json:"sessionConfig,omitempty" yaml:"sessionConfig,omitempty" mapstructure:"sessionConfig,omitempty"`
 
 	// Type corresponds to the JSON schema field "type".
 	Type string `json:"type" yaml:"type" mapstructure:"type"`
+
+	// Highest protocol version the client speaks, as MAJOR.MINOR. Clients that send
+	// neither version nor capabilities speak 1.0
+	Version *string `json:"version,omitempty" yaml:"version,omitempty" mapstructure:"version,omitempty"`
 }
 
 // UnmarshalJSON implements json.Unmarshaler.
@@ -392,6 +497,14 @@ func (j *SetupRequestJson) UnmarshalJSON(value []byte) error {
 	if err := json.Unmarshal(value, &plain); err != nil {
 		return err
 	}
+	if len(plain.Model) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "model", 1)
+	}
+	if plain.Version != nil {
+		if matched, _ := regexp.MatchString(`^[0-9]+\.[0-9]+$`, string(*plain.Version)); !matched {
+			return fmt.Errorf("field %s pattern match: must match %s", "Version", `^[0-9]+\.[0-9]+$`)
+		}
+	}
 	*j = SetupRequestJson(plain)
 	return nil
 }
@@ -434,6 +547,12 @@ func (j *ToolResultJson) UnmarshalJSON(value []byte) error {
 	if err := json.Unmarshal(value, &plain); err != nil {
 		return err
 	}
+	if len(plain.CallId) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "callId", 1)
+	}
+	if matched, _ := regexp.MatchString(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`, string(plain.Name)); !matched {
+		return fmt.Errorf("field %s pattern match: must match %s", "Name", `^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
+	}
 	*j = ToolResultJson(plain)
 	return nil
 }
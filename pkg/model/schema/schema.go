@@ -0,0 +1,162 @@
+// Package schema validates messages against the JSON schemas in api/models.
+//
+// The generated types check required fields and enums when they are
+// unmarshalled, but not patterns, lengths or base64 content, so a message
+// can decode cleanly and still break the spec. Validate applies the whole
+// schema of a message and reports where it is broken.
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"jig.sx/twinspeak/api"
+)
+
+// dir is where the message schemas live in api.FS.
+const dir = "models/gemini"
+
+// ErrUnknownType is returned by Validate for a message type without a schema.
+var ErrUnknownType = errors.New("no schema for message type")
+
+// Violation is a message that does not match its schema.
+type Violation struct {
+	// Path is the JSON pointer to the offending value, "/" for the
+	// message itself.
+	Path string
+	// Message says which constraint the value breaks.
+	Message string
+}
+
+func (v *Violation) Error() string {
+	return v.Path + ": " + v.Message
+}
+
+var (
+	loadOnce sync.Once
+	schemas  map[string]*jsonschema.Schema
+	errLoad  error
+)
+
+// load compiles every schema once, keyed by the message type in its type
+// property.
+func load() (map[string]*jsonschema.Schema, error) {
+	loadOnce.Do(func() {
+		schemas, errLoad = compile(api.FS)
+	})
+	return schemas, errLoad
+}
+
+func compile(fsys fs.FS) (map[string]*jsonschema.Schema, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	// Without this contentEncoding is only an annotation and base64 goes
+	// unchecked.
+	c.AssertContent()
+	docs := make(map[string]any, len(names))
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		url := "file:///" + name
+		if err := c.AddResource(url, doc); err != nil {
+			return nil, fmt.Errorf("add %s: %w", name, err)
+		}
+		docs[url] = doc
+	}
+
+	compiled := make(map[string]*jsonschema.Schema, len(docs))
+	for url, doc := range docs {
+		msgType, ok := typeConst(doc)
+		if !ok {
+			continue
+		}
+		sch, err := c.Compile(url)
+		if err != nil {
+			return nil, fmt.Errorf("compile %s: %w", url, err)
+		}
+		compiled[msgType] = sch
+	}
+	return compiled, nil
+}
+
+// typeConst returns the constant of a schema's type property.
+func typeConst(doc any) (string, bool) {
+	obj, _ := doc.(map[string]any)
+	props, _ := obj["properties"].(map[string]any)
+	typ, _ := props["type"].(map[string]any)
+	c, ok := typ["const"].(string)
+	return c, ok
+}
+
+// Types lists the message types that have a schema.
+func Types() ([]string, error) {
+	m, err := load()
+	if err != nil {
+		return nil, err
+	}
+	types := make([]string, 0, len(m))
+	for t := range m {
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// Validate checks data, a message of type msgType, against its schema. It
+// returns a *Violation if the message breaks the schema, ErrUnknownType if
+// msgType has none, and another error if data is not JSON.
+func Validate(msgType string, data []byte) error {
+	m, err := load()
+	if err != nil {
+		return err
+	}
+	sch, ok := m[msgType]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownType, msgType)
+	}
+	v, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	err = sch.Validate(v)
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	return violation(verr)
+}
+
+// violation reduces a validation error to its first leaf, which names the
+// deepest value at fault rather than the message as a whole.
+func violation(err *jsonschema.ValidationError) *Violation {
+	out := err.BasicOutput()
+	unit := *out
+	for _, u := range out.Errors {
+		if u.Error != nil {
+			unit = u
+			break
+		}
+	}
+	v := &Violation{Path: unit.InstanceLocation, Message: "invalid message"}
+	if v.Path == "" {
+		v.Path = "/"
+	}
+	if unit.Error != nil {
+		v.Message = unit.Error.String()
+	}
+	return v
+}
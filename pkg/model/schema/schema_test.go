@@ -0,0 +1,73 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestValidate tests that schema violations are reported with the path of the offending value
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		msgType  string
+		message  string
+		expected string
+	}{
+		{"Valid text", "input_text", `{"type": "input_text", "text": "Hello"}`, ""},
+		{"Valid setup", "setup", `{"type": "setup", "model": "gemini-1.5-flash", "sessionConfig": {"a": 1}}`, ""},
+		{"Missing field", "input_text", `{"type": "input_text"}`, "/"},
+		{"Extra field", "end_session", `{"type": "end_session", "reason": "done", "extra": 1}`, "/"},
+		{"Empty model", "setup", `{"type": "setup", "model": ""}`, "/model"},
+		{"Bad base64", "input_audio", `{"type": "input_audio", "format": "wav", "chunk": "not base64!", "final": true}`,
+			"/chunk"},
+		{"Bad enum", "input_audio", `{"type": "input_audio", "format": "mp3", "chunk": "AAAA", "final": true}`,
+			"/format"},
+		{"Bad tool name", "tool_result", `{"type": "tool_result", "name": "1 tool", "callId": "c", "result": {}}`,
+			"/name"},
+		{"Long turn ID", "input_text", `{"type": "input_text", "text": "Hi", "turnId": "` + long(129) + `"}`,
+			"/turnId"},
+		{"Server message", "function_call", `{"type": "function_call", "name": "f", "callId": "", "arguments": {}}`,
+			"/callId"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.msgType, []byte(tt.message))
+			if tt.expected == "" {
+				if err != nil {
+					t.Fatalf("Failed to validate message: %v", err)
+				}
+				return
+			}
+			var v *Violation
+			if !errors.As(err, &v) {
+				t.Fatalf("Expected a violation, got %v", err)
+			}
+			if v.Path != tt.expected || v.Message == "" {
+				t.Errorf("Expected a violation at %s, got %v", tt.expected, v)
+			}
+		})
+	}
+}
+
+// TestValidateUnknownType tests that types without a schema are told apart from violations
+func TestValidateUnknownType(t *testing.T) {
+	if err := Validate("unknown_message", []byte(`{}`)); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Expected ErrUnknownType, got %v", err)
+	}
+	types, err := Types()
+	if err != nil {
+		t.Fatalf("Failed to load schemas: %v", err)
+	}
+	if len(types) != 12 {
+		t.Errorf("Expected a schema for each of the 12 message types, got %v", types)
+	}
+}
+
+func long(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 'x'
+	}
+	return string(b)
+}
@@ -0,0 +1,99 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// serverIDs are the fields of server messages whose values the server
+// chooses anew on every run; clientIDs are where clients echo them back.
+var (
+	serverIDs = []string{"handle", "callId"}
+	clientIDs = []string{"resumptionHandle", "callId"}
+)
+
+// Matcher compares the replies of a replayed conversation with the
+// recorded ones. Resumption handles and call IDs differ between runs, so
+// it learns which live value stands for each recorded one and rewrites the
+// client's frames to match.
+type Matcher struct {
+	ids map[string]string
+}
+
+// NewMatcher returns a Matcher that has not seen any replies.
+func NewMatcher() *Matcher {
+	return &Matcher{ids: make(map[string]string)}
+}
+
+// Rewrite returns a recorded client frame with the recorded IDs replaced
+// by their live counterparts. A resumption handle that was never seen in
+// this replay is dropped, so a recording that starts by resuming a session
+// replays as a new one. Frames that are not JSON objects are returned as is.
+func (m *Matcher) Rewrite(data []byte) []byte {
+	var msg map[string]any
+	if json.Unmarshal(data, &msg) != nil {
+		return data
+	}
+	changed := false
+	for _, field := range clientIDs {
+		recorded, ok := msg[field].(string)
+		if !ok {
+			continue
+		}
+		live, known := m.ids[recorded]
+		switch {
+		case known:
+			msg[field] = live
+		case field == "resumptionHandle":
+			delete(msg, field)
+		default:
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return data
+	}
+	out, err := json.Marshal(msg)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// Match reports how actual differs from the recorded reply expected, or
+// nil if they are the same JSON apart from IDs. The first time a recorded
+// ID is met, the live value in its place is taken to stand for it.
+func (m *Matcher) Match(expected, actual []byte) error {
+	var want, got map[string]any
+	if json.Unmarshal(expected, &want) != nil || json.Unmarshal(actual, &got) != nil {
+		if bytes.Equal(expected, actual) {
+			return nil
+		}
+		return fmt.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	learned := make(map[string]string)
+	for _, field := range serverIDs {
+		recorded, ok1 := want[field].(string)
+		live, ok2 := got[field].(string)
+		if !ok1 || !ok2 {
+			continue
+		}
+		if known, ok := m.ids[recorded]; ok {
+			live = known
+		} else {
+			learned[recorded] = live
+		}
+		want[field] = live
+	}
+	if !reflect.DeepEqual(want, got) {
+		return fmt.Errorf("expected %s, got %s", expected, actual)
+	}
+	for recorded, live := range learned {
+		m.ids[recorded] = live
+	}
+	return nil
+}
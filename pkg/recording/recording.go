@@ -0,0 +1,175 @@
+// Package recording reads and writes archives of the WebSocket frames
+// exchanged on a /v1/speak connection, so that a conversation can be
+// replayed against a server later.
+//
+// An archive is a JSON Lines file: a Header followed by one Frame per line
+// in the order the frames were sent or received.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Version is the archive format written by Writer.
+const Version = 1
+
+// ErrFull is returned by Writer.Write for a frame that would grow the archive
+// beyond the limit set with SetLimit.
+var ErrFull = errors.New("recording full")
+
+// Direction tells who sent a frame.
+type Direction string
+
+const (
+	// Inbound frames were sent by the client.
+	Inbound Direction = "in"
+	// Outbound frames were sent by the server.
+	Outbound Direction = "out"
+)
+
+// Header describes the recorded connection.
+type Header struct {
+	Version   int       `json:"version"`
+	SessionID string    `json:"sessionId"`
+	Model     string    `json:"model"`
+	Started   time.Time `json:"started"`
+}
+
+// Frame is a recorded message. Text frames, which carry the JSON protocol,
+// are kept verbatim in Text; anything else is kept in Binary.
+type Frame struct {
+	// OffsetMs is the time since the start of the recording.
+	OffsetMs  float64   `json:"offsetMs"`
+	Direction Direction `json:"direction"`
+	Text      string    `json:"text,omitempty"`
+	Binary    []byte    `json:"binary,omitempty"`
+}
+
+// Offset returns OffsetMs as a duration.
+func (f Frame) Offset() time.Duration {
+	return time.Duration(f.OffsetMs * float64(time.Millisecond))
+}
+
+// Data returns the payload of f.
+func (f Frame) Data() []byte {
+	if f.Binary != nil {
+		return f.Binary
+	}
+	return []byte(f.Text)
+}
+
+// Writer appends frames to an archive. It is safe for concurrent use, as
+// the server writes outbound frames from more than one goroutine.
+type Writer struct {
+	mu    sync.Mutex
+	w     io.WriteCloser
+	buf   *bufio.Writer
+	start time.Time
+	err   error
+	// size is the number of bytes written so far and limit the most
+	// there may be, if it is positive.
+	size  int64
+	limit int64
+}
+
+// NewWriter writes h to w and returns a Writer for the frames that follow.
+// Closing the Writer closes w.
+func NewWriter(w io.WriteCloser, h Header) (*Writer, error) {
+	h.Version = Version
+	if h.Started.IsZero() {
+		h.Started = time.Now()
+	}
+	buf := bufio.NewWriter(w)
+	rw := &Writer{w: w, buf: buf, start: h.Started}
+	if err := rw.encode(h); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Write records a frame sent in direction dir. Text frames must be valid
+// UTF-8 to survive the archive unchanged; binary says they are not text.
+// The first error is kept and returned by every later call.
+func (w *Writer) Write(dir Direction, data []byte, binary bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	f := Frame{OffsetMs: float64(time.Since(w.start)) / float64(time.Millisecond), Direction: dir}
+	if binary {
+		f.Binary = data
+	} else {
+		f.Text = string(data)
+	}
+	w.err = w.encode(f)
+	return w.err
+}
+
+// SetLimit caps the archive at n bytes, header included: Write fails with
+// ErrFull instead of writing a frame that would exceed it, so the archive
+// stays readable. A limit of zero or less removes the cap.
+func (w *Writer) SetLimit(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limit = n
+}
+
+// encode writes v as one line of the archive.
+func (w *Writer) encode(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if w.limit > 0 && w.size+int64(len(data)) > w.limit {
+		return ErrFull
+	}
+	n, err := w.buf.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+// Close flushes the archive and closes the underlying writer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.buf.Flush()
+	if w.err == nil {
+		w.err = errors.New("recording closed")
+	}
+	return errors.Join(err, w.w.Close())
+}
+
+// Read returns the header and frames of an archive.
+func Read(r io.Reader) (Header, []Frame, error) {
+	dec := json.NewDecoder(r)
+	var h Header
+	if err := dec.Decode(&h); err != nil {
+		return Header{}, nil, fmt.Errorf("read recording header: %w", err)
+	}
+	if h.Version != Version {
+		return Header{}, nil, fmt.Errorf("unsupported recording version %d", h.Version)
+	}
+	var frames []Frame
+	for {
+		var f Frame
+		err := dec.Decode(&f)
+		if errors.Is(err, io.EOF) {
+			return h, frames, nil
+		}
+		if err != nil {
+			return Header{}, nil, fmt.Errorf("read frame %d: %w", len(frames)+1, err)
+		}
+		if f.Direction != Inbound && f.Direction != Outbound {
+			return Header{}, nil, fmt.Errorf("frame %d has unknown direction %q", len(frames)+1, f.Direction)
+		}
+		frames = append(frames, f)
+	}
+}
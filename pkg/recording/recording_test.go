@@ -0,0 +1,113 @@
+package recording
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// TestArchiveRoundTrip tests that written frames are read back in order with their payloads
+func TestArchiveRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(nopCloser{&buf}, Header{SessionID: "s1", Model: "m"})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	frames := []struct {
+		dir    Direction
+		data   []byte
+		binary bool
+	}{
+		{Inbound, []byte(`{"type":"setup","model":"m"}`), false},
+		{Outbound, []byte(`{"type":"session_resumption_update","handle":"h"}`), false},
+		{Inbound, []byte{0xff, 0x00, 0x80}, true},
+	}
+	for _, f := range frames {
+		if err := w.Write(f.dir, f.data, f.binary); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	if err := w.Write(Inbound, nil, false); err == nil {
+		t.Error("Expected writing after Close to fail")
+	}
+
+	h, got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if h.Version != Version || h.SessionID != "s1" || h.Started.IsZero() {
+		t.Errorf("Unexpected header %+v", h)
+	}
+	if len(got) != len(frames) {
+		t.Fatalf("Expected %d frames, got %d", len(frames), len(got))
+	}
+	for i, f := range frames {
+		if got[i].Direction != f.dir || !bytes.Equal(got[i].Data(), f.data) {
+			t.Errorf("Frame %d: expected %s %q, got %s %q", i, f.dir, f.data, got[i].Direction, got[i].Data())
+		}
+		if i > 0 && got[i].Offset() < got[i-1].Offset() {
+			t.Errorf("Frame %d is earlier than the one before it", i)
+		}
+	}
+}
+
+// TestMatcher tests that IDs chosen by the server are matched up and rewritten in client frames
+func TestMatcher(t *testing.T) {
+	m := NewMatcher()
+	if err := m.Match([]byte(`{"type":"session_resumption_update","handle":"old"}`),
+		[]byte(`{"handle":"new","type":"session_resumption_update"}`)); err != nil {
+		t.Fatalf("Expected handles to be matched up, got %v", err)
+	}
+	if err := m.Match([]byte(`{"type":"going_away","handle":"old"}`),
+		[]byte(`{"type":"going_away","handle":"other"}`)); err == nil {
+		t.Error("Expected a handle that contradicts an earlier one to diverge")
+	}
+	if err := m.Match([]byte(`{"type":"output_text","text":"a"}`),
+		[]byte(`{"type":"output_text","text":"b"}`)); err == nil {
+		t.Error("Expected different text to diverge")
+	}
+
+	got := m.Rewrite([]byte(`{"type":"setup","model":"m","resumptionHandle":"old"}`))
+	if !bytes.Contains(got, []byte(`"resumptionHandle":"new"`)) {
+		t.Errorf("Expected the handle to be rewritten, got %s", got)
+	}
+	got = m.Rewrite([]byte(`{"type":"setup","model":"m","resumptionHandle":"unknown"}`))
+	if bytes.Contains(got, []byte("resumptionHandle")) {
+		t.Errorf("Expected an unknown handle to be dropped, got %s", got)
+	}
+}
+
+// TestWriterLimit tests that a frame that would exceed the limit is refused and the archive stays readable
+func TestWriterLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(nopCloser{&buf}, Header{SessionID: "s1", Model: "m"})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	w.SetLimit(1024)
+	if err := w.Write(Inbound, []byte(`{"type":"setup","model":"m"}`), false); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	if err := w.Write(Inbound, make([]byte, 1024), true); !errors.Is(err, ErrFull) {
+		t.Errorf("Expected ErrFull for a frame beyond the limit, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	_, frames, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if len(frames) != 1 {
+		t.Errorf("Expected the frame within the limit only, got %d frames", len(frames))
+	}
+}
@@ -0,0 +1,129 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Persister saves sessions to durable storage so they can be resumed after a restart.
+type Persister interface {
+	Save(ctx context.Context, sessions []*Session) error
+	Load(ctx context.Context) ([]*Session, error)
+}
+
+// Record is the serialized form of a Session.
+type Record struct {
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+	ID               ID        `json:"id"`
+	Model            string    `json:"model"`
+	Principal        string    `json:"principal,omitempty"`
+	ResumptionHandle string    `json:"resumptionHandle"`
+	Log              []any     `json:"log"`
+	LogBytes         int64     `json:"logBytes"`
+	State            State     `json:"state"`
+	Deadline         time.Time `json:"deadline,omitzero"`
+}
+
+// Record returns a consistent snapshot of the session.
+func (s *Session) Record() Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Record{
+		CreatedAt:        s.CreatedAt,
+		UpdatedAt:        s.UpdatedAt,
+		ID:               s.ID,
+		Model:            s.Model,
+		Principal:        s.Principal,
+		ResumptionHandle: s.ResumptionHandle,
+		Log:              append([]any(nil), s.Log...),
+		LogBytes:         s.LogBytes,
+		State:            s.State,
+		Deadline:         s.Deadline,
+	}
+}
+
+// FromRecord restores a session from its serialized form.
+func FromRecord(r Record) *Session {
+	log := r.Log
+	if log == nil {
+		log = []any{}
+	}
+	return &Session{
+		CreatedAt:        r.CreatedAt,
+		UpdatedAt:        r.UpdatedAt,
+		ID:               r.ID,
+		Model:            r.Model,
+		Principal:        r.Principal,
+		ResumptionHandle: r.ResumptionHandle,
+		Log:              log,
+		LogBytes:         r.LogBytes,
+		State:            r.State,
+		Deadline:         r.Deadline,
+	}
+}
+
+// FilePersister keeps sessions in a single JSON file.
+type FilePersister struct {
+	path string
+}
+
+// NewFilePersister creates a persister backed by the file at path.
+func NewFilePersister(path string) *FilePersister {
+	return &FilePersister{path: path}
+}
+
+// Save implements Persister. The file is replaced atomically.
+func (p *FilePersister) Save(_ context.Context, sessions []*Session) error {
+	records := make([]Record, 0, len(sessions))
+	for _, s := range sessions {
+		records = append(records, s.Record())
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("encode sessions: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".*")
+	if err != nil {
+		return fmt.Errorf("save sessions: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("save sessions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save sessions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return fmt.Errorf("save sessions: %w", err)
+	}
+	return nil
+}
+
+// Load implements Persister. A missing file yields no sessions.
+func (p *FilePersister) Load(_ context.Context) ([]*Session, error) {
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load sessions: %w", err)
+	}
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("parse sessions %s: %w", p.path, err)
+	}
+	sessions := make([]*Session, 0, len(records))
+	for _, r := range records {
+		sessions = append(sessions, FromRecord(r))
+	}
+	return sessions, nil
+}
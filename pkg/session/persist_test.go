@@ -0,0 +1,50 @@
+package session
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFilePersister tests saving and loading sessions through a file
+func TestFilePersister(t *testing.T) {
+	p := NewFilePersister(filepath.Join(t.TempDir(), "sessions.json"))
+
+	loaded, err := p.Load(context.Background())
+	if err != nil || len(loaded) != 0 {
+		t.Fatalf("Expected no sessions from a missing file, got %d (%v)", len(loaded), err)
+	}
+
+	session := NewSession("gemini-1.5-flash")
+	session.State = StateActive
+	session.Principal = "alice"
+	session.ResumptionHandle = "session_" + string(session.ID)
+	session.Deadline = time.Now().Add(time.Hour)
+	if err := session.AppendSized(map[string]any{"type": "input_text", "text": "hi"}, 36, 0); err != nil {
+		t.Fatalf("Failed to append message: %v", err)
+	}
+
+	if err := p.Save(context.Background(), []*Session{session}); err != nil {
+		t.Fatalf("Failed to save sessions: %v", err)
+	}
+	loaded, err = p.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to load sessions: %v", err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(loaded))
+	}
+
+	got := loaded[0]
+	if got.ID != session.ID || got.State != StateActive || got.Principal != "alice" ||
+		got.ResumptionHandle != session.ResumptionHandle || got.LogBytes != 36 || len(got.Log) != 1 {
+		t.Errorf("Expected %+v, got %+v", session.Record(), got.Record())
+	}
+	if !got.CreatedAt.Equal(session.CreatedAt) {
+		t.Errorf("Expected CreatedAt %v, got %v", session.CreatedAt, got.CreatedAt)
+	}
+	if !got.Deadline.Equal(session.Deadline) {
+		t.Errorf("Expected Deadline %v, got %v", session.Deadline, got.Deadline)
+	}
+}
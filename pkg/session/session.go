@@ -2,12 +2,16 @@
 package session
 
 import (
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrLogFull is returned when a message would grow the session log beyond its limit.
+var ErrLogFull = errors.New("session log full")
+
 // ID represents a unique session identifier.
 type ID string
 
@@ -17,10 +21,16 @@ type Session struct {
 	UpdatedAt        time.Time
 	ID               ID
 	Model            string
+	Principal        string
 	ResumptionHandle string
 	Log              []any
+	LogBytes         int64
 	mu               sync.Mutex
 	State            State
+	// Deadline is when the session has used up its maximum duration,
+	// across every connection that resumes it. It is zero if the session
+	// has no maximum duration.
+	Deadline time.Time
 }
 
 // NewSession creates a new session with the specified model.
@@ -45,6 +55,44 @@ func (s *Session) Append(message any) {
 	s.UpdatedAt = time.Now()
 }
 
+// AppendSized adds a message whose encoded size is size bytes to the session
+// log, refusing it with ErrLogFull if the log would exceed limit bytes.
+// A limit of zero or less disables the check.
+func (s *Session) AppendSized(message any, size, limit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit > 0 && s.LogBytes+size > limit {
+		return ErrLogFull
+	}
+	s.Log = append(s.Log, message)
+	s.LogBytes += size
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// SetState moves the session to state.
+func (s *Session) SetState(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = state
+}
+
+// CurrentState returns the state of the session, which connections change
+// while others read it.
+func (s *Session) CurrentState() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.State
+}
+
+// Stats returns the number of logged messages and the time of the last update.
+func (s *Session) Stats() (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Log), s.UpdatedAt
+}
+
 // Store manages multiple sessions with thread-safe operations.
 type Store struct {
 	sessions map[ID]*Session
@@ -73,6 +121,29 @@ func (s *Store) Get(id ID) (*Session, bool) {
 	return session, exists
 }
 
+// List returns a snapshot of all sessions in the store.
+func (s *Store) List() []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// FindByHandle returns the session with the given resumption handle.
+func (s *Store) FindByHandle(handle string) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, session := range s.sessions {
+		if session.ResumptionHandle == handle {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
 // Delete removes a session from the store.
 func (s *Store) Delete(id ID) {
 	s.mu.Lock()
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -118,6 +119,31 @@ func TestSessionAppendConcurrency(t *testing.T) {
 	}
 }
 
+// TestSessionAppendSized tests that the log refuses messages beyond its size limit
+func TestSessionAppendSized(t *testing.T) {
+	session := NewSession("test-model")
+
+	if err := session.AppendSized("first", 60, 100); err != nil {
+		t.Fatalf("Expected first message to fit, got %v", err)
+	}
+	if err := session.AppendSized("second", 60, 100); !errors.Is(err, ErrLogFull) {
+		t.Errorf("Expected ErrLogFull, got %v", err)
+	}
+	if err := session.AppendSized("third", 40, 100); err != nil {
+		t.Errorf("Expected message filling the log exactly to fit, got %v", err)
+	}
+	if err := session.AppendSized("unlimited", 1000, 0); err != nil {
+		t.Errorf("Expected zero limit to disable the check, got %v", err)
+	}
+
+	if len(session.Log) != 3 {
+		t.Errorf("Expected log length 3, got %d", len(session.Log))
+	}
+	if session.LogBytes != 1100 {
+		t.Errorf("Expected 1100 logged bytes, got %d", session.LogBytes)
+	}
+}
+
 // TestNewStore tests store creation
 func TestNewStore(t *testing.T) {
 	store := NewStore()
@@ -0,0 +1,77 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sessionInfo is the admin API view of a session.
+type sessionInfo struct {
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	ID        string    `json:"id"`
+	Model     string    `json:"model"`
+	Principal string    `json:"principal,omitempty"`
+	State     string    `json:"state"`
+	Messages  int       `json:"messages"`
+}
+
+// adminMethods are the authentication methods admins may use. Ephemeral
+// tokens are left out: they carry the subject of whoever minted them and are
+// handed to browsers.
+var adminMethods = []string{MethodAPIKey, MethodHMAC, MethodJWT, MethodClientCert}
+
+// ValidateAdmins checks that every admin is given as method:id with one of
+// the methods admins may authenticate with.
+func ValidateAdmins(principals ...string) error {
+	var errs []error
+	for _, p := range principals {
+		method, id, ok := strings.Cut(p, ":")
+		if !ok || id == "" || !slices.Contains(adminMethods, method) {
+			errs = append(errs, fmt.Errorf("admin %q must be method:id with a method of %s",
+				p, strings.Join(adminMethods, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requireAdmin restricts a route to admin principals. Unlike the rest of the
+// server the admin API stays closed without authentication: it lists the
+// sessions whose IDs make their resumption handles, so an open one would let
+// anyone who can reach the port take over every session.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok || p.Method == MethodEphemeral || !s.admins[p.Identity()] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, _ *http.Request) {
+	sessions := s.Store.List()
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		messages, updatedAt := sess.Stats()
+		infos = append(infos, sessionInfo{
+			CreatedAt: sess.CreatedAt,
+			UpdatedAt: updatedAt,
+			ID:        string(sess.ID),
+			Model:     sess.Model,
+			Principal: sess.Principal,
+			State:     sess.CurrentState().String(),
+			Messages:  messages,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(s.mustJSON(map[string]any{"sessions": infos}))
+}
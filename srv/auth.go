@@ -0,0 +1,208 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Authentication methods reported on a Principal.
+const (
+	MethodAPIKey = "api_key"
+	MethodHMAC   = "hmac"
+	MethodJWT    = "jwt"
+)
+
+// bearerProtocolPrefix marks a Sec-WebSocket-Protocol entry that carries a
+// credential, for browser clients that cannot set an Authorization header.
+const bearerProtocolPrefix = "bearer."
+
+// ErrUnauthenticated is returned when a request carries no acceptable credential.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal identifies an authenticated caller. Model and SessionConfig,
+// when set, pin the sessions the principal may set up.
+type Principal struct {
+	SessionConfig map[string]any `json:"sessionConfig,omitempty"`
+	ID            string         `json:"id"`
+	Method        string         `json:"method"`
+	Model         string         `json:"model,omitempty"`
+}
+
+// Identity returns method:id, which names p across authentication methods:
+// an ID is unique only within the method that vouched for it, so an API key
+// and a JWT subject that share a name are different callers.
+func (p *Principal) Identity() string {
+	return p.Method + ":" + p.ID
+}
+
+// Authenticator verifies the credentials presented on an HTTP request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal stored by the authentication middleware.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalName returns the principal ID for logging.
+func principalName(p *Principal) string {
+	if p == nil {
+		return "anonymous"
+	}
+	return p.ID
+}
+
+// authenticate rejects requests that none of the configured authenticators accept.
+// When no authenticators are configured every request is let through anonymously.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.authenticators) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var lastErr error
+		for _, a := range s.authenticators {
+			p, err := a.Authenticate(r)
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+				return
+			}
+			if !errors.Is(err, ErrUnauthenticated) || lastErr == nil {
+				lastErr = err
+			}
+		}
+
+		s.logger.Warn("Authentication failed", "method", r.Method, "path", loggedPath(r), "remote", r.RemoteAddr,
+			"error", lastErr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="twinspeak"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// credential extracts a bearer credential from the Authorization header,
+// the access_token query parameter or a "bearer." WebSocket subprotocol.
+func credential(r *http.Request) (string, bool) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, token, ok := strings.Cut(h, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") && token != "" {
+			return strings.TrimSpace(token), true
+		}
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, true
+	}
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, proto := range strings.Split(h, ",") {
+			proto = strings.TrimSpace(proto)
+			if token, ok := strings.CutPrefix(proto, bearerProtocolPrefix); ok && token != "" {
+				return token, true
+			}
+		}
+	}
+	return "", false
+}
+
+// APIKeys authenticates requests carrying one of a set of static keys.
+type APIKeys struct {
+	principals atomic.Pointer[map[[sha256.Size]byte]string]
+}
+
+// NewAPIKeys creates an authenticator from a map of key to principal ID.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	a := &APIKeys{}
+	a.Replace(keys)
+	return a
+}
+
+// Replace swaps in a new map of key to principal ID. Sessions authenticated
+// with a removed key stay open.
+func (a *APIKeys) Replace(keys map[string]string) {
+	principals := make(map[[sha256.Size]byte]string, len(keys))
+	for key, id := range keys {
+		principals[sha256.Sum256([]byte(key))] = id
+	}
+	a.principals.Store(&principals)
+}
+
+// Len returns the number of configured keys.
+func (a *APIKeys) Len() int {
+	return len(*a.principals.Load())
+}
+
+// Authenticate implements Authenticator.
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key, ok := credential(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	id, ok := (*a.principals.Load())[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return &Principal{ID: id, Method: MethodAPIKey}, nil
+}
+
+// ParseAPIKeys parses "principal:key" entries separated by newlines or commas.
+// Blank entries and lines starting with '#' are ignored.
+func ParseAPIKeys(data string) (map[string]string, error) {
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(data, ",", "\n")))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(entry, ":")
+		id, key = strings.TrimSpace(id), strings.TrimSpace(key)
+		if !ok || id == "" || key == "" {
+			return nil, fmt.Errorf("entry %d: expected principal:key", line)
+		}
+		keys[key] = id
+	}
+	return keys, scanner.Err()
+}
+
+// LoadAPIKeys reads API keys from the file at path and from the named
+// environment variable. Either source may be empty.
+func LoadAPIKeys(path, env string) (map[string]string, error) {
+	keys := make(map[string]string)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read API keys: %w", err)
+		}
+		fromFile, err := ParseAPIKeys(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parse API keys file %s: %w", path, err)
+		}
+		for k, v := range fromFile {
+			keys[k] = v
+		}
+	}
+	if v := os.Getenv(env); env != "" && v != "" {
+		fromEnv, err := ParseAPIKeys(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", env, err)
+		}
+		for k, v := range fromEnv {
+			keys[k] = v
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,373 @@
+package srv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// setupSession sends a setup message and waits for the resumption update
+func setupSession(t *testing.T, conn net.Conn) {
+	t.Helper()
+	data, err := json.Marshal(g.SetupRequestJson{Type: "setup", Model: "gemini-1.5-flash"})
+	if err != nil {
+		t.Fatalf("Failed to marshal setup request: %v", err)
+	}
+	if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+		t.Fatalf("Failed to send setup message: %v", err)
+	}
+	if _, _, err := wsutil.ReadServerData(conn); err != nil {
+		t.Fatalf("Failed to read setup response: %v", err)
+	}
+}
+
+// TestAuthenticationRequired tests that upgrades without credentials are rejected
+func TestAuthenticationRequired(t *testing.T) {
+	server := New(WithAuthenticators(NewAPIKeys(map[string]string{"secret-key": "alice"})))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	for _, url := range []string{wsURL, wsURL + "?access_token=wrong-key"} {
+		_, _, _, err := ws.DefaultDialer.Dial(context.Background(), url)
+		var statusErr ws.StatusError
+		if !errors.As(err, &statusErr) || int(statusErr) != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for %s, got %v", url, err)
+		}
+	}
+
+	resp, err := httpServer.Client().Get(httpServer.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Failed to call health endpoint: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected health endpoint to stay public, got %d", resp.StatusCode)
+	}
+}
+
+// TestAPIKeyCredentialLocations tests that API keys are accepted from header, query and subprotocol
+func TestAPIKeyCredentialLocations(t *testing.T) {
+	server := New(WithAuthenticators(NewAPIKeys(map[string]string{"secret-key": "alice"})))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	tests := []struct {
+		dialer   ws.Dialer
+		name     string
+		url      string
+		protocol string
+	}{
+		{
+			name: "Authorization header",
+			url:  wsURL,
+			dialer: ws.Dialer{
+				Header: ws.HandshakeHeaderHTTP(http.Header{"Authorization": {"Bearer secret-key"}}),
+			},
+		},
+		{
+			name: "Query parameter",
+			url:  wsURL + "?access_token=secret-key",
+		},
+		{
+			name:     "Subprotocol",
+			url:      wsURL,
+			dialer:   ws.Dialer{Protocols: []string{bearerProtocolPrefix + "secret-key", Subprotocol}},
+			protocol: Subprotocol,
+		},
+		{
+			// Browsers fail the handshake unless one of their protocols is selected.
+			name:     "Subprotocol only",
+			url:      wsURL,
+			dialer:   ws.Dialer{Protocols: []string{bearerProtocolPrefix + "secret-key"}},
+			protocol: bearerProtocolPrefix + "secret-key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, hs, err := tt.dialer.Dial(context.Background(), tt.url)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+
+			if hs.Protocol != tt.protocol {
+				t.Errorf("Expected negotiated protocol %q, got %q", tt.protocol, hs.Protocol)
+			}
+
+			setupSession(t, conn)
+		})
+	}
+
+	for _, sess := range server.Store.List() {
+		if sess.Principal != "api_key:alice" {
+			t.Errorf("Expected session principal api_key:alice, got %q", sess.Principal)
+		}
+	}
+}
+
+// TestHMACTokens tests HMAC-signed bearer token verification
+func TestHMACTokens(t *testing.T) {
+	tokens := NewHMACTokens([]byte("0123456789abcdef0123456789abcdef"))
+	server := New(WithAuthenticators(tokens))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	now := time.Now()
+
+	valid, err := tokens.Sign(Claims{Subject: "bob", ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	expired, err := tokens.Sign(Claims{Subject: "bob", ExpiresAt: now.Add(-time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	forged, err := NewHMACTokens([]byte("another-secret-another-secret-00")).
+		Sign(Claims{Subject: "bob", ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+valid)
+	if err != nil {
+		t.Fatalf("Expected valid token to be accepted: %v", err)
+	}
+	setupSession(t, conn)
+	conn.Close()
+
+	for name, token := range map[string]string{"expired": expired, "forged": forged} {
+		if _, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+token); err == nil {
+			t.Errorf("Expected %s token to be rejected", name)
+		}
+	}
+}
+
+// TestJWTVerification tests JWT verification against a JWKS
+func TestJWTVerification(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	jwks, err := json.Marshal(map[string]any{"keys": []JWK{{
+		Kty: "EC",
+		Kid: "test-key",
+		Crv: "P-256",
+		X:   b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	if err != nil {
+		t.Fatalf("Failed to marshal JWKS: %v", err)
+	}
+	keySet, err := ParseJWKS(jwks)
+	if err != nil {
+		t.Fatalf("Failed to parse JWKS: %v", err)
+	}
+
+	server := New(WithAuthenticators(NewJWTVerifier(keySet, "https://issuer.example", "twinspeak")))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	exp := time.Now().Add(time.Minute).Unix()
+
+	sign := func(claims map[string]any) string {
+		header := b64.EncodeToString([]byte(`{"alg":"ES256","kid":"test-key","typ":"JWT"}`))
+		payload, _ := json.Marshal(claims)
+		input := header + "." + b64.EncodeToString(payload)
+		sum := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		return input + "." + b64.EncodeToString(sig)
+	}
+
+	valid := sign(map[string]any{"sub": "carol", "iss": "https://issuer.example", "aud": "twinspeak", "exp": exp})
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+valid)
+	if err != nil {
+		t.Fatalf("Expected valid JWT to be accepted: %v", err)
+	}
+	setupSession(t, conn)
+	conn.Close()
+
+	wrongIssuer := sign(map[string]any{"sub": "carol", "iss": "https://evil.example", "aud": "twinspeak", "exp": exp})
+	if _, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+wrongIssuer); err == nil {
+		t.Error("Expected JWT with wrong issuer to be rejected")
+	}
+}
+
+// TestAdminSessions tests the admin session listing and its access control
+func TestAdminSessions(t *testing.T) {
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"admin-key": "root", "user-key": "alice"})),
+		WithAdmins("api_key:root"),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token=user-key")
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	setupSession(t, conn)
+
+	get := func(key string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/v1/admin/sessions", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := httpServer.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to call admin endpoint: %v", err)
+		}
+		return resp
+	}
+
+	resp := get("user-key")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for non-admin, got %d", resp.StatusCode)
+	}
+
+	resp = get("admin-key")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for admin, got %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode admin response: %v", err)
+	}
+	if len(body.Sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(body.Sessions))
+	}
+	if body.Sessions[0].Principal != "api_key:alice" {
+		t.Errorf("Expected principal api_key:alice, got %q", body.Sessions[0].Principal)
+	}
+	if body.Sessions[0].State != "Configured" {
+		t.Errorf("Expected state Configured, got %s", body.Sessions[0].State)
+	}
+}
+
+// waitDetached waits until server has no live connections, so that their sessions can be resumed
+func waitDetached(t *testing.T, server *Server) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		server.connsMu.Lock()
+		live := len(server.conns)
+		server.connsMu.Unlock()
+		if live == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connections to end, %d still live", live)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestResumptionIdentity tests that only the principal that set a session up, by the same method, may resume it
+func TestResumptionIdentity(t *testing.T) {
+	hmacTokens := NewHMACTokens([]byte("0123456789abcdef0123456789abcdef"))
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"alice-key": "alice", "backend-key": "backend"}), hmacTokens),
+		WithEphemeralTokens(NewEphemeralTokens([]byte("ephemeral-secret-ephemeral-secret"))),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	key := func(k string) func() string { return func() string { return k } }
+	minted := func(body string) func() string {
+		return func() string {
+			_, token := mintToken(t, httpServer.URL, "backend-key", body)
+			return token.Token
+		}
+	}
+	hmacAlice, err := hmacTokens.Sign(Claims{Subject: "alice", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		owner    func() string
+		resumer  func() string
+		expected string
+	}{
+		{name: "Same key", owner: key("alice-key"), resumer: key("alice-key")},
+		{name: "Same ID by another method", owner: key("alice-key"), resumer: key(hmacAlice),
+			expected: "invalid_handle"},
+		{name: "Token minted by the owner", owner: key("backend-key"), resumer: minted(`{}`),
+			expected: "invalid_handle"},
+		{name: "Tokens for the same user", owner: minted(`{"user": "u1"}`), resumer: minted(`{"user": "u1"}`)},
+		{name: "Tokens for another user", owner: minted(`{"user": "u1"}`), resumer: minted(`{"user": "u2"}`),
+			expected: "invalid_handle"},
+		{name: "Tokens without a user", owner: minted(`{}`), resumer: minted(`{}`), expected: "invalid_handle"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+tt.owner())
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			update, _ := sendSetup(t, owner, "")
+			owner.Close()
+			waitDetached(t, server)
+
+			resumer, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+tt.resumer())
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer resumer.Close()
+			if _, errorResp := sendSetup(t, resumer, update.Handle); errorResp.Code != tt.expected {
+				t.Errorf("Expected error %q on resumption, got %q", tt.expected, errorResp.Code)
+			}
+		})
+	}
+}
+
+// TestAdminClosedWithoutAuthentication tests that the admin API is refused when no authenticators are configured
+func TestAdminClosedWithoutAuthentication(t *testing.T) {
+	httpServer := httptest.NewServer(New(WithAdmins("api_key:root")).Handler())
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/v1/admin/sessions")
+	if err != nil {
+		t.Fatalf("Failed to call admin API: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", resp.StatusCode)
+	}
+}
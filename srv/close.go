@@ -0,0 +1,130 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// closeReason is a close frame the server sends. Reasons are snake_case
+// tokens that clients can match on where codes are shared; both are listed
+// under x-close-codes of the /v1/speak channel in api/gemini.json.
+type closeReason struct {
+	code   ws.StatusCode
+	reason string
+}
+
+// The close frames of /v1/speak, one for every way the server ends a
+// connection. Clients that close first have their own code echoed.
+var (
+	closeSessionEnded     = closeReason{ws.StatusNormalClosure, "session_ended"}
+	closeShutdown         = closeReason{ws.StatusGoingAway, "server_shutdown"}
+	closeKeepaliveTimeout = closeReason{ws.StatusGoingAway, "keepalive_timeout"}
+	closeProtocolError    = closeReason{ws.StatusProtocolError, "protocol_error"}
+	closeInvalidPayload   = closeReason{ws.StatusInvalidFramePayloadData, "invalid_payload"}
+	closeRateLimited      = closeReason{ws.StatusPolicyViolation, "rate_limited"}
+	closeMessageTooBig    = closeReason{ws.StatusMessageTooBig, "message_too_big"}
+	closeInternalError    = closeReason{ws.StatusInternalServerError, "internal_error"}
+)
+
+// closeReasons lists every close frame the server sends.
+var closeReasons = []closeReason{
+	closeSessionEnded, closeShutdown, closeKeepaliveTimeout, closeProtocolError,
+	closeInvalidPayload, closeRateLimited, closeMessageTooBig, closeInternalError,
+}
+
+// closeWith sends the close frame c unless a close frame was sent already,
+// and counts it. The connection is left for the caller to close.
+func (s *Server) closeWith(conn *clientConn, c closeReason) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	if conn.closeSent {
+		return
+	}
+	conn.closeSent = true
+	if err := conn.transport.WriteClose(c.code, c.reason); err != nil {
+		conn.logger().Warn("Failed to send close frame", "code", c.code, "reason", c.reason, "error", err)
+		return
+	}
+	s.metrics.closes.WithLabelValues(initiatorServer, strconv.Itoa(int(c.code))).Inc()
+}
+
+// WriteClose sends a close frame, unless one was sent already.
+func (c *wsConn) WriteClose(code ws.StatusCode, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	c.closeSent = true
+	return ws.WriteFrame(c, ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+}
+
+// handleControl answers a control frame of the client. A close frame is
+// echoed with the client's code, which counts as the server's close frame;
+// one that breaks the rules gets a protocol error close instead.
+func (c *wsConn) handleControl(hdr ws.Header, r io.Reader) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if hdr.OpCode != ws.OpClose {
+		return c.control(hdr, r)
+	}
+	if c.closeSent {
+		// This is the client's answer to the server's close frame.
+		return wsutil.ClosedError{Code: ws.StatusNormalClosure}
+	}
+	err := c.control(hdr, r)
+	c.closeSent = true
+	return err
+}
+
+// closedByClient records that the client of conn closed the connection,
+// unless it was answering the server's close frame.
+func (s *Server) closedByClient(conn *clientConn, closed wsutil.ClosedError) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	if conn.closeSent {
+		return
+	}
+	conn.closeSent = true
+	s.metrics.closes.WithLabelValues(initiatorClient, strconv.Itoa(int(closed.Code))).Inc()
+}
+
+// readFailed ends conn after reading from it failed, with the close frame
+// the failure calls for. Clients that closed the connection themselves or
+// whose network dropped it are not sent one.
+func (s *Server) readFailed(conn *clientConn, err error) {
+	var closed wsutil.ClosedError
+	var protocolErr ws.ProtocolError
+	switch {
+	case conn.closing.Load():
+		// Shutdown closed the connection.
+	case errors.As(err, &closed):
+		s.closedByClient(conn, closed)
+		conn.logger().Info("Connection closed by client", "code", closed.Code, "reason", closed.Reason)
+	case errors.Is(err, wsutil.ErrFrameTooLarge):
+		conn.logger().Warn("Closing connection: message too big", "max_frame_bytes", s.messageLimits.MaxFrameBytes)
+		s.sendError(conn, "frame_too_large",
+			fmt.Sprintf("Message exceeds the limit of %d bytes", s.messageLimits.MaxFrameBytes))
+		s.closeWith(conn, closeMessageTooBig)
+	case errors.Is(err, os.ErrDeadlineExceeded) && conn.sessionOver():
+		conn.logger().Warn("Closing connection: maximum session duration reached")
+		s.rateLimited(conn, "Maximum session duration reached")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		s.unresponsive(conn)
+	case errors.Is(err, wsutil.ErrInvalidUTF8), errors.Is(err, errCorruptMessage):
+		conn.logger().Warn("Closing connection: invalid message payload", "error", err)
+		s.closeWith(conn, closeInvalidPayload)
+	case errors.As(err, &protocolErr):
+		conn.logger().Warn("Closing connection: WebSocket protocol error", "error", err)
+		s.closeWith(conn, closeProtocolError)
+	default:
+		conn.logger().Info("Connection closed", "reason", err)
+	}
+}
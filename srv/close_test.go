@@ -0,0 +1,126 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"jig.sx/twinspeak/api"
+)
+
+// expectClose reads frames until the server's close frame and returns its code and reason
+func expectClose(t *testing.T, conn net.Conn) (ws.StatusCode, string) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	for {
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("Expected a close frame, got %v", err)
+		}
+		if frame.Header.OpCode == ws.OpClose {
+			return ws.ParseCloseFrameData(frame.Payload)
+		}
+	}
+}
+
+// TestCloseCodesDocumented tests that the spec lists exactly the close frames the server sends
+func TestCloseCodesDocumented(t *testing.T) {
+	data, err := api.FS.ReadFile("gemini.json")
+	if err != nil {
+		t.Fatalf("Failed to read spec: %v", err)
+	}
+	var spec struct {
+		Channels map[string]struct {
+			CloseCodes []struct {
+				Code   ws.StatusCode `json:"code"`
+				Reason string        `json:"reason"`
+			} `json:"x-close-codes"`
+		} `json:"channels"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("Failed to parse spec: %v", err)
+	}
+	documented := make(map[closeReason]bool)
+	for _, c := range spec.Channels["/v1/speak"].CloseCodes {
+		documented[closeReason{c.Code, c.Reason}] = true
+	}
+	for _, c := range closeReasons {
+		if !documented[c] {
+			t.Errorf("Close %d %s is not documented", c.code, c.reason)
+		}
+		delete(documented, c)
+	}
+	for c := range documented {
+		t.Errorf("Close %d %s is documented but never sent", c.code, c.reason)
+	}
+}
+
+// TestCloseFrames tests the close frame that ends a connection in each way a client can bring it about
+func TestCloseFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		send     func(conn net.Conn) error
+		expected closeReason
+	}{
+		{
+			name: "End session",
+			send: func(c net.Conn) error {
+				return wsutil.WriteClientText(c, []byte(`{"type": "end_session", "reason": "user_requested"}`))
+			},
+			expected: closeSessionEnded,
+		},
+		{
+			name: "Invalid UTF-8",
+			send: func(c net.Conn) error {
+				return wsutil.WriteClientText(c, []byte{'"', 0xff, '"'})
+			},
+			expected: closeInvalidPayload,
+		},
+		{
+			name: "Unmasked frame",
+			send: func(c net.Conn) error {
+				return ws.WriteFrame(c, ws.NewTextFrame([]byte(`{"type": "input_text", "text": "hi"}`)))
+			},
+			expected: closeProtocolError,
+		},
+		{
+			name: "Client close",
+			send: func(c net.Conn) error {
+				body := ws.NewCloseFrameBody(ws.StatusNormalClosure, "done")
+				return ws.WriteFrame(c, ws.MaskFrame(ws.NewCloseFrame(body)))
+			},
+			expected: closeReason{ws.StatusNormalClosure, ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(New().Handler())
+			defer httpServer.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+			setupSession(t, conn)
+
+			if err := tt.send(conn); err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+			if code, reason := expectClose(t, conn); code != tt.expected.code || reason != tt.expected.reason {
+				t.Errorf("Expected close %d %q, got %d %q", tt.expected.code, tt.expected.reason, code, reason)
+			}
+		})
+	}
+}
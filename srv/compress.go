@@ -0,0 +1,199 @@
+package srv
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// CapabilityCompression is reported in setup_complete when permessage-deflate
+// was negotiated at the upgrade. It cannot be enabled by setup alone.
+const CapabilityCompression = "compression"
+
+// deflateWindow is the size of the LZ77 window that context takeover keeps
+// between messages.
+const deflateWindow = 32 << 10
+
+// deflateTail is appended to a compressed message before inflating it: the
+// empty block that the sender's flush ended it with, followed by an empty
+// final block so that the inflater stops at the end of the message.
+var deflateTail = []byte{0, 0, 0xff, 0xff, 1, 0, 0, 0xff, 0xff}
+
+// errCorruptMessage is returned by inflate for data that is not deflate.
+var errCorruptMessage = errors.New("corrupt compressed message")
+
+// CompressionConfig configures permessage-deflate (RFC 7692) on /v1/speak.
+// It only applies to clients that offer the extension.
+type CompressionConfig struct {
+	// Enabled accepts permessage-deflate offers.
+	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// Level is the flate level from 1 (fastest) to 9 (smallest); 0 uses
+	// the flate default.
+	Level int `json:"level,omitempty" yaml:"level,omitempty"`
+	// ContextTakeover keeps the compression window from one message to
+	// the next. A session repeats itself a lot, so this compresses much
+	// better, at the cost of about 32 KiB of window per direction and
+	// connection.
+	ContextTakeover bool `json:"contextTakeover,omitempty" yaml:"contextTakeover,omitempty"`
+	// MinSize is the size below which messages are sent uncompressed,
+	// where deflate saves too little to pay for itself.
+	MinSize int `json:"minSize,omitempty" yaml:"minSize,omitempty"`
+}
+
+// Validate checks the level and the size threshold.
+func (c CompressionConfig) Validate() error {
+	if c.Level < 0 || c.Level > flate.BestCompression {
+		return fmt.Errorf("compression level %d is not between 0 and %d", c.Level, flate.BestCompression)
+	}
+	if c.MinSize < 0 {
+		return errors.New("compression minimum size must not be negative")
+	}
+	return nil
+}
+
+// WithCompression negotiates permessage-deflate as configured by c.
+func WithCompression(c CompressionConfig) Option {
+	return func(s *Server) {
+		s.compression = c
+	}
+}
+
+// extension returns the permessage-deflate parameters the server accepts.
+// Without context takeover both sides are told to reset their window after
+// every message. Offers that limit the server's window are declined, as
+// compress/flate always uses the full one.
+func (c CompressionConfig) extension() *wsflate.Extension {
+	return &wsflate.Extension{Parameters: wsflate.Parameters{
+		ServerNoContextTakeover: !c.ContextTakeover,
+		ClientNoContextTakeover: !c.ContextTakeover,
+	}}
+}
+
+// deflater compresses the messages of one connection and inflates those of
+// its client. Outbound state is guarded by the connection's writeMu and
+// inbound state is only used by its reading goroutine.
+type deflater struct {
+	level    int
+	minSize  int
+	takeover bool
+
+	writer *flate.Writer
+	out    bytes.Buffer
+
+	state  wsflate.MessageState
+	reader io.ReadCloser
+	window []byte
+}
+
+func newDeflater(c CompressionConfig) (*deflater, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	d := &deflater{level: level, minSize: c.MinSize, takeover: c.ContextTakeover}
+	w, err := flate.NewWriter(&d.out, level)
+	if err != nil {
+		return nil, err
+	}
+	d.writer = w
+	return d, nil
+}
+
+// compress deflates data unless it is smaller than minSize, and reports
+// whether it did. The result is only valid until the next call.
+func (d *deflater) compress(data []byte) ([]byte, bool, error) {
+	if len(data) < d.minSize {
+		return data, false, nil
+	}
+	d.out.Reset()
+	if !d.takeover {
+		d.writer.Reset(&d.out)
+	}
+	if _, err := d.writer.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := d.writer.Flush(); err != nil {
+		return nil, false, err
+	}
+	// The flush ends with an empty stored block, which RFC 7692 says to
+	// leave out of the message.
+	return bytes.TrimSuffix(d.out.Bytes(), deflateTail[:4]), true, nil
+}
+
+// inflate decompresses a message of the client, failing with
+// wsutil.ErrFrameTooLarge once it exceeds limit bytes and with
+// wsutil.ErrInvalidUTF8 if it is text that is not UTF-8.
+func (d *deflater) inflate(payload []byte, limit int64, text bool) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail))
+	var dict []byte
+	if d.takeover {
+		dict = d.window
+	}
+	if d.reader == nil {
+		d.reader = flate.NewReaderDict(src, dict)
+	} else if err := d.reader.(flate.Resetter).Reset(src, dict); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(d.reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCorruptMessage, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, wsutil.ErrFrameTooLarge
+	}
+	if text && !utf8.Valid(data) {
+		return nil, wsutil.ErrInvalidUTF8
+	}
+	if d.takeover {
+		d.window = append(d.window, data...)
+		if n := len(d.window); n > deflateWindow {
+			d.window = append(d.window[:0], d.window[n-deflateWindow:]...)
+		}
+	}
+	return data, nil
+}
+
+// acceptCompression sets c up for the permessage-deflate extension accepted
+// at its upgrade.
+func (s *Server) acceptCompression(c *wsConn) {
+	// Only an invalid level fails, which Validate rules out.
+	d, err := newDeflater(s.compression)
+	s.ensure(err)
+	c.deflate = d
+	c.reader.State |= ws.StateExtended
+	c.reader.Extensions = []wsutil.RecvExtension{&d.state}
+	// The reader would check the compressed bytes, so ReadMessage checks
+	// the inflated text instead.
+	c.reader.CheckUTF8 = false
+	s.metrics.compressedConns.Inc()
+}
+
+// WriteMessage writes data as a text message, compressed if the client
+// negotiated permessage-deflate and data is large enough.
+func (c *wsConn) WriteMessage(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	d := c.deflate
+	if d == nil {
+		return wsutil.WriteServerMessage(c, ws.OpText, data)
+	}
+	payload, compressed, err := d.compress(data)
+	if err != nil {
+		return err
+	}
+	frame := ws.NewTextFrame(payload)
+	if compressed {
+		if frame.Header, err = wsflate.SetBit(frame.Header); err != nil {
+			return err
+		}
+		c.metrics.observeCompression(directionOut, len(data), len(payload))
+	}
+	return ws.WriteFrame(c, frame)
+}
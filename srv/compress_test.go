@@ -0,0 +1,212 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// deflatePeer is the client side of a connection that negotiated
+// permessage-deflate. It compresses with a deflater of its own, as the
+// wsflate helpers trip over the final block of current compress/flate, but
+// decompresses with them where no state is kept between messages.
+type deflatePeer struct {
+	t        *testing.T
+	conn     net.Conn
+	d        *deflater
+	takeover bool
+}
+
+// dialDeflate connects to the server at baseURL, offering permessage-deflate
+// if offer is set, and reports whether the server accepted it.
+func dialDeflate(t *testing.T, baseURL string, offer bool, c CompressionConfig) (*deflatePeer, bool) {
+	t.Helper()
+	var d ws.Dialer
+	if offer {
+		params := wsflate.DefaultParameters
+		if c.ContextTakeover {
+			params = wsflate.Parameters{}
+		}
+		d.Extensions = []httphead.Option{params.Option()}
+	}
+	conn, br, hs, err := d.Dial(context.Background(), "ws"+strings.TrimPrefix(baseURL, "http")+"/v1/speak")
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &deflatePeer{t: t, conn: withBuffered(conn, br), takeover: c.ContextTakeover}
+	if p.d, err = newDeflater(CompressionConfig{ContextTakeover: c.ContextTakeover}); err != nil {
+		t.Fatalf("Failed to create deflater: %v", err)
+	}
+	return p, len(hs.Extensions) > 0
+}
+
+// send writes msg as a compressed text message.
+func (p *deflatePeer) send(msg string) {
+	p.t.Helper()
+	payload, _, err := p.d.compress([]byte(msg))
+	frame := ws.NewTextFrame(payload)
+	if err == nil {
+		frame.Header, err = wsflate.SetBit(frame.Header)
+	}
+	if err == nil {
+		err = ws.WriteFrame(p.conn, ws.MaskFrameInPlace(frame))
+	}
+	if err != nil {
+		p.t.Fatalf("Failed to send message: %v", err)
+	}
+}
+
+// read returns the next server message and whether it came compressed.
+func (p *deflatePeer) read() ([]byte, bool) {
+	p.t.Helper()
+	frame, err := ws.ReadFrame(p.conn)
+	if err != nil {
+		p.t.Fatalf("Failed to read message: %v", err)
+	}
+	if frame.Header.OpCode == ws.OpClose {
+		code, reason := ws.ParseCloseFrameData(frame.Payload)
+		p.t.Fatalf("Expected a message, got close %d %s", code, reason)
+	}
+	compressed, err := wsflate.IsCompressed(frame.Header)
+	if err != nil {
+		p.t.Fatalf("Failed to check compression: %v", err)
+	}
+	if !compressed {
+		return frame.Payload, false
+	}
+	if !p.takeover {
+		frame, err = wsflate.DecompressFrame(frame)
+	} else {
+		frame.Payload, err = p.d.inflate(frame.Payload, DefaultMessageLimits.MaxFrameBytes, true)
+	}
+	if err != nil {
+		p.t.Fatalf("Failed to decompress message: %v", err)
+	}
+	return frame.Payload, true
+}
+
+// TestCompression tests that messages are compressed in both directions once negotiated, and only above MinSize
+func TestCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		offer    bool
+		takeover bool
+	}{
+		{name: "Not offered"},
+		{name: "No context takeover", offer: true},
+		{name: "Context takeover", offer: true, takeover: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := CompressionConfig{Enabled: true, Level: 6, ContextTakeover: tt.takeover, MinSize: 64}
+			httpServer := httptest.NewServer(New(WithCompression(c)).Handler())
+			defer httpServer.Close()
+
+			p, accepted := dialDeflate(t, httpServer.URL, tt.offer, c)
+			if accepted != tt.offer {
+				t.Fatalf("Expected permessage-deflate accepted to be %v", tt.offer)
+			}
+			send := p.send
+			if !tt.offer {
+				send = func(msg string) {
+					if err := wsutil.WriteClientText(p.conn, []byte(msg)); err != nil {
+						t.Fatalf("Failed to send message: %v", err)
+					}
+				}
+			}
+			read := func() []byte {
+				t.Helper()
+				msg, compressed := p.read()
+				if expected := tt.offer && len(msg) >= c.MinSize; compressed != expected {
+					t.Errorf("Expected compressed to be %v for %d bytes: %s", expected, len(msg), msg)
+				}
+				return msg
+			}
+
+			send(`{"type": "setup", "model": "gemini-1.5-flash", "version": "1.1", "capabilities": ["compression"]}`)
+			var complete g.SetupCompleteJson
+			if err := json.Unmarshal(read(), &complete); err != nil {
+				t.Fatalf("Failed to unmarshal setup_complete: %v", err)
+			}
+			if slices.Contains(complete.Capabilities, CapabilityCompression) != tt.offer {
+				t.Errorf("Expected compression capability to be %v, got %v", tt.offer, complete.Capabilities)
+			}
+			read()
+
+			for _, text := range []string{
+				"hi",
+				strings.Repeat("all work and no play makes a dull session ", 20),
+				strings.Repeat("all work and no play makes a dull session ", 21),
+			} {
+				send(`{"type": "input_text", "text": "` + text + `"}`)
+				var output g.ServerOutputTextJson
+				if err := json.Unmarshal(read(), &output); err != nil {
+					t.Fatalf("Failed to unmarshal text output: %v", err)
+				}
+				if output.Text != "[echo] "+text || !output.Final {
+					t.Errorf("Expected final echo of %d characters, got %+v", len(text), output)
+				}
+			}
+
+			body := scrape(t, httpServer.URL)
+			if !tt.offer {
+				if strings.Contains(body, "twinspeak_ws_compressed_connections_total 1") {
+					t.Errorf("Expected no compressed connections")
+				}
+				return
+			}
+			for _, want := range []string{
+				`twinspeak_ws_compressed_connections_total 1`,
+				`twinspeak_ws_compression_ratio_count{direction="in"} 4`,
+				`twinspeak_ws_compression_ratio_count{direction="out"} 4`,
+				`twinspeak_ws_compression_ratio_bucket{direction="out",le="0.2"} 2`,
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("Expected metrics to contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+// TestDecompressionLimit tests that a compressed message is held to MaxFrameBytes once inflated
+func TestDecompressionLimit(t *testing.T) {
+	c := CompressionConfig{Enabled: true}
+	server := New(WithCompression(c), WithMessageLimits(MessageLimits{MaxFrameBytes: 1024}))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	p, accepted := dialDeflate(t, httpServer.URL, true, c)
+	if !accepted {
+		t.Fatalf("Expected permessage-deflate to be accepted")
+	}
+	p.send(`{"type": "input_text", "text": "` + strings.Repeat(" ", 64<<10) + `"}`)
+
+	msg, _ := p.read()
+	var errorResp g.ErrorJson
+	if err := json.Unmarshal(msg, &errorResp); err != nil {
+		t.Fatalf("Failed to unmarshal error response: %v", err)
+	}
+	if errorResp.Code != "frame_too_large" {
+		t.Errorf("Expected frame_too_large error code, got %s", errorResp.Code)
+	}
+	_, _, err := wsutil.ReadServerData(p.conn)
+	var closed wsutil.ClosedError
+	if !errors.As(err, &closed) || closed.Code != ws.StatusMessageTooBig {
+		t.Errorf("Expected close code %d, got %v", ws.StatusMessageTooBig, err)
+	}
+}
@@ -0,0 +1,214 @@
+package srv
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// ErrBinaryMessage is returned by Conn.ReadMessage along with the payload of
+// a binary message, which the protocol answers with an error.
+var ErrBinaryMessage = errors.New("binary message")
+
+// Conn carries the messages of one client, whatever the transport. ServeConn
+// runs the protocol on it, which is how /v1/speak serves WebSocket clients,
+// the Server-Sent Events fallback serves HTTP clients, and tests serve the
+// in-memory end of a Pipe. Failures are reported with the errors of wsutil,
+// so that every transport ends its connections alike.
+//
+// ServeConn calls ReadMessage from one goroutine and the other methods from
+// any, but never two of WriteMessage and WriteClose at once. Ping comes from
+// the keepalive's goroutine at any time, so a transport serializes it with
+// its writes itself. No method is called once ServeConn has returned.
+type Conn interface {
+	// ReadMessage returns the next message of the client. It fails with
+	// wsutil.ErrFrameTooLarge for a message above MaxFrameBytes, with
+	// wsutil.ErrInvalidUTF8 for text that is not UTF-8, with
+	// wsutil.ClosedError once the client closed the connection, and with
+	// os.ErrDeadlineExceeded once the read deadline has passed.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a JSON message to the client.
+	WriteMessage(data []byte) error
+	// WriteClose tells the client that the connection ends and why. No
+	// message is written after it.
+	WriteClose(code ws.StatusCode, reason string) error
+	// Ping sends the client a keepalive.
+	Ping() error
+	// SetReadDeadline sets when a pending and every later ReadMessage
+	// fails. The zero time means no deadline.
+	SetReadDeadline(t time.Time) error
+	// Close releases the connection. It is called once ServeConn is done
+	// with it, whether or not WriteClose was.
+	Close() error
+}
+
+// posted is a message queued for a reader, or the error to fail it with.
+type posted struct {
+	data []byte
+	err  error
+}
+
+// inbox queues the messages of a connection whose transport does not read
+// them from a socket itself, with the read deadline of Conn.
+type inbox struct {
+	messages chan posted
+	// gone ends reading when it closes; nil never does.
+	gone <-chan struct{}
+	// done is closed by close, after which nothing is queued.
+	done      chan struct{}
+	closeOnce sync.Once
+	// deadline is the read deadline; deadlineSet wakes a waiting read when
+	// it changes.
+	deadline    time.Time
+	deadlineSet chan struct{}
+	deadlineMu  sync.Mutex
+}
+
+// newInbox returns an inbox holding up to size messages before put waits.
+func newInbox(size int) *inbox {
+	return &inbox{
+		messages:    make(chan posted, size),
+		done:        make(chan struct{}),
+		deadlineSet: make(chan struct{}, 1),
+	}
+}
+
+// put queues p, waiting while the inbox is full until cancel closes. It
+// fails with net.ErrClosed once the inbox is closed.
+func (b *inbox) put(p posted, cancel <-chan struct{}) error {
+	select {
+	case b.messages <- p:
+		return nil
+	case <-b.done:
+		return net.ErrClosed
+	case <-cancel:
+		return net.ErrClosed
+	}
+}
+
+// read returns the next queued message. Messages queued before the inbox
+// was closed are still read.
+func (b *inbox) read() ([]byte, error) {
+	for {
+		select {
+		case p := <-b.messages:
+			return p.data, p.err
+		default:
+		}
+		p, ok, err := b.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return p.data, p.err
+		}
+	}
+}
+
+// next waits for the next message until the read deadline. It returns
+// neither a message nor an error if the deadline changed meanwhile.
+func (b *inbox) next() (posted, bool, error) {
+	b.deadlineMu.Lock()
+	deadline := b.deadline
+	b.deadlineMu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p := <-b.messages:
+		return p, true, nil
+	case <-b.deadlineSet:
+		return posted{}, false, nil
+	case <-expired:
+		return posted{}, false, os.ErrDeadlineExceeded
+	case <-b.gone:
+		return posted{}, false, io.EOF
+	case <-b.done:
+		return posted{}, false, io.EOF
+	}
+}
+
+// SetReadDeadline sets the deadline of read.
+func (b *inbox) SetReadDeadline(deadline time.Time) error {
+	b.deadlineMu.Lock()
+	b.deadline = deadline
+	b.deadlineMu.Unlock()
+	select {
+	case b.deadlineSet <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// close refuses further messages and ends reading once the queue is empty.
+func (b *inbox) close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// pipeQueue is how many messages one end of a Pipe holds before the other
+// end's writes wait.
+const pipeQueue = 64
+
+// pipeConn is one end of a Pipe.
+type pipeConn struct {
+	in   *inbox
+	peer *pipeConn
+	// closed is shared by both ends and closed by either.
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// Pipe returns the two ends of an in-memory connection: what one end writes,
+// the other reads. Serving one end with ServeConn and speaking the protocol
+// on the other exercises the server without network I/O. The client end
+// reads the server's close as a wsutil.ClosedError with its code and reason,
+// and so does the server end the client's.
+func Pipe() (Conn, Conn) {
+	closed := make(chan struct{})
+	once := new(sync.Once)
+	a := &pipeConn{in: newInbox(pipeQueue), closed: closed, closeOnce: once}
+	b := &pipeConn{in: newInbox(pipeQueue), closed: closed, closeOnce: once, peer: a}
+	a.peer = b
+	a.in.gone, b.in.gone = closed, closed
+	return a, b
+}
+
+// ReadMessage returns the next message written by the other end.
+func (p *pipeConn) ReadMessage() ([]byte, error) {
+	return p.in.read()
+}
+
+// WriteMessage queues data for the other end, waiting while its queue is full.
+func (p *pipeConn) WriteMessage(data []byte) error {
+	return p.peer.in.put(posted{data: data}, p.closed)
+}
+
+// WriteClose makes the other end's next read fail with a wsutil.ClosedError.
+func (p *pipeConn) WriteClose(code ws.StatusCode, reason string) error {
+	return p.peer.in.put(posted{err: wsutil.ClosedError{Code: code, Reason: reason}}, p.closed)
+}
+
+// Ping does nothing: the other end is in the same process.
+func (p *pipeConn) Ping() error {
+	return nil
+}
+
+// SetReadDeadline sets the deadline of ReadMessage.
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	return p.in.SetReadDeadline(t)
+}
+
+// Close closes both ends. Messages already written can still be read.
+func (p *pipeConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
@@ -0,0 +1,168 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// servePipe serves one end of a Pipe with server and returns the other,
+// which is closed and waited for when the test ends.
+func servePipe(t *testing.T, server *Server) Conn {
+	t.Helper()
+	serverEnd, clientEnd := Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ServeConn(httptest.NewRequest("GET", "/v1/speak", nil), serverEnd)
+	}()
+	t.Cleanup(func() {
+		clientEnd.Close()
+		<-done
+	})
+	return clientEnd
+}
+
+// exchange sends msg on conn and returns the reply.
+func exchange(t *testing.T, conn Conn, msg string) []byte {
+	t.Helper()
+	if err := conn.WriteMessage([]byte(msg)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply
+}
+
+// expectPipeClose reads the close that must come next on conn.
+func expectPipeClose(t *testing.T, conn Conn, expected closeReason) {
+	t.Helper()
+	_, err := conn.ReadMessage()
+	var closed wsutil.ClosedError
+	if !errors.As(err, &closed) {
+		t.Fatalf("Expected a close, got %v", err)
+	}
+	if closed.Code != expected.code || closed.Reason != expected.reason {
+		t.Errorf("Expected close %d %s, got %d %s", expected.code, expected.reason, closed.Code, closed.Reason)
+	}
+}
+
+// TestServeConn tests a session served over a Pipe from setup to its end
+func TestServeConn(t *testing.T) {
+	conn := servePipe(t, New())
+
+	var update g.SessionResumptionUpdateJson
+	if err := json.Unmarshal(exchange(t, conn, `{"type": "setup", "model": "gemini-1.5-flash"}`), &update); err != nil {
+		t.Fatalf("Failed to unmarshal resumption update: %v", err)
+	}
+	if update.Type != g.TypeSessionResumptionUpdate || update.Handle == "" {
+		t.Errorf("Expected a resumption update with a handle, got %+v", update)
+	}
+
+	tests := []struct {
+		name     string
+		msg      string
+		expected string
+	}{
+		{name: "Echo", msg: `{"type": "input_text", "text": "hello"}`, expected: `"text":"[echo] hello"`},
+		{name: "Unknown type", msg: `{"type": "bogus"}`, expected: `"code":"unknown_type"`},
+		{name: "Invalid JSON", msg: `{"type": `, expected: `"code":"bad_json"`},
+		{name: "Already set up", msg: `{"type": "setup", "model": "gemini-1.5-flash"}`,
+			expected: `"code":"already_setup"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reply := exchange(t, conn, tt.msg); !strings.Contains(string(reply), tt.expected) {
+				t.Errorf("Expected a reply containing %s, got %s", tt.expected, reply)
+			}
+		})
+	}
+
+	exchange(t, conn, `{"type": "end_session", "reason": "user_requested"}`)
+	expectPipeClose(t, conn, closeSessionEnded)
+	if _, err := conn.ReadMessage(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection to be closed after the close, got %v", err)
+	}
+}
+
+// TestServeConnSessionDuration tests that the maximum session duration ends a session served over a Pipe
+func TestServeConnSessionDuration(t *testing.T) {
+	server := New(WithLimits(LimitsConfig{Default: Limits{MaxSessionDuration: Duration(50 * time.Millisecond)}}))
+	conn := servePipe(t, server)
+	exchange(t, conn, `{"type": "setup", "model": "gemini-1.5-flash"}`)
+
+	reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read error: %v", err)
+	}
+	var errorResp g.ErrorJson
+	if err := json.Unmarshal(reply, &errorResp); err != nil || errorResp.Code != "rate_limited" {
+		t.Errorf("Expected rate_limited error, got %s", reply)
+	}
+	expectPipeClose(t, conn, closeRateLimited)
+}
+
+// TestSessionDurationAcrossResumes tests that resuming a session does not restart its maximum duration
+func TestSessionDurationAcrossResumes(t *testing.T) {
+	server := New(WithLimits(LimitsConfig{Default: Limits{MaxSessionDuration: Duration(100 * time.Millisecond)}}))
+	first := servePipe(t, server)
+	var update g.SessionResumptionUpdateJson
+	if err := json.Unmarshal(exchange(t, first, `{"type": "setup", "model": "gemini-1.5-flash"}`), &update); err != nil {
+		t.Fatalf("Failed to unmarshal resumption update: %v", err)
+	}
+	first.Close()
+	time.Sleep(150 * time.Millisecond)
+
+	second := servePipe(t, server)
+	reply := exchange(t, second,
+		`{"type": "setup", "model": "gemini-1.5-flash", "resumptionHandle": "`+update.Handle+`"}`)
+	var errorResp g.ErrorJson
+	if err := json.Unmarshal(reply, &errorResp); err != nil || errorResp.Code != "rate_limited" {
+		t.Errorf("Expected rate_limited error, got %s", reply)
+	}
+	expectPipeClose(t, second, closeRateLimited)
+}
+
+// TestPipe tests that the ends of a Pipe see each other's messages, closes and their own deadlines
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+
+	if err := a.WriteMessage([]byte("ping")); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if err := a.WriteClose(ws.StatusNormalClosure, "done"); err != nil {
+		t.Fatalf("Failed to write close: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Failed to close pipe: %v", err)
+	}
+	if msg, err := b.ReadMessage(); err != nil || string(msg) != "ping" {
+		t.Errorf("Expected the message written before the close, got %q, %v", msg, err)
+	}
+	expectPipeClose(t, b, closeReason{ws.StatusNormalClosure, "done"})
+	if _, err := b.ReadMessage(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF once the pipe is closed, got %v", err)
+	}
+
+	c, _ := Pipe()
+	defer c.Close()
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	if _, err := c.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the read deadline to pass, got %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+package srv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// clockSkew is the leeway applied to exp and nbf checks.
+const clockSkew = 30 * time.Second
+
+var b64 = base64.RawURLEncoding
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims holds the registered JWT claims checked by the token authenticators.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+func (c *Claims) validate(now time.Time, issuer, aud string) error {
+	if c.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	if c.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-clockSkew).Unix() >= c.ExpiresAt {
+		return errors.New("token expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Unix() < c.NotBefore {
+		return errors.New("token not yet valid")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if aud != "" && !c.Audience.contains(aud) {
+		return fmt.Errorf("token not issued for audience %q", aud)
+	}
+	return nil
+}
+
+// audience accepts both the string and array forms of the aud claim.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(v string) bool {
+	for _, s := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWS splits a compact JWS, checks its signature with verify and
+// decodes its payload into claims.
+func parseJWS(token string, verify func(h jwsHeader, input, sig []byte) error, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("%w: malformed token header", ErrUnauthenticated)
+	}
+	var h jwsHeader
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return fmt.Errorf("%w: malformed token header", ErrUnauthenticated)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: malformed token signature", ErrUnauthenticated)
+	}
+	if err := verify(h, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return err
+	}
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token payload: %w", err)
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return fmt.Errorf("malformed token claims: %w", err)
+	}
+	return nil
+}
+
+// HMACTokens authenticates HS256-signed bearer tokens issued with a shared secret.
+type HMACTokens struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// NewHMACTokens creates an HMAC token authenticator and signer.
+func NewHMACTokens(secret []byte) *HMACTokens {
+	return &HMACTokens{secret: secret, now: time.Now}
+}
+
+// Sign returns a compact HS256 JWS with claims as its payload.
+func (h *HMACTokens) Sign(claims any) (string, error) {
+	header, err := json.Marshal(jwsHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(input))
+	return input + "." + b64.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verify checks the signature of token and decodes its payload into claims.
+func (h *HMACTokens) Verify(token string, claims any) error {
+	return parseJWS(token, func(hdr jwsHeader, input, sig []byte) error {
+		if hdr.Alg != "HS256" {
+			return fmt.Errorf("%w: unsupported algorithm %q", ErrUnauthenticated, hdr.Alg)
+		}
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(input)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return fmt.Errorf("%w: invalid token signature", ErrUnauthenticated)
+		}
+		return nil
+	}, claims)
+}
+
+// Authenticate implements Authenticator.
+func (h *HMACTokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := credential(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	var claims Claims
+	if err := h.Verify(token, &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.validate(h.now(), "", ""); err != nil {
+		return nil, err
+	}
+	return &Principal{ID: claims.Subject, Method: MethodHMAC}, nil
+}
+
+// JWK is a single JSON Web Key. Only RSA and EC public keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func (k JWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid modulus: %w", k.Kid, err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid exponent: %w", k.Kid, err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid x coordinate: %w", k.Kid, err)
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid y coordinate: %w", k.Kid, err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("key %q: unsupported key type %q", k.Kid, k.Kty)
+	}
+}
+
+// JWKS is a set of public keys used to verify JWT signatures.
+type JWKS struct {
+	keys map[string]crypto.PublicKey
+}
+
+// ParseJWKS parses a JSON Web Key Set document.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var doc struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+	set := &JWKS{keys: make(map[string]crypto.PublicKey, len(doc.Keys))}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		set.keys[k.Kid] = pub
+	}
+	if len(set.keys) == 0 {
+		return nil, errors.New("JWKS contains no signing keys")
+	}
+	return set, nil
+}
+
+// LoadJWKS reads a JSON Web Key Set from a local file.
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read JWKS: %w", err)
+	}
+	return ParseJWKS(data)
+}
+
+func (s *JWKS) verify(h jwsHeader, input, sig []byte) error {
+	pub, ok := s.keys[h.Kid]
+	if !ok {
+		return fmt.Errorf("%w: unknown signing key %q", ErrUnauthenticated, h.Kid)
+	}
+
+	var hashFunc crypto.Hash
+	var newHash func() hash.Hash
+	switch h.Alg {
+	case "RS256", "ES256":
+		hashFunc, newHash = crypto.SHA256, sha256.New
+	case "RS384", "ES384":
+		hashFunc, newHash = crypto.SHA384, sha512.New384
+	case "RS512", "ES512":
+		hashFunc, newHash = crypto.SHA512, sha512.New
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrUnauthenticated, h.Alg)
+	}
+	digest := newHash()
+	digest.Write(input)
+	sum := digest.Sum(nil)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if h.Alg[0] != 'R' {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(key, hashFunc, sum, sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if h.Alg[0] != 'E' || len(sig) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, sum, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q does not match key %q", h.Alg, h.Kid)
+}
+
+// JWTVerifier authenticates JWTs signed by a key from a local JWKS.
+type JWTVerifier struct {
+	keys     *JWKS
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// NewJWTVerifier creates a JWT authenticator. Empty issuer or audience
+// disables the corresponding claim check.
+func NewJWTVerifier(keys *JWKS, issuer, audience string) *JWTVerifier {
+	return &JWTVerifier{keys: keys, issuer: issuer, audience: audience, now: time.Now}
+}
+
+// Authenticate implements Authenticator.
+func (v *JWTVerifier) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := credential(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	var claims Claims
+	if err := parseJWS(token, v.keys.verify, &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.validate(v.now(), v.issuer, v.audience); err != nil {
+		return nil, err
+	}
+	return &Principal{ID: claims.Subject, Method: MethodJWT}, nil
+}
@@ -0,0 +1,142 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// DefaultKeepalive is applied unless overridden with WithKeepalive.
+var DefaultKeepalive = KeepaliveConfig{
+	PingInterval: Duration(30 * time.Second),
+	PongTimeout:  Duration(15 * time.Second),
+	WriteTimeout: Duration(10 * time.Second),
+}
+
+// KeepaliveConfig configures the detection of dead /v1/speak connections.
+// Without it a half-open TCP connection, whose client vanished without a
+// FIN, goes unnoticed until the kernel gives up on it, which can take hours,
+// and holds its session and quota all that time.
+type KeepaliveConfig struct {
+	// PingInterval is how often the server pings each connection. Zero
+	// disables pings and leaves idle connections open indefinitely.
+	PingInterval Duration `json:"pingInterval" yaml:"pingInterval"`
+	// PongTimeout is how long the client has to answer a ping. Any frame
+	// counts as an answer, not only the pong.
+	PongTimeout Duration `json:"pongTimeout" yaml:"pongTimeout"`
+	// WriteTimeout bounds every write, so that a client that stopped
+	// reading cannot stall its connection's writers. Zero disables it.
+	WriteTimeout Duration `json:"writeTimeout" yaml:"writeTimeout"`
+}
+
+// Validate checks that the durations are usable.
+func (c KeepaliveConfig) Validate() error {
+	if c.PingInterval < 0 || c.PongTimeout < 0 || c.WriteTimeout < 0 {
+		return errors.New("keepalive durations must not be negative")
+	}
+	if c.PingInterval > 0 && c.PongTimeout == 0 {
+		return errors.New("keepalive.pongTimeout is required with keepalive.pingInterval")
+	}
+	return nil
+}
+
+// WithKeepalive overrides DefaultKeepalive.
+func WithKeepalive(c KeepaliveConfig) Option {
+	return func(s *Server) {
+		s.keepalive = c
+	}
+}
+
+// Write writes p to the connection within the write timeout. Every frame
+// goes through here, including those of the control frame handler.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// Ping sends a ping frame.
+func (c *wsConn) Ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return ws.WriteFrame(c, ws.NewPingFrame(nil))
+}
+
+// ping pings the client of conn every PingInterval until ctx is done. A
+// ping that cannot be written is not acted on here: the client did not
+// answer it either, so the read deadline closes the connection.
+func (s *Server) ping(ctx context.Context, conn *clientConn) {
+	ticker := time.NewTicker(time.Duration(s.keepalive.PingInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := conn.transport.Ping(); err != nil {
+			conn.logger().Debug("Failed to send ping", "error", err)
+			return
+		}
+	}
+}
+
+// extendDeadline gives the client PingInterval plus PongTimeout to send its
+// next frame, time enough to answer the next ping, or until the deadline set
+// with SetReadDeadline if that is sooner.
+func (c *wsConn) extendDeadline() error {
+	if c.alive == 0 {
+		return nil
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.aliveUntil = time.Now().Add(c.alive)
+	return c.Conn.SetReadDeadline(c.readDeadline())
+}
+
+// SetReadDeadline sets the deadline of ReadMessage, which the keepalive
+// never extends.
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(c.readDeadline())
+}
+
+// readDeadline is the sooner of the deadline and aliveUntil, zero if
+// neither is set. It is called with deadlineMu held.
+func (c *wsConn) readDeadline() time.Time {
+	if c.deadline.IsZero() || (!c.aliveUntil.IsZero() && c.aliveUntil.Before(c.deadline)) {
+		return c.aliveUntil
+	}
+	return c.deadline
+}
+
+// endSession makes reads on c fail once the maximum session duration is
+// used up at end.
+func (c *clientConn) endSession(end time.Time) {
+	c.sessionEnd = end
+	if err := c.transport.SetReadDeadline(end); err != nil {
+		c.logger().Warn("Failed to set session deadline", "error", err)
+	}
+}
+
+// sessionOver reports whether conn has used up its maximum session duration.
+func (c *clientConn) sessionOver() bool {
+	return !c.sessionEnd.IsZero() && !time.Now().Before(c.sessionEnd)
+}
+
+// unresponsive closes conn after its client failed to answer a ping in
+// time. The session is left detached rather than ended, as the client is
+// most likely on a network that dropped it and will resume.
+func (s *Server) unresponsive(conn *clientConn) {
+	s.metrics.keepaliveTimeouts.Inc()
+	conn.logger().Warn("Closing connection: client unresponsive",
+		"ping_interval", time.Duration(s.keepalive.PingInterval), "pong_timeout", time.Duration(s.keepalive.PongTimeout))
+	s.closeWith(conn, closeKeepaliveTimeout)
+}
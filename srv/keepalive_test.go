@@ -0,0 +1,157 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// fastKeepalive pings often enough for tests to see several pings.
+var fastKeepalive = KeepaliveConfig{
+	PingInterval: Duration(20 * time.Millisecond),
+	PongTimeout:  Duration(50 * time.Millisecond),
+	WriteTimeout: Duration(time.Second),
+}
+
+// TestKeepalivePings tests that clients answering pings stay connected while idle and that pings can be disabled
+func TestKeepalivePings(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepalive KeepaliveConfig
+		pings     bool
+	}{
+		{name: "Enabled", keepalive: fastKeepalive, pings: true},
+		{name: "Disabled", keepalive: KeepaliveConfig{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(New(WithKeepalive(tt.keepalive)).Handler())
+			defer httpServer.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+			setupSession(t, conn)
+
+			// Stay idle for several ping intervals, answering pings.
+			pings := 0
+			handler := wsutil.ControlFrameHandler(conn, ws.StateClientSide)
+			if err := conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond)); err != nil {
+				t.Fatalf("Failed to set read deadline: %v", err)
+			}
+			for {
+				hdr, err := ws.ReadHeader(conn)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to read frame: %v", err)
+				}
+				if hdr.OpCode != ws.OpPing {
+					t.Fatalf("Expected only pings while idle, got %v", hdr.OpCode)
+				}
+				pings++
+				if err := handler(hdr, io.LimitReader(conn, hdr.Length)); err != nil {
+					t.Fatalf("Failed to answer ping: %v", err)
+				}
+			}
+			if (pings > 0) != tt.pings {
+				t.Errorf("Expected pings to be %v, got %d", tt.pings, pings)
+			}
+			if err := conn.SetReadDeadline(time.Time{}); err != nil {
+				t.Fatalf("Failed to clear read deadline: %v", err)
+			}
+
+			if err := wsutil.WriteClientText(conn, []byte(`{"type": "input_text", "text": "still there?"}`)); err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+			msg, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			var output g.ServerOutputTextJson
+			if err := json.Unmarshal(msg, &output); err != nil || output.Text != "[echo] still there?" {
+				t.Errorf("Expected the echo after idling, got %s", msg)
+			}
+		})
+	}
+}
+
+// TestUnresponsiveClient tests that a client that stops answering pings is closed and its session stays resumable
+func TestUnresponsiveClient(t *testing.T) {
+	httpServer := httptest.NewServer(New(WithKeepalive(fastKeepalive)).Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	dial := func() net.Conn {
+		conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		return conn
+	}
+
+	silent := dial()
+	defer silent.Close()
+	update, _ := sendSetup(t, silent, "")
+
+	// Read frames without answering any of them, as a client whose network
+	// dropped would.
+	start := time.Now()
+	if err := silent.SetReadDeadline(start.Add(2 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	for {
+		frame, err := ws.ReadFrame(silent)
+		if err != nil {
+			t.Fatalf("Expected a close frame, got %v", err)
+		}
+		if frame.Header.OpCode == ws.OpClose {
+			code, reason := ws.ParseCloseFrameData(frame.Payload)
+			if c := closeKeepaliveTimeout; code != c.code || reason != c.reason {
+				t.Errorf("Expected close %d %s, got %d %s", c.code, c.reason, code, reason)
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Duration(fastKeepalive.PongTimeout) {
+		t.Errorf("Expected the server to wait for the pong timeout, closed after %s", elapsed)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn := dial()
+		resumed, errorResp := sendSetup(t, conn, update.Handle)
+		conn.Close()
+		if errorResp.Code == "" {
+			if resumed.Handle != update.Handle {
+				t.Errorf("Expected handle %s, got %s", update.Handle, resumed.Handle)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the session to be resumable after the keepalive timeout, got %q", errorResp.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if body := scrape(t, httpServer.URL); !strings.Contains(body, "twinspeak_ws_keepalive_timeouts_total 1") {
+		t.Errorf("Expected one keepalive timeout in metrics")
+	}
+}
@@ -0,0 +1,255 @@
+package srv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// Audio byte rates used to estimate the duration of an input_audio chunk.
+// Clients do not declare a sample rate, so PCM is assumed to be 16 kHz mono
+// 16-bit and Opus a typical 32 kbit/s voice stream.
+const (
+	pcmBytesPerSecond  = 16000 * 2
+	opusBytesPerSecond = 32000 / 8
+	wavHeaderSize      = 44
+)
+
+// Duration is a time.Duration that reads and writes strings such as "90s".
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Limits bounds the resources a single principal may use. Zero disables a limit.
+type Limits struct {
+	MaxSessions           int      `json:"maxSessions,omitempty" yaml:"maxSessions,omitempty"`
+	MessagesPerSecond     float64  `json:"messagesPerSecond,omitempty" yaml:"messagesPerSecond,omitempty"`
+	MessageBurst          int      `json:"messageBurst,omitempty" yaml:"messageBurst,omitempty"`
+	AudioSecondsPerMinute float64  `json:"audioSecondsPerMinute,omitempty" yaml:"audioSecondsPerMinute,omitempty"`
+	MaxSessionDuration    Duration `json:"maxSessionDuration,omitempty" yaml:"maxSessionDuration,omitempty"`
+}
+
+// LimitsConfig assigns limits to principals. Principals without an entry,
+// and anonymous clients keyed by remote IP, get Default.
+type LimitsConfig struct {
+	Principals map[string]Limits `json:"principals,omitempty" yaml:"principals,omitempty"`
+	Default    Limits            `json:"default" yaml:"default"`
+}
+
+// For returns the limits that apply to principal id.
+func (c LimitsConfig) For(id string) Limits {
+	if l, ok := c.Principals[id]; ok {
+		return l
+	}
+	return c.Default
+}
+
+// LoadLimits reads a JSON limits configuration file.
+func LoadLimits(path string) (LimitsConfig, error) {
+	var cfg LimitsConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read limits: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse limits %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// bucket is a token bucket refilled continuously at rate tokens per second.
+type bucket struct {
+	last     time.Time
+	tokens   float64
+	capacity float64
+	rate     float64
+}
+
+func newBucket(capacity, rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{tokens: capacity, capacity: capacity, rate: rate, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *bucket) take(n float64, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *bucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// quota tracks the usage of one rate limiting key across its connections.
+type quota struct {
+	messages  *bucket
+	audio     *bucket
+	principal string
+	limits    Limits
+	active    int
+}
+
+func (q *quota) configure(limits Limits, now time.Time) {
+	burst := float64(max(limits.MessageBurst, 1))
+	q.limits = limits
+	q.messages = newBucket(max(burst, limits.MessagesPerSecond), limits.MessagesPerSecond, now)
+	q.audio = newBucket(limits.AudioSecondsPerMinute, limits.AudioSecondsPerMinute/60, now)
+}
+
+// limiter enforces LimitsConfig per principal or remote IP.
+type limiter struct {
+	quotas map[string]*quota
+	now    func() time.Time
+	config LimitsConfig
+	mu     sync.Mutex
+}
+
+func newLimiter(cfg LimitsConfig) *limiter {
+	return &limiter{config: cfg, quotas: make(map[string]*quota), now: time.Now}
+}
+
+// setConfig replaces the configuration. Quotas whose limits changed start
+// over with full buckets; open sessions keep counting against MaxSessions.
+func (l *limiter) setConfig(cfg LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = cfg
+	now := l.now()
+	for _, q := range l.quotas {
+		if limits := cfg.For(q.principal); limits != q.limits {
+			q.configure(limits, now)
+		}
+	}
+}
+
+// limitKey identifies the caller of r for rate limiting, by the same
+// identity that owns its sessions, and returns the principal ID its limits
+// are configured under.
+func limitKey(r *http.Request) (key, principal string) {
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		return "principal:" + p.Identity(), p.ID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, ""
+}
+
+// acquire reserves a session slot for key and returns the quota with the
+// limits in effect, or false if the key already has MaxSessions open.
+func (l *limiter) acquire(key, principal string) (*quota, Limits, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for k, q := range l.quotas {
+		if q.active == 0 && q.messages.full(now) && q.audio.full(now) {
+			delete(l.quotas, k)
+		}
+	}
+
+	q, ok := l.quotas[key]
+	if !ok {
+		q = &quota{principal: principal}
+		q.configure(l.config.For(principal), now)
+		l.quotas[key] = q
+	}
+	if q.limits.MaxSessions > 0 && q.active >= q.limits.MaxSessions {
+		return nil, q.limits, false
+	}
+	q.active++
+	return q, q.limits, true
+}
+
+func (l *limiter) release(q *quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q.active--
+}
+
+// allowMessage consumes one message from the quota.
+func (l *limiter) allowMessage(q *quota) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return q.messages.take(1, l.now())
+}
+
+// allowAudio consumes seconds of audio from the quota.
+func (l *limiter) allowAudio(q *quota, seconds float64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if q.audio == nil {
+		return true
+	}
+	if seconds > q.audio.capacity {
+		return false
+	}
+	return q.audio.take(seconds, l.now())
+}
+
+// startsWAV reports whether the base64 audio chunk starts with a RIFF/WAVE
+// header.
+func startsWAV(chunk string) bool {
+	// 16 base64 characters decode to the 12 bytes RIFF, size and WAVE.
+	if len(chunk) < 16 {
+		return false
+	}
+	magic, err := base64.StdEncoding.DecodeString(chunk[:16])
+	return err == nil && string(magic[:4]) == "RIFF" && string(magic[8:12]) == "WAVE"
+}
+
+// audioSeconds estimates the playback duration of a base64 audio chunk.
+func audioSeconds(format g.ClientInputAudioJsonFormat, chunk string) float64 {
+	size := base64.StdEncoding.DecodedLen(len(chunk)) - strings.Count(chunk, "=")
+	switch format {
+	case g.ClientInputAudioJsonFormatOpus:
+		return float64(size) / opusBytesPerSecond
+	case g.ClientInputAudioJsonFormatWav:
+		if startsWAV(chunk) {
+			// Only the first chunk of a stream carries the header.
+			size = max(size-wavHeaderSize, 0)
+		}
+		return float64(size) / pcmBytesPerSecond
+	default:
+		return float64(size) / pcmBytesPerSecond
+	}
+}
@@ -0,0 +1,298 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// expectRateLimited reads a rate_limited error followed by a policy violation close frame
+func expectRateLimited(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	msg, _, err := wsutil.ReadServerData(conn)
+	if err != nil {
+		t.Fatalf("Failed to read error response: %v", err)
+	}
+	var errorResp g.ErrorJson
+	if err := json.Unmarshal(msg, &errorResp); err != nil {
+		t.Fatalf("Failed to unmarshal error response: %v", err)
+	}
+	if errorResp.Code != "rate_limited" {
+		t.Errorf("Expected rate_limited error code, got %s", errorResp.Code)
+	}
+
+	_, _, err = wsutil.ReadServerData(conn)
+	var closed wsutil.ClosedError
+	if !errors.As(err, &closed) {
+		t.Fatalf("Expected close frame, got %v", err)
+	}
+	if closed.Code != ws.StatusPolicyViolation {
+		t.Errorf("Expected close code %d, got %d", ws.StatusPolicyViolation, closed.Code)
+	}
+}
+
+// bufferedConn reads frames the server sent along with the handshake response first
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// withBuffered wraps conn so that reads drain br before the connection
+func withBuffered(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br == nil {
+		return conn
+	}
+	return bufferedConn{Conn: conn, r: io.MultiReader(br, conn)}
+}
+
+// dialLimited starts a server with the given limits and returns its WebSocket URL
+func dialLimited(t *testing.T, limits Limits) (string, func()) {
+	t.Helper()
+	server := New(WithLimits(LimitsConfig{Default: limits}))
+	httpServer := httptest.NewServer(server.Handler())
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak", httpServer.Close
+}
+
+// TestMaxConcurrentSessions tests that extra connections beyond the limit are rejected
+func TestMaxConcurrentSessions(t *testing.T) {
+	wsURL, closeServer := dialLimited(t, Limits{MaxSessions: 1})
+	defer closeServer()
+
+	first, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	setupSession(t, first)
+
+	second, br, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer second.Close()
+	expectRateLimited(t, withBuffered(second, br))
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		third, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		data, _ := json.Marshal(g.SetupRequestJson{Type: "setup", Model: "gemini-1.5-flash"})
+		_ = wsutil.WriteClientMessage(third, ws.OpText, data)
+		msg, _, err := wsutil.ReadServerData(third)
+		third.Close()
+		if err == nil && strings.Contains(string(msg), "session_resumption_update") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a slot to free up after the first session closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestLimitsPerIdentity tests that principals sharing an ID across methods, and the tokens a principal
+// mints, have limits of their own
+func TestLimitsPerIdentity(t *testing.T) {
+	hmacTokens := NewHMACTokens([]byte("0123456789abcdef0123456789abcdef"))
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"alice-key": "alice", "backend-key": "backend"}), hmacTokens),
+		WithEphemeralTokens(NewEphemeralTokens([]byte("ephemeral-secret-ephemeral-secret"))),
+		WithLimits(LimitsConfig{Default: Limits{MaxSessions: 1}}),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	hmacAlice, err := hmacTokens.Sign(Claims{Subject: "alice", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	_, minted := mintToken(t, httpServer.URL, "backend-key", `{}`)
+
+	tests := []struct {
+		name       string
+		credential string
+		limited    bool
+	}{
+		{name: "API key", credential: "alice-key"},
+		{name: "Same ID by another method", credential: hmacAlice},
+		{name: "Minter", credential: "backend-key"},
+		{name: "Token minted by the minter", credential: minted.Token},
+		{name: "Second session of the API key", credential: "alice-key", limited: true},
+	}
+
+	// Every session stays open until the test ends.
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, br, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+tt.credential)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			conns = append(conns, conn)
+			if tt.limited {
+				expectRateLimited(t, withBuffered(conn, br))
+			} else if _, errorResp := sendSetup(t, conn, ""); errorResp.Code != "" {
+				t.Errorf("Expected a session, got error %q", errorResp.Code)
+			}
+		})
+	}
+}
+
+// TestMessageRateLimit tests that bursts above the message rate close the connection
+func TestMessageRateLimit(t *testing.T) {
+	wsURL, closeServer := dialLimited(t, Limits{MessagesPerSecond: 1, MessageBurst: 2})
+	defer closeServer()
+
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	setupSession(t, conn)
+
+	data, _ := json.Marshal(g.ClientInputTextJson{Type: "input_text", Text: "hello"})
+	if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+		t.Fatalf("Failed to send text input: %v", err)
+	}
+	if _, _, err := wsutil.ReadServerData(conn); err != nil {
+		t.Fatalf("Failed to read text response: %v", err)
+	}
+
+	if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+		t.Fatalf("Failed to send text input: %v", err)
+	}
+	expectRateLimited(t, conn)
+}
+
+// TestAudioQuota tests that audio beyond the per-minute allowance closes the connection
+func TestAudioQuota(t *testing.T) {
+	wsURL, closeServer := dialLimited(t, Limits{AudioSecondsPerMinute: 1})
+	defer closeServer()
+
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	setupSession(t, conn)
+
+	halfSecond := base64.StdEncoding.EncodeToString(make([]byte, pcmBytesPerSecond/2))
+	audio := g.ClientInputAudioJson{Type: "input_audio", Format: g.ClientInputAudioJsonFormatPcm16, Chunk: halfSecond}
+	data, _ := json.Marshal(audio)
+	for i := 0; i < 2; i++ {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+			t.Fatalf("Failed to send audio input: %v", err)
+		}
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			t.Fatalf("Failed to read audio response: %v", err)
+		}
+	}
+
+	if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+		t.Fatalf("Failed to send audio input: %v", err)
+	}
+	expectRateLimited(t, conn)
+}
+
+// TestAudioSeconds tests the duration estimated for audio chunks of each format
+func TestAudioSeconds(t *testing.T) {
+	second := make([]byte, pcmBytesPerSecond)
+	header := make([]byte, wavHeaderSize)
+	copy(header, "RIFF")
+	copy(header[8:], "WAVE")
+	encode := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name     string
+		format   g.ClientInputAudioJsonFormat
+		chunk    string
+		expected float64
+	}{
+		{name: "PCM", format: g.ClientInputAudioJsonFormatPcm16, chunk: encode(second), expected: 1},
+		{name: "Opus", format: g.ClientInputAudioJsonFormatOpus, chunk: encode(make([]byte, opusBytesPerSecond)),
+			expected: 1},
+		{name: "WAV with header", format: g.ClientInputAudioJsonFormatWav, chunk: encode(append(header, second...)),
+			expected: 1},
+		{name: "WAV continuation", format: g.ClientInputAudioJsonFormatWav, chunk: encode(second), expected: 1},
+		{name: "WAV header only", format: g.ClientInputAudioJsonFormatWav, chunk: encode(header), expected: 0},
+		{name: "Short WAV continuation", format: g.ClientInputAudioJsonFormatWav, chunk: encode(make([]byte, 32)),
+			expected: 0.001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := audioSeconds(tt.format, tt.chunk); got != tt.expected {
+				t.Errorf("Expected %v seconds, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestMaxSessionDuration tests that sessions are closed once their duration is used up
+func TestMaxSessionDuration(t *testing.T) {
+	wsURL, closeServer := dialLimited(t, Limits{MaxSessionDuration: Duration(100 * time.Millisecond)})
+	defer closeServer()
+
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	setupSession(t, conn)
+	expectRateLimited(t, conn)
+}
+
+// TestLoadLimits tests per-principal limits from a config file
+func TestLoadLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	config := `{
+		"default": {"maxSessions": 2, "maxSessionDuration": "30m"},
+		"principals": {"batch": {"maxSessions": 10, "audioSecondsPerMinute": 600}}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("Failed to write limits file: %v", err)
+	}
+
+	cfg, err := LoadLimits(path)
+	if err != nil {
+		t.Fatalf("Failed to load limits: %v", err)
+	}
+
+	if got := cfg.For("alice"); got.MaxSessions != 2 || time.Duration(got.MaxSessionDuration) != 30*time.Minute {
+		t.Errorf("Expected default limits for alice, got %+v", got)
+	}
+	if got := cfg.For("batch"); got.MaxSessions != 10 || got.AudioSecondsPerMinute != 600 {
+		t.Errorf("Expected batch limits, got %+v", got)
+	}
+}
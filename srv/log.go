@@ -0,0 +1,146 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// redactedFields are the message fields replaced in logged payloads unless
+// redaction is disabled: audio chunks and tool call arguments and results
+// routinely carry user data.
+var redactedFields = []string{"chunk", "arguments", "result"}
+
+// LogConfig selects how the server logs.
+type LogConfig struct {
+	// Level is one of debug, info, warn or error. Message payloads are
+	// only logged at debug.
+	Level string `json:"level" yaml:"level"`
+	// Format is json or text.
+	Format string `json:"format" yaml:"format"`
+	// Unredacted logs audio chunks and tool arguments verbatim.
+	Unredacted bool `json:"unredacted,omitempty" yaml:"unredacted,omitempty"`
+}
+
+// DefaultLogConfig logs JSON records at info level.
+var DefaultLogConfig = LogConfig{Level: "info", Format: "json"}
+
+// NewLogger returns a logger writing records to w as configured by c.
+func NewLogger(w io.Writer, c LogConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch c.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("log format must be json or text, got %q", c.Format)
+	}
+}
+
+// payload defers encoding a message for the log until a record is actually
+// emitted, so that payloads cost nothing below debug level.
+type payload struct {
+	msg        any
+	unredacted bool
+}
+
+// LogValue implements slog.LogValuer.
+func (p payload) LogValue() slog.Value {
+	data, ok := p.msg.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(p.msg); err != nil {
+			return slog.StringValue(err.Error())
+		}
+	}
+	if p.unredacted {
+		return slog.AnyValue(json.RawMessage(data))
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return slog.StringValue(fmt.Sprintf("[unparsable %d bytes]", len(data)))
+	}
+	for _, name := range redactedFields {
+		if v, ok := fields[name]; ok {
+			fields[name], _ = json.Marshal(fmt.Sprintf("[redacted %d bytes]", len(v)))
+		}
+	}
+	data, _ = json.Marshal(fields)
+	return slog.AnyValue(json.RawMessage(data))
+}
+
+// payload wraps msg for logging with the server's redaction setting.
+func (s *Server) payload(msg any) payload {
+	return payload{msg: msg, unredacted: s.unredacted}
+}
+
+// logger returns the logger annotated with the connection's principal,
+// session and the message being handled.
+func (c *clientConn) logger() *slog.Logger {
+	return c.log.Load()
+}
+
+// annotate points the connection's logger at a message of msgType, which
+// may be empty while the type is not yet known.
+func (c *clientConn) annotate(msgType string) {
+	l := c.base
+	if c.sess != nil {
+		l = l.With("session_id", c.sess.ID, "model", c.sess.Model, "turn_id", c.turnID)
+	}
+	if msgType != "" {
+		l = l.With("type", msgType)
+	}
+	c.log.Store(l)
+}
+
+// loggedPath returns the path of r for logs: its route pattern once it has
+// been routed, else the path with any Server-Sent Events connection ID
+// replaced by {id}. The ID is the connection's only credential and must not
+// end up in logs.
+func loggedPath(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1/sessions/")
+	if !ok {
+		return r.URL.Path
+	}
+	if _, endpoint, found := strings.Cut(rest, "/"); found {
+		return "/v1/sessions/{id}/" + endpoint
+	}
+	return "/v1/sessions/{id}"
+}
+
+// logRequests logs every HTTP request once it has been served. Probes and
+// scrapes are logged at debug so they don't drown out client traffic.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		defer func() {
+			level := slog.LevelInfo
+			if r.URL.Path == "/healthz" || r.URL.Path == "/metrics" {
+				level = slog.LevelDebug
+			}
+			s.logger.Log(r.Context(), level, "Request served",
+				"method", r.Method, "path", loggedPath(r), "status", ww.Status(), "bytes", ww.BytesWritten(),
+				"duration", time.Since(start), "remote", r.RemoteAddr)
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
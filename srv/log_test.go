@@ -0,0 +1,143 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// syncBuffer is a bytes.Buffer that the server and the test may use concurrently
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// converse runs a session with text, audio and a tool result against a server
+// logging at debug level and returns the JSON records it logged
+func converse(t *testing.T, opts ...Option) (string, []map[string]any) {
+	t.Helper()
+	var out syncBuffer
+	logger, err := NewLogger(&out, LogConfig{Level: "debug", Format: "json"})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	server := New(append(opts, WithLogger(logger))...)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	setupSession(t, conn)
+
+	toolResult, _ := json.Marshal(g.ToolResultJson{
+		Type: "tool_result", Name: "lookup", CallId: "call_1", Result: map[string]any{"secret": "tool-secret"},
+	})
+	messages := [][]byte{
+		[]byte(`{"type": "input_text", "text": "hello"}`),
+		[]byte(`{"type": "input_audio", "format": "pcm16", "chunk": "QVVESU9TRUNSRVQ=", "final": true}`),
+		toolResult,
+		[]byte(`{"type": "end_session", "reason": "done"}`),
+	}
+	for _, msg := range messages {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, msg); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	for range 3 {
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+	if _, _, err := wsutil.ReadServerData(conn); err == nil {
+		t.Fatal("Expected the server to close the connection after end_session")
+	}
+	httpServer.Close()
+
+	var records []map[string]any
+	for line := range strings.Lines(out.String()) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to parse log record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return out.String(), records
+}
+
+// TestSessionLogging tests that records of a conversation carry its correlation fields
+func TestSessionLogging(t *testing.T) {
+	_, records := converse(t)
+
+	turns := make(map[string]float64)
+	for _, r := range records {
+		if r["msg"] != "Received message" {
+			continue
+		}
+		typ, _ := r["type"].(string)
+		if typ != "setup" && (r["session_id"] == nil || r["model"] != "gemini-1.5-flash" || r["turn_id"] == nil) {
+			t.Errorf("Expected session fields on %v", r)
+		}
+		if r["principal"] != "anonymous" {
+			t.Errorf("Expected the principal on %v", r)
+		}
+		turns[typ], _ = r["turn_id"].(float64)
+	}
+	if turns["input_text"] != 1 || turns["input_audio"] != 2 || turns["end_session"] != 3 {
+		t.Errorf("Expected each final input to start a new turn, got %v", turns)
+	}
+
+	var ended bool
+	for _, r := range records {
+		ended = ended || r["msg"] == "Session ended" && r["session_id"] != nil && r["type"] == "end_session"
+	}
+	if !ended {
+		t.Error("Expected the end of the session to be logged with its session ID")
+	}
+}
+
+// TestPayloadRedaction tests that audio chunks and tool data are only logged when redaction is off
+func TestPayloadRedaction(t *testing.T) {
+	secrets := []string{"QVVESU9TRUNSRVQ=", "tool-secret"}
+
+	out, _ := converse(t)
+	for _, secret := range secrets {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %q to be redacted", secret)
+		}
+	}
+	if !strings.Contains(out, "[redacted") {
+		t.Error("Expected redaction markers in the log")
+	}
+
+	out, _ = converse(t, WithUnredactedPayloads())
+	for _, secret := range secrets {
+		if !strings.Contains(out, secret) {
+			t.Errorf("Expected %q to be logged without redaction", secret)
+		}
+	}
+}
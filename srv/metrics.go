@@ -0,0 +1,247 @@
+package srv
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/session"
+)
+
+const metricsNamespace = "twinspeak"
+
+// metrics holds the Prometheus instruments of a Server. Each server has its
+// own registry so that several can run in one process.
+type metrics struct {
+	registry          *prometheus.Registry
+	sessionsCreated   prometheus.Counter
+	sessionsResumed   prometheus.Counter
+	sessionsEnded     prometheus.Counter
+	sessionsReaped    prometheus.Counter
+	messagesIn        *prometheus.CounterVec
+	messagesOut       *prometheus.CounterVec
+	errors            *prometheus.CounterVec
+	audioSeconds      *prometheus.CounterVec
+	turnLatency       prometheus.Histogram
+	toolCallLatency   prometheus.Histogram
+	writeQueueDepth   prometheus.Gauge
+	compressedConns   prometheus.Counter
+	rawBytes          *prometheus.CounterVec
+	deflatedBytes     *prometheus.CounterVec
+	deflateRatio      *prometheus.HistogramVec
+	keepaliveTimeouts prometheus.Counter
+	closes            *prometheus.CounterVec
+}
+
+// Directions of WebSocket traffic, as metric labels.
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// Sides of a WebSocket connection that may start the closing handshake, as
+// metric labels.
+const (
+	initiatorServer = "server"
+	initiatorClient = "client"
+)
+
+func newMetrics(store *session.Store) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		sessionsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "sessions_created_total",
+			Help: "Sessions set up on /v1/speak.",
+		}),
+		sessionsResumed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "sessions_resumed_total",
+			Help: "Sessions resumed with a resumption handle.",
+		}),
+		sessionsEnded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "sessions_ended_total",
+			Help: "Sessions ended by the client with end_session.",
+		}),
+		sessionsReaped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "sessions_reaped_total",
+			Help: "Detached sessions removed after their resumption window expired.",
+		}),
+		messagesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "messages_received_total",
+			Help: "Client messages received, by type.",
+		}, []string{"type"}),
+		messagesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "messages_sent_total",
+			Help: "Server messages sent, by type.",
+		}, []string{"type"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "errors_total",
+			Help: "Error messages sent to clients, by code.",
+		}, []string{"code"}),
+		audioSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "audio_seconds_total",
+			Help: "Estimated seconds of input audio processed, by format.",
+		}, []string{"format"}),
+		turnLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "turn_latency_seconds",
+			Help:    "Time from the final input of a turn to the first output.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		toolCallLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "tool_call_latency_seconds",
+			Help:    "Time from sending a function_call to receiving its tool_result.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		writeQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "ws_write_queue_depth",
+			Help: "WebSocket messages waiting to be written, across connections.",
+		}),
+		compressedConns: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "ws_compressed_connections_total",
+			Help: "Connections that negotiated permessage-deflate.",
+		}),
+		rawBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "ws_uncompressed_bytes_total",
+			Help: "Size of compressed messages before compression, by direction.",
+		}, []string{"direction"}),
+		deflatedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "ws_compressed_bytes_total",
+			Help: "Size of compressed messages on the wire, by direction.",
+		}, []string{"direction"}),
+		keepaliveTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "ws_keepalive_timeouts_total",
+			Help: "Connections closed because the client did not answer a ping in time.",
+		}),
+		closes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "ws_closes_total",
+			Help: "WebSocket close frames, by the side that sent the first one and its status code.",
+		}, []string{"initiator", "code"}),
+		deflateRatio: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "ws_compression_ratio",
+			Help: "Compressed size of a message as a fraction of its uncompressed size, by direction.",
+			// Small messages can grow a little.
+			Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.7, 1, 1.5},
+		}, []string{"direction"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.sessionsCreated, m.sessionsResumed, m.sessionsEnded, m.sessionsReaped,
+		m.messagesIn, m.messagesOut, m.errors, m.audioSeconds,
+		m.turnLatency, m.toolCallLatency, m.writeQueueDepth,
+		m.compressedConns, m.rawBytes, m.deflatedBytes, m.deflateRatio, m.keepaliveTimeouts,
+		m.closes,
+		sessionCollector{store: store},
+	)
+	return m
+}
+
+// handler serves the registry in the Prometheus exposition format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+var sessionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "sessions"),
+	"Sessions in the store, by state and model.",
+	[]string{"state", "model"}, nil,
+)
+
+// sessionCollector reports the sessions in the store at scrape time.
+type sessionCollector struct {
+	store *session.Store
+}
+
+// Describe implements prometheus.Collector.
+func (c sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	type key struct{ state, model string }
+	counts := make(map[key]int)
+	for _, sess := range c.store.List() {
+		r := sess.Record()
+		counts[key{r.State.String(), r.Model}]++
+	}
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(n), k.state, k.model)
+	}
+}
+
+// observeCompression records a message of raw bytes sent or received in
+// compressed bytes.
+func (m *metrics) observeCompression(direction string, raw, compressed int) {
+	m.rawBytes.WithLabelValues(direction).Add(float64(raw))
+	m.deflatedBytes.WithLabelValues(direction).Add(float64(compressed))
+	if raw > 0 {
+		m.deflateRatio.WithLabelValues(direction).Observe(float64(compressed) / float64(raw))
+	}
+}
+
+// inboundType bounds the type label of received messages to the known types.
+func inboundType(t string) string {
+	if slices.Contains(g.ClientTypes, t) {
+		return t
+	}
+	return "unknown"
+}
+
+// messageType returns the type field of a generated message struct.
+func messageType(v any) string {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return "unknown"
+	}
+	if f := rv.FieldByName("Type"); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	return "unknown"
+}
+
+// observeOutput records an outbound message of type msgType on conn, closing
+// the open turn on its first output and starting tool call timers. It is
+// called with conn.writeMu held.
+func (m *metrics) observeOutput(conn *clientConn, msgType string, v any) {
+	m.messagesOut.WithLabelValues(msgType).Inc()
+	switch msgType {
+	case g.TypeServerOutputText, g.TypeServerOutputAudio, g.TypeFunctionCall:
+		if !conn.turnStart.IsZero() {
+			m.turnLatency.Observe(time.Since(conn.turnStart).Seconds())
+			conn.turnStart = time.Time{}
+		}
+	}
+	if call, ok := v.(g.FunctionCallJson); ok {
+		if conn.pendingCalls == nil {
+			conn.pendingCalls = make(map[string]time.Time)
+		}
+		conn.pendingCalls[call.CallId] = time.Now()
+	}
+}
+
+// startTurn marks the final input of a turn on conn.
+func (m *metrics) startTurn(conn *clientConn) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	conn.turnStart = time.Now()
+}
+
+// finishToolCall records the round trip of the function call answered by
+// callID and returns when the call was sent.
+func (m *metrics) finishToolCall(conn *clientConn, callID string) (time.Time, bool) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	sent, ok := conn.pendingCalls[callID]
+	if ok {
+		m.toolCallLatency.Observe(time.Since(sent).Seconds())
+		delete(conn.pendingCalls, callID)
+	}
+	return sent, ok
+}
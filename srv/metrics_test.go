@@ -0,0 +1,113 @@
+package srv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// scrape fetches the metrics exposition of the server at baseURL
+func scrape(t *testing.T, baseURL string) string {
+	t.Helper()
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+// TestMetrics tests that session and message activity shows up on /metrics
+func TestMetrics(t *testing.T) {
+	server := New()
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	setupSession(t, conn)
+
+	audio, _ := json.Marshal(g.ClientInputAudioJson{
+		Type:   "input_audio",
+		Format: g.ClientInputAudioJsonFormatPcm16,
+		Chunk:  base64.StdEncoding.EncodeToString(make([]byte, pcmBytesPerSecond)),
+		Final:  true,
+	})
+	messages := [][]byte{
+		[]byte(`{"type": "input_text", "text": "hello"}`),
+		audio,
+		[]byte(`{"type": "no_such_type"}`),
+	}
+	for _, msg := range messages {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, msg); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+
+	body := scrape(t, httpServer.URL)
+	for _, want := range []string{
+		`twinspeak_sessions{model="gemini-1.5-flash",state="Active"} 1`,
+		`twinspeak_sessions_created_total 1`,
+		`twinspeak_messages_received_total{type="input_text"} 1`,
+		`twinspeak_messages_received_total{type="unknown"} 1`,
+		`twinspeak_messages_sent_total{type="output_text"} 2`,
+		`twinspeak_messages_sent_total{type="session_resumption_update"} 1`,
+		`twinspeak_errors_total{code="unknown_type"} 1`,
+		`twinspeak_audio_seconds_total{format="pcm16"} 1`,
+		`twinspeak_turn_latency_seconds_count 2`,
+		`twinspeak_ws_write_queue_depth 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+// TestSessionReaping tests that detached sessions are removed after the session TTL
+func TestSessionReaping(t *testing.T) {
+	server := New(WithSessionTTL(50 * time.Millisecond))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	setupSession(t, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.Store.List()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the detached session to be reaped")
+		}
+		time.Sleep(20 * time.Millisecond)
+		scrape(t, httpServer.URL)
+	}
+	if body := scrape(t, httpServer.URL); !strings.Contains(body, "twinspeak_sessions_reaped_total 1") {
+		t.Error("Expected the reaped session to be counted")
+	}
+}
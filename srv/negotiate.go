@@ -0,0 +1,128 @@
+package srv
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/session"
+)
+
+// ProtocolVersion is the highest protocol version the server speaks.
+// Versions with the same major version are compatible: a minor version only
+// adds optional fields, message types and capabilities.
+const ProtocolVersion = "1.1"
+
+// CapabilityStreamingDeltas asks for replies streamed as non-final
+// output_text deltas ending with a final one, rather than one final message.
+const CapabilityStreamingDeltas = "streaming_deltas"
+
+// version is a MAJOR.MINOR protocol version.
+type version struct {
+	major, minor int
+}
+
+// legacyVersion is spoken by clients that do not negotiate: those written
+// before setup had a version or capabilities field.
+var legacyVersion = version{1, 0}
+
+// introduced maps the server message types added after 1.0 to the version
+// that added them. They are not sent on connections negotiated to an
+// earlier version, whose clients would not know what to make of them.
+var introduced = map[string]version{
+	g.TypeSetupComplete: {1, 1},
+}
+
+func parseVersion(s string) (version, error) {
+	major, minor, ok := strings.Cut(s, ".")
+	maj, err1 := strconv.Atoi(major)
+	mnr, err2 := strconv.Atoi(minor)
+	if !ok || err1 != nil || err2 != nil || maj < 0 || mnr < 0 {
+		return version{}, fmt.Errorf("invalid protocol version %q", s)
+	}
+	return version{maj, mnr}, nil
+}
+
+func (v version) less(o version) bool {
+	return v.major < o.major || v.major == o.major && v.minor < o.minor
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// negotiate settles the protocol version and capabilities of conn from a
+// setup request. A client that asks for neither speaks 1.0; one that asks
+// for capabilities without a version speaks the server's version. It fails
+// only for a major version the server does not speak.
+func (s *Server) negotiate(conn *clientConn, req g.SetupRequestJson) error {
+	server, _ := parseVersion(ProtocolVersion)
+	conn.version = legacyVersion
+	if req.Version == nil && req.Capabilities == nil {
+		return nil
+	}
+	conn.version = server
+	if req.Version != nil {
+		client, err := parseVersion(*req.Version)
+		if err != nil {
+			return err
+		}
+		if client.major != server.major {
+			return fmt.Errorf("unsupported protocol version %s, the server speaks %d.x", client, server.major)
+		}
+		if client.less(server) {
+			conn.version = client
+		}
+	}
+	conn.capabilities = nil
+	for _, c := range req.Capabilities {
+		if s.supports(conn, c) {
+			conn.capabilities = append(conn.capabilities, c)
+		}
+	}
+	return nil
+}
+
+// supports reports whether the server can provide capability on conn.
+// Unknown capabilities are not an error so that clients can ask newer
+// servers for features older ones lack.
+func (s *Server) supports(conn *clientConn, capability string) bool {
+	switch capability {
+	case CapabilityStreamingDeltas:
+		return true
+	case CapabilityCompression:
+		c, ok := conn.transport.(*wsConn)
+		return ok && c.deflate != nil
+	}
+	return false
+}
+
+// understands reports whether the client on conn knows messages of msgType.
+func (c *clientConn) understands(msgType string) bool {
+	v, ok := introduced[msgType]
+	return !ok || !c.version.less(v)
+}
+
+// has reports whether capability was negotiated on conn.
+func (c *clientConn) has(capability string) bool {
+	return slices.Contains(c.capabilities, capability)
+}
+
+// completeSetup answers a setup: with setup_complete if the client
+// negotiated a version that has it, then with the resumption handle of sess.
+func (s *Server) completeSetup(conn *clientConn, sess *session.Session) bool {
+	if conn.understands(g.TypeSetupComplete) {
+		caps := conn.capabilities
+		if caps == nil {
+			caps = []string{}
+		}
+		complete := g.SetupCompleteJson{Type: g.TypeSetupComplete, Version: conn.version.String(), Capabilities: caps}
+		if err := s.writeJSON(conn, complete); err != nil {
+			conn.logger().Warn("Failed to send setup complete", "error", err)
+			return true
+		}
+	}
+	return s.sendResumptionUpdate(conn, sess)
+}
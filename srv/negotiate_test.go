@@ -0,0 +1,143 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// TestNegotiation tests the replies to setup for each way a client may or may not negotiate
+func TestNegotiation(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        string
+		expectedType string
+		version      string
+		capabilities []string
+	}{
+		{
+			name:         "Legacy client",
+			setup:        `{"type": "setup", "model": "gemini-1.5-flash"}`,
+			expectedType: g.TypeSessionResumptionUpdate,
+		},
+		{
+			name:         "Explicit 1.0",
+			setup:        `{"type": "setup", "model": "gemini-1.5-flash", "version": "1.0"}`,
+			expectedType: g.TypeSessionResumptionUpdate,
+		},
+		{
+			name:         "Capabilities without version",
+			setup:        `{"type": "setup", "model": "gemini-1.5-flash", "capabilities": []}`,
+			expectedType: g.TypeSetupComplete,
+			version:      ProtocolVersion,
+			capabilities: []string{},
+		},
+		{
+			name: "Newer minor version",
+			setup: `{"type": "setup", "model": "gemini-1.5-flash", "version": "1.9", ` +
+				`"capabilities": ["telepathy", "streaming_deltas"]}`,
+			expectedType: g.TypeSetupComplete,
+			version:      ProtocolVersion,
+			capabilities: []string{CapabilityStreamingDeltas},
+		},
+		{
+			name:         "Unsupported major version",
+			setup:        `{"type": "setup", "model": "gemini-1.5-flash", "version": "2.0"}`,
+			expectedType: g.TypeError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(New().Handler())
+			defer httpServer.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+
+			if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte(tt.setup)); err != nil {
+				t.Fatalf("Failed to send setup message: %v", err)
+			}
+			msg, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatalf("Failed to read setup response: %v", err)
+			}
+			var env envelope
+			if err := json.Unmarshal(msg, &env); err != nil || env.Type != tt.expectedType {
+				t.Fatalf("Expected %s, got %s", tt.expectedType, msg)
+			}
+			if tt.expectedType != g.TypeSetupComplete {
+				return
+			}
+			var complete g.SetupCompleteJson
+			if err := json.Unmarshal(msg, &complete); err != nil {
+				t.Fatalf("Failed to unmarshal setup complete: %v", err)
+			}
+			if complete.Version != tt.version || !slices.Equal(complete.Capabilities, tt.capabilities) {
+				t.Errorf("Expected version %s with %q, got %s", tt.version, tt.capabilities, msg)
+			}
+			if _, _, err := wsutil.ReadServerData(conn); err != nil {
+				t.Fatalf("Failed to read resumption update: %v", err)
+			}
+		})
+	}
+}
+
+// TestStreamingDeltas tests that a negotiated streaming_deltas capability splits the echo into deltas
+func TestStreamingDeltas(t *testing.T) {
+	httpServer := httptest.NewServer(New().Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	messages := []string{
+		`{"type": "setup", "model": "gemini-1.5-flash", "version": "1.1", "capabilities": ["streaming_deltas"]}`,
+		`{"type": "input_text", "text": "one two three"}`,
+	}
+	for _, msg := range messages {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte(msg)); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	for range 2 {
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			t.Fatalf("Failed to read setup response: %v", err)
+		}
+	}
+
+	var deltas []string
+	for {
+		msg, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatalf("Failed to read delta: %v", err)
+		}
+		var out g.ServerOutputTextJson
+		if err := json.Unmarshal(msg, &out); err != nil {
+			t.Fatalf("Failed to unmarshal delta: %v", err)
+		}
+		deltas = append(deltas, out.Text)
+		if out.Final {
+			break
+		}
+	}
+	if len(deltas) != 4 || strings.Join(deltas, "") != "[echo] one two three" {
+		t.Errorf("Expected the echo in 4 deltas, got %q", deltas)
+	}
+}
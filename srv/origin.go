@@ -0,0 +1,122 @@
+package srv
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// corsMaxAge is how long browsers may cache a preflight response.
+const corsMaxAge = 10 * time.Minute
+
+// originPolicy decides which browser origins may call the server. Requests
+// without an Origin header and same-origin requests are always allowed.
+type originPolicy struct {
+	patterns atomic.Pointer[[]string]
+}
+
+// setOrigins replaces the allowlist. Entries are hosts ("app.example.com"),
+// wildcard subdomains ("*.example.com"), full origins
+// ("https://app.example.com") or "*" to allow any origin, though not with
+// credentials. An entry without a port allows its hosts on any port, and
+// one with a port ("localhost:3000") on that port only.
+func (p *originPolicy) setOrigins(patterns []string) {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			normalized = append(normalized, strings.TrimSuffix(pattern, "/"))
+		}
+	}
+	p.patterns.Store(&normalized)
+}
+
+// allowed reports whether the origin of r may call the server, and whether
+// it may do so with credentials. An origin that only "*" allows may not:
+// reflecting every origin with credentials would let any site read the
+// responses to requests that carry its visitors' credentials.
+func (p *originPolicy) allowed(r *http.Request) (allowed, credentials bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true, true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false, false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true, true
+	}
+
+	patterns := p.patterns.Load()
+	if patterns == nil {
+		return false, false
+	}
+	for _, pattern := range *patterns {
+		if pattern == "*" {
+			allowed = true
+		} else if matchOrigin(pattern, u) {
+			return true, true
+		}
+	}
+	return allowed, false
+}
+
+func matchOrigin(pattern string, origin *url.URL) bool {
+	host := pattern
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if scheme != origin.Scheme {
+			return false
+		}
+		host = rest
+	}
+	target := origin.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		target = origin.Hostname()
+		host = strings.Trim(host, "[]")
+	}
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		return strings.HasSuffix(target, "."+suffix)
+	}
+	return host == target
+}
+
+// cors enforces the origin policy on every route and answers CORS preflight
+// requests for the REST endpoints. Disallowed origins get 403, which also
+// blocks cross-site WebSocket upgrades before the handshake.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed, credentials := s.origins.allowed(r)
+		if !allowed {
+			s.logger.Warn("Rejecting disallowed origin", "method", r.Method, "path", loggedPath(r), "origin", origin)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		if credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
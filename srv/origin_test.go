@@ -0,0 +1,188 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+// TestOriginPolicy tests origin matching against hosts, wildcards and full origins
+func TestOriginPolicy(t *testing.T) {
+	var policy originPolicy
+	policy.setOrigins([]string{"app.example.com", "*.example.org", "https://secure.example.net", "localhost:3000",
+		"*.example.io:8443"})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "", allowed: true},
+		{origin: "http://twinspeak.local", allowed: true},
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "https://evil.example.com", allowed: false},
+		{origin: "https://a.b.example.org", allowed: true},
+		{origin: "https://example.org", allowed: false},
+		{origin: "https://notexample.org", allowed: false},
+		{origin: "https://secure.example.net", allowed: true},
+		{origin: "http://secure.example.net", allowed: false},
+		{origin: "https://app.example.com:8443", allowed: true},
+		{origin: "https://a.example.org:8443", allowed: true},
+		{origin: "https://secure.example.net:8443", allowed: true},
+		{origin: "http://localhost:3000", allowed: true},
+		{origin: "http://localhost:4000", allowed: false},
+		{origin: "http://localhost", allowed: false},
+		{origin: "https://a.example.io:8443", allowed: true},
+		{origin: "https://a.example.io", allowed: false},
+		{origin: "null", allowed: false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://twinspeak.local/v1/speak", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got, _ := policy.allowed(r); got != tt.allowed {
+			t.Errorf("Origin %q: expected allowed=%v, got %v", tt.origin, tt.allowed, got)
+		}
+	}
+}
+
+// TestWebSocketOrigin tests that upgrades from disallowed origins are refused with 403
+func TestWebSocketOrigin(t *testing.T) {
+	server := New(WithAllowedOrigins("*.example.com"))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	dial := func(origin string) error {
+		dialer := ws.Dialer{
+			Protocols: []string{Subprotocol},
+			Header:    ws.HandshakeHeaderHTTP(http.Header{"Origin": {origin}}),
+		}
+		conn, _, _, err := dialer.Dial(context.Background(), wsURL)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err := dial("https://app.example.com"); err != nil {
+		t.Errorf("Expected allowed origin to connect, got %v", err)
+	}
+	if err := dial(httpServer.URL); err != nil {
+		t.Errorf("Expected same origin to connect, got %v", err)
+	}
+
+	var status ws.StatusError
+	if err := dial("https://attacker.test"); !errors.As(err, &status) || int(status) != http.StatusForbidden {
+		t.Errorf("Expected 403 for disallowed origin, got %v", err)
+	}
+}
+
+// TestWebSocketOriginWithCredentials tests that an upgrade from a disallowed origin is refused with 403 even
+// when it carries valid credentials
+func TestWebSocketOriginWithCredentials(t *testing.T) {
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"secret-key": "alice"})),
+		WithAllowedOrigins("https://app.example.com"),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak?access_token=secret-key"
+	for _, tt := range []struct {
+		origin string
+		status int
+	}{
+		{origin: "https://app.example.com", status: http.StatusSwitchingProtocols},
+		{origin: "https://attacker.test", status: http.StatusForbidden},
+	} {
+		dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Origin": {tt.origin}})}
+		conn, _, _, err := dialer.Dial(context.Background(), wsURL)
+		var status ws.StatusError
+		switch {
+		case err == nil:
+			conn.Close()
+			if tt.status != http.StatusSwitchingProtocols {
+				t.Errorf("Origin %s: expected status %d, got an upgrade", tt.origin, tt.status)
+			}
+		case !errors.As(err, &status) || int(status) != tt.status:
+			t.Errorf("Origin %s: expected status %d, got %v", tt.origin, tt.status, err)
+		}
+	}
+}
+
+// TestCORSWildcard tests that origins allowed only by "*" are not allowed credentials
+func TestCORSWildcard(t *testing.T) {
+	server := New(WithAllowedOrigins("*", "https://app.example.com"))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	tests := []struct {
+		origin      string
+		credentials string
+	}{
+		{origin: "https://app.example.com", credentials: "true"},
+		{origin: "https://anyone.test", credentials: ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodOptions, httpServer.URL+"/v1/tokens", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send preflight: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.origin {
+			t.Errorf("Origin %s: expected it to be echoed, got %q", tt.origin, got)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+			t.Errorf("Origin %s: expected credentials %q, got %q", tt.origin, tt.credentials, got)
+		}
+	}
+}
+
+// TestCORSPreflight tests preflight responses for the REST endpoints
+func TestCORSPreflight(t *testing.T) {
+	server := New(WithAllowedOrigins("https://app.example.com"))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, httpServer.URL+"/v1/tokens", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send preflight: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected allowed origin to be echoed, got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Authorization") {
+		t.Errorf("Expected Authorization in allowed headers, got %q", got)
+	}
+
+	if resp := preflight("https://attacker.test"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for disallowed origin, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,125 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/recording"
+	"jig.sx/twinspeak/pkg/session"
+)
+
+// recordKey is the sessionConfig field with which a client asks for its
+// session to be recorded.
+const recordKey = "record"
+
+// DefaultRecordingMaxBytes caps each archive unless RecordingConfig.MaxBytes
+// says otherwise.
+const DefaultRecordingMaxBytes = 64 << 20
+
+// RecordingConfig configures the recording of sessions for replay.
+type RecordingConfig struct {
+	// Dir receives one archive per recorded connection. Recording is
+	// disabled when it is empty.
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+	// All records every session; otherwise only those of OptIn principals
+	// whose setup sets sessionConfig.record to true are recorded.
+	All bool `json:"all,omitempty" yaml:"all,omitempty"`
+	// OptIn lists the principals that may ask for their sessions to be
+	// recorded, "anonymous" for clients without one. Other clients cannot,
+	// as every archive takes disk space the operator has to grant.
+	OptIn []string `json:"optIn,omitempty" yaml:"optIn,omitempty"`
+	// MaxBytes caps each archive. Recording stops before a frame that
+	// would exceed it; zero means DefaultRecordingMaxBytes.
+	MaxBytes int64 `json:"maxBytes,omitempty" yaml:"maxBytes,omitempty"`
+}
+
+// Validate checks that Dir, if set, is a directory and MaxBytes is not
+// negative.
+func (c RecordingConfig) Validate() error {
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("recording size limit %d is negative", c.MaxBytes)
+	}
+	if c.Dir == "" {
+		return nil
+	}
+	if fi, err := os.Stat(c.Dir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("recording directory %q does not exist", c.Dir)
+	}
+	return nil
+}
+
+// WithRecording records sessions as configured by c.
+func WithRecording(c RecordingConfig) Option {
+	return func(s *Server) {
+		if c.MaxBytes <= 0 {
+			c.MaxBytes = DefaultRecordingMaxBytes
+		}
+		s.recording = c
+	}
+}
+
+// records reports whether a session of p set up with req is recorded.
+func (c RecordingConfig) records(p *Principal, req g.SetupRequestJson) bool {
+	if c.Dir == "" {
+		return false
+	}
+	return c.All || (req.SessionConfig[recordKey] == true && slices.Contains(c.OptIn, principalName(p)))
+}
+
+// startRecording opens an archive for conn if sess is to be recorded and
+// records the setup message that configured it. A session resumed on
+// another connection gets an archive of its own, so every archive replays
+// from a setup. Failing to record does not fail the session.
+func (s *Server) startRecording(conn *clientConn, sess *session.Session, req g.SetupRequestJson, msg []byte) {
+	if !s.recording.records(conn.principal, req) {
+		return
+	}
+	name := fmt.Sprintf("%s-%d.jsonl", sess.ID, time.Now().UnixNano())
+	// Archives hold users' audio and transcripts, so only the server may read them.
+	f, err := os.OpenFile(filepath.Join(s.recording.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		conn.logger().Error("Failed to create recording", "error", err)
+		return
+	}
+	w, err := recording.NewWriter(f, recording.Header{SessionID: string(sess.ID), Model: sess.Model})
+	if err != nil {
+		_ = f.Close()
+		conn.logger().Error("Failed to write recording", "error", err)
+		return
+	}
+	w.SetLimit(s.recording.MaxBytes)
+	conn.recorder.Store(w)
+	s.recordFrame(conn, recording.Inbound, msg, ws.OpText)
+	conn.logger().Info("Recording session", "file", f.Name())
+}
+
+// recordFrame appends a frame to conn's archive, if it has one.
+func (s *Server) recordFrame(conn *clientConn, dir recording.Direction, data []byte, op ws.OpCode) {
+	w := conn.recorder.Load()
+	if w == nil {
+		return
+	}
+	switch err := w.Write(dir, data, op != ws.OpText); {
+	case errors.Is(err, recording.ErrFull):
+		conn.logger().Warn("Stopping recording: archive size limit reached", "max_bytes", s.recording.MaxBytes)
+		s.stopRecording(conn)
+	case err != nil:
+		conn.logger().Warn("Failed to record frame", "error", err)
+	}
+}
+
+// stopRecording closes conn's archive, if it has one.
+func (s *Server) stopRecording(conn *clientConn) {
+	if w := conn.recorder.Swap(nil); w != nil {
+		if err := w.Close(); err != nil {
+			conn.logger().Warn("Failed to close recording", "error", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package srv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"jig.sx/twinspeak/pkg/recording"
+)
+
+// recordedSetup asks for the session to be recorded.
+const recordedSetup = `{"type": "setup", "model": "gemini-1.5-flash", "sessionConfig": {"record": true}}`
+
+// talk runs a short session with setup on the server at wsURL, authenticated with key if it is not empty.
+func talk(t *testing.T, wsURL, key, setup string) {
+	t.Helper()
+	var dialer ws.Dialer
+	if key != "" {
+		dialer.Header = ws.HandshakeHeaderHTTP(http.Header{"Authorization": {"Bearer " + key}})
+	}
+	conn, _, _, err := dialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{setup, `{"type": "input_text", "text": "hello"}`,
+		`{"type": "end_session", "reason": "done"}`} {
+		if err := wsutil.WriteClientText(conn, []byte(msg)); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	for {
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			return
+		}
+	}
+}
+
+// readRecordings returns the paths of the archives in dir and the frames of the only one.
+func readRecordings(t *testing.T, dir string) ([]string, recording.Header, []recording.Frame) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if len(files) != 1 {
+		return files, recording.Header{}, nil
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("Failed to open recording: %v", err)
+	}
+	defer f.Close()
+	h, frames, err := recording.Read(f)
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+	return files, h, frames
+}
+
+// TestRecording tests that sessions asking to be recorded are archived frame by frame and others are not
+func TestRecording(t *testing.T) {
+	dir := t.TempDir()
+	server := New(WithRecording(RecordingConfig{Dir: dir, OptIn: []string{"anonymous"}}))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	talk(t, wsURL, "", `{"type": "setup", "model": "gemini-1.5-flash"}`)
+	talk(t, wsURL, "", recordedSetup)
+
+	files, h, frames := readRecordings(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected one recording, got %v", files)
+	}
+	fi, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatalf("Failed to stat recording: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the recording to be private to the server, got %v", fi.Mode())
+	}
+	if h.Model != "gemini-1.5-flash" || !strings.HasPrefix(filepath.Base(files[0]), h.SessionID) {
+		t.Errorf("Unexpected header %+v for %s", h, files[0])
+	}
+	want := []struct {
+		dir  recording.Direction
+		text string
+	}{
+		{recording.Inbound, `"setup"`},
+		{recording.Outbound, `"session_resumption_update"`},
+		{recording.Inbound, `"input_text"`},
+		{recording.Outbound, `[echo] hello`},
+		{recording.Inbound, `"end_session"`},
+		{recording.Outbound, `Goodbye!`},
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("Expected %d frames, got %d: %+v", len(want), len(frames), frames)
+	}
+	for i, w := range want {
+		if frames[i].Direction != w.dir || !strings.Contains(frames[i].Text, w.text) {
+			t.Errorf("Frame %d: expected %s containing %s, got %+v", i, w.dir, w.text, frames[i])
+		}
+	}
+}
+
+// TestRecordingOptIn tests that only principals allowed to opt in are recorded on request
+func TestRecordingOptIn(t *testing.T) {
+	dir := t.TempDir()
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"alice-key": "alice", "bob-key": "bob"})),
+		WithRecording(RecordingConfig{Dir: dir, OptIn: []string{"alice"}}),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	talk(t, wsURL, "bob-key", recordedSetup)
+	if files, _, _ := readRecordings(t, dir); len(files) != 0 {
+		t.Fatalf("Expected no recording for a principal not allowed to opt in, got %v", files)
+	}
+	talk(t, wsURL, "alice-key", recordedSetup)
+	if files, _, _ := readRecordings(t, dir); len(files) != 1 {
+		t.Errorf("Expected one recording for an allowed principal, got %v", files)
+	}
+}
+
+// TestRecordingLimit tests that recording stops before an archive exceeds its size limit
+func TestRecordingLimit(t *testing.T) {
+	dir := t.TempDir()
+	const limit = 400
+	server := New(WithRecording(RecordingConfig{Dir: dir, All: true, MaxBytes: limit}))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	talk(t, "ws"+strings.TrimPrefix(httpServer.URL, "http")+"/v1/speak", "", recordedSetup)
+
+	files, _, frames := readRecordings(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected one recording, got %v", files)
+	}
+	if len(frames) == 0 || len(frames) >= 6 {
+		t.Errorf("Expected the recording to stop part way, got %d frames", len(frames))
+	}
+	if fi, err := os.Stat(files[0]); err != nil || fi.Size() > limit {
+		t.Errorf("Expected at most %d bytes, got %v, %v", limit, fi, err)
+	}
+}
@@ -0,0 +1,199 @@
+package srv
+
+import (
+	"context"
+	"time"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/session"
+)
+
+// DefaultDrainPeriod is how long Shutdown waits for sessions to wind down
+// unless overridden with WithDrainPeriod.
+const DefaultDrainPeriod = 10 * time.Second
+
+// drainPollInterval is how often Shutdown checks for remaining connections.
+const drainPollInterval = 50 * time.Millisecond
+
+// DefaultSessionTTL is how long a detached session stays resumable unless
+// overridden with WithSessionTTL.
+const DefaultSessionTTL = 10 * time.Minute
+
+// reapInterval bounds how often reapSessions scans the store.
+const reapInterval = time.Second
+
+// register tracks a live connection, failing once the server is draining.
+func (s *Server) register(conn *clientConn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.draining.Load() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) unregister(conn *clientConn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, conn)
+}
+
+// attach binds sess to conn unless another live connection holds it.
+func (s *Server) attach(conn *clientConn, sess *session.Session) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for c := range s.conns {
+		if c != conn && c.sess == sess {
+			return false
+		}
+	}
+	conn.sess = sess
+	return true
+}
+
+// reapSessions deletes sessions that have had no connection and no
+// activity for longer than the session TTL.
+func (s *Server) reapSessions() {
+	if s.sessionTTL <= 0 {
+		return
+	}
+	s.connsMu.Lock()
+	if time.Since(s.lastReap) < min(reapInterval, s.sessionTTL) {
+		s.connsMu.Unlock()
+		return
+	}
+	s.lastReap = time.Now()
+	attached := make(map[session.ID]bool, len(s.conns))
+	for c := range s.conns {
+		if c.sess != nil {
+			attached[c.sess.ID] = true
+		}
+	}
+	s.connsMu.Unlock()
+
+	cutoff := time.Now().Add(-s.sessionTTL)
+	for _, sess := range s.Store.List() {
+		if _, updated := sess.Stats(); !attached[sess.ID] && updated.Before(cutoff) {
+			s.Store.Delete(sess.ID)
+			s.metrics.sessionsReaped.Inc()
+			s.logger.Info("Session reaped", "session_id", sess.ID, "principal", sess.Principal, "model", sess.Model,
+				"ttl", s.sessionTTL)
+		}
+	}
+}
+
+// liveConns returns a snapshot of the registered connections.
+func (s *Server) liveConns() []*clientConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	conns := make([]*clientConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// waitConns blocks until every connection is gone or ctx is done.
+func (s *Server) waitConns(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		s.connsMu.Lock()
+		n := len(s.conns)
+		s.connsMu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown drains the server: new upgrades are refused, every live session
+// is sent going_away with its resumption handle and given the drain period
+// to finish, and the remaining connections are closed with 1001 once their
+// current turn completes. Detached sessions are then saved to the persister,
+// if one is configured. Shutdown does not stop the HTTP server itself.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMu.Lock()
+	s.draining.Store(true)
+	s.connsMu.Unlock()
+
+	deadline := time.Now().Add(s.drainPeriod)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conns := s.liveConns()
+	s.logger.Info("Draining sessions", "sessions", len(conns), "deadline", deadline)
+	for _, c := range conns {
+		s.goingAway(c, time.Until(deadline))
+	}
+
+	drainCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if s.waitConns(drainCtx) != nil {
+		for _, c := range s.liveConns() {
+			s.closeGoingAway(c)
+		}
+	}
+	err := s.waitConns(ctx)
+
+	if s.persister != nil {
+		var detached []*session.Session
+		for _, sess := range s.Store.List() {
+			if sess.CurrentState() != session.StateClosed {
+				detached = append(detached, sess)
+			}
+		}
+		if perr := s.persister.Save(ctx, detached); perr != nil {
+			s.logger.Error("Failed to persist sessions", "error", perr)
+			return perr
+		}
+		s.logger.Info("Persisted sessions", "sessions", len(detached))
+	}
+	return err
+}
+
+// goingAway announces the shutdown to the client of conn.
+func (s *Server) goingAway(conn *clientConn, timeLeft time.Duration) {
+	msg := g.GoingAwayJson{Type: g.TypeGoingAway, TimeLeftMs: int(max(timeLeft, 0).Milliseconds())}
+	s.connsMu.Lock()
+	if conn.sess != nil {
+		handle := conn.sess.ResumptionHandle
+		msg.Handle = &handle
+	}
+	s.connsMu.Unlock()
+	if err := s.writeJSON(conn, msg); err != nil {
+		conn.logger().Warn("Failed to send going away notice", "error", err)
+	}
+}
+
+// closeGoingAway waits for the turn in progress on conn, then closes it with 1001.
+func (s *Server) closeGoingAway(conn *clientConn) {
+	conn.turn.Lock()
+	defer conn.turn.Unlock()
+	conn.closing.Store(true)
+	s.closeWith(conn, closeShutdown)
+	if err := conn.transport.SetReadDeadline(time.Now()); err != nil {
+		conn.logger().Warn("Failed to interrupt connection", "error", err)
+	}
+}
+
+// Restore loads persisted sessions into the store so they can be resumed.
+func (s *Server) Restore(ctx context.Context) (int, error) {
+	if s.persister == nil {
+		return 0, nil
+	}
+	sessions, err := s.persister.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, sess := range sessions {
+		s.Store.Put(sess)
+	}
+	return len(sessions), nil
+}
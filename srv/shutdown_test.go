@@ -0,0 +1,165 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/session"
+)
+
+// sendSetup sends a setup message, resuming handle if set, and returns the decoded reply
+func sendSetup(t *testing.T, conn net.Conn, handle string) (g.SessionResumptionUpdateJson, g.ErrorJson) {
+	t.Helper()
+	req := g.SetupRequestJson{Type: "setup", Model: "gemini-1.5-flash"}
+	if handle != "" {
+		req.ResumptionHandle = &handle
+	}
+	data, _ := json.Marshal(req)
+	if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+		t.Fatalf("Failed to send setup message: %v", err)
+	}
+	msg, _, err := wsutil.ReadServerData(conn)
+	if err != nil {
+		t.Fatalf("Failed to read setup response: %v", err)
+	}
+	var update g.SessionResumptionUpdateJson
+	var errorResp g.ErrorJson
+	if strings.Contains(string(msg), `"error"`) {
+		_ = json.Unmarshal(msg, &errorResp)
+	} else if err := json.Unmarshal(msg, &update); err != nil {
+		t.Fatalf("Failed to unmarshal setup response: %v", err)
+	}
+	return update, errorResp
+}
+
+// TestSessionResumption tests resuming a detached session by its handle
+func TestSessionResumption(t *testing.T) {
+	server := New()
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	dial := func() net.Conn {
+		conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		return conn
+	}
+
+	first := dial()
+	update, _ := sendSetup(t, first, "")
+
+	second := dial()
+	defer second.Close()
+	if _, errorResp := sendSetup(t, second, update.Handle); errorResp.Code != "invalid_handle" {
+		t.Errorf("Expected invalid_handle while the session is attached, got %q", errorResp.Code)
+	}
+	first.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn := dial()
+		resumed, errorResp := sendSetup(t, conn, update.Handle)
+		conn.Close()
+		if errorResp.Code == "" {
+			if resumed.Handle != update.Handle {
+				t.Errorf("Expected handle %s, got %s", update.Handle, resumed.Handle)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the session to be resumable after disconnect, got %q", errorResp.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn := dial()
+	defer conn.Close()
+	if _, errorResp := sendSetup(t, conn, "session_unknown"); errorResp.Code != "invalid_handle" {
+		t.Errorf("Expected invalid_handle for an unknown handle, got %q", errorResp.Code)
+	}
+}
+
+// TestGracefulShutdown tests draining, the going_away notice and resuming after a restart
+func TestGracefulShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	server := New(WithDrainPeriod(100*time.Millisecond), WithPersister(session.NewFilePersister(path)))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	update, _ := sendSetup(t, conn, "")
+
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(context.Background()) }()
+
+	msg, _, err := wsutil.ReadServerData(conn)
+	if err != nil {
+		t.Fatalf("Failed to read going away notice: %v", err)
+	}
+	var notice g.GoingAwayJson
+	if err := json.Unmarshal(msg, &notice); err != nil {
+		t.Fatalf("Failed to unmarshal going away notice: %v", err)
+	}
+	if notice.Type != "going_away" || notice.Handle == nil || *notice.Handle != update.Handle {
+		t.Errorf("Expected going_away with handle %s, got %s", update.Handle, msg)
+	}
+
+	resp, err := http.Get(httpServer.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Failed to query health: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while draining, got %d", resp.StatusCode)
+	}
+	var status ws.StatusError
+	if _, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL); !errors.As(err, &status) ||
+		int(status) != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for new upgrades while draining, got %v", err)
+	}
+
+	_, _, err = wsutil.ReadServerData(conn)
+	var closed wsutil.ClosedError
+	if !errors.As(err, &closed) || closed.Code != ws.StatusGoingAway {
+		t.Errorf("Expected close code %d, got %v", ws.StatusGoingAway, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+
+	restarted := New(WithPersister(session.NewFilePersister(path)))
+	if n, err := restarted.Restore(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 restored session, got %d (%v)", n, err)
+	}
+	restartedServer := httptest.NewServer(restarted.Handler())
+	defer restartedServer.Close()
+
+	wsURL = "ws" + strings.TrimPrefix(restartedServer.URL, "http") + "/v1/speak"
+	resumedConn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer resumedConn.Close()
+	if resumed, errorResp := sendSetup(t, resumedConn, update.Handle); resumed.Handle != update.Handle {
+		t.Errorf("Expected to resume %s after restart, got error %q", update.Handle, errorResp.Code)
+	}
+}
@@ -2,36 +2,216 @@
 package srv
 
 import (
+	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
 
 	"jig.sx/twinspeak/pkg/session"
 )
 
 // Server represents the HTTP server with session management.
 type Server struct {
-	Store *session.Store
-	mux   *chi.Mux
+	Store          *session.Store
+	mux            *chi.Mux
+	ephemeral      *EphemeralTokens
+	limiter        *limiter
+	messageLimits  MessageLimits
+	origins        originPolicy
+	authenticators []Authenticator
+	admins         map[string]bool
+	persister      session.Persister
+	metrics        *metrics
+	logger         *slog.Logger
+	tracer         trace.Tracer
+	unredacted     bool
+	checkReplies   bool
+	recording      RecordingConfig
+	compression    CompressionConfig
+	keepalive      KeepaliveConfig
+	conns          map[*clientConn]struct{}
+	sse            map[string]*sseConn
+	lastReap       time.Time
+	drainPeriod    time.Duration
+	sessionTTL     time.Duration
+	connsMu        sync.Mutex
+	sseMu          sync.Mutex
+	draining       atomic.Bool
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAuthenticators requires every /v1 request to be accepted by one of the
+// given authenticators, tried in order.
+func WithAuthenticators(authenticators ...Authenticator) Option {
+	return func(s *Server) {
+		s.authenticators = append(s.authenticators, authenticators...)
+	}
+}
+
+// WithEphemeralTokens enables POST /v1/tokens and accepts the minted tokens on /v1/speak.
+func WithEphemeralTokens(tokens *EphemeralTokens) Option {
+	return func(s *Server) {
+		s.ephemeral = tokens
+		s.authenticators = append(s.authenticators, tokens)
+	}
+}
+
+// WithLimits enforces per-principal rate limits and quotas on /v1/speak.
+func WithLimits(cfg LimitsConfig) Option {
+	return func(s *Server) {
+		s.SetLimits(cfg)
+	}
+}
+
+// WithMessageLimits overrides DefaultMessageLimits. Zero fields keep their default.
+func WithMessageLimits(limits MessageLimits) Option {
+	return func(s *Server) {
+		if limits.MaxFrameBytes > 0 {
+			s.messageLimits.MaxFrameBytes = limits.MaxFrameBytes
+		}
+		if limits.MaxAudioBytes > 0 {
+			s.messageLimits.MaxAudioBytes = limits.MaxAudioBytes
+		}
+		if limits.MaxTextLength > 0 {
+			s.messageLimits.MaxTextLength = limits.MaxTextLength
+		}
+		if limits.MaxDepth > 0 {
+			s.messageLimits.MaxDepth = limits.MaxDepth
+		}
+		if limits.MaxLogBytes > 0 {
+			s.messageLimits.MaxLogBytes = limits.MaxLogBytes
+		}
+	}
+}
+
+// WithAllowedOrigins allows browser clients from the given origins in
+// addition to same-origin requests. See originPolicy.setOrigins for the syntax.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) {
+		s.SetAllowedOrigins(origins...)
+	}
+}
+
+// WithDrainPeriod sets how long Shutdown lets live sessions finish before
+// closing them.
+func WithDrainPeriod(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainPeriod = d
+	}
+}
+
+// WithSessionTTL sets how long a session without a connection stays
+// resumable before it is reaped. Zero keeps sessions until they are ended.
+func WithSessionTTL(d time.Duration) Option {
+	return func(s *Server) {
+		s.sessionTTL = d
+	}
+}
+
+// WithPersister saves unfinished sessions on Shutdown and makes Restore
+// load them back, so clients can resume across restarts.
+func WithPersister(p session.Persister) Option {
+	return func(s *Server) {
+		s.persister = p
+	}
+}
+
+// WithAdmins grants the given principals access to the admin API. Each is
+// given as method:id, such as api_key:ops, as principal IDs are only unique
+// per authentication method; see ValidateAdmins.
+func WithAdmins(principals ...string) Option {
+	return func(s *Server) {
+		for _, p := range principals {
+			s.admins[p] = true
+		}
+	}
+}
+
+// WithLogger sends the server's records to logger instead of slog.Default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithUnredactedPayloads logs audio chunks and tool arguments and results
+// verbatim in debug records instead of redacting them.
+func WithUnredactedPayloads() Option {
+	return func(s *Server) {
+		s.unredacted = true
+	}
+}
+
+// WithOutboundValidation checks every message the server sends against its
+// schema and logs the violations. It decodes every reply once more,
+// so it is meant for debugging backends rather than production.
+func WithOutboundValidation() Option {
+	return func(s *Server) {
+		s.checkReplies = true
+	}
 }
 
 // New creates a new server instance with configured routes.
-func New() *Server {
+func New(opts ...Option) *Server {
+	store := session.NewStore()
 	s := &Server{
-		Store: session.NewStore(),
-		mux:   chi.NewRouter(),
+		Store:         store,
+		metrics:       newMetrics(store),
+		logger:        slog.Default(),
+		tracer:        defaultTracer(),
+		mux:           chi.NewRouter(),
+		limiter:       newLimiter(LimitsConfig{}),
+		messageLimits: DefaultMessageLimits,
+		admins:        make(map[string]bool),
+		conns:         make(map[*clientConn]struct{}),
+		sse:           make(map[string]*sseConn),
+		drainPeriod:   DefaultDrainPeriod,
+		sessionTTL:    DefaultSessionTTL,
+		keepalive:     DefaultKeepalive,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	s.routes()
 	return s
 }
 
+// SetLimits replaces the rate limits of a running server.
+func (s *Server) SetLimits(cfg LimitsConfig) {
+	s.limiter.setConfig(cfg)
+}
+
+// SetAllowedOrigins replaces the origin allowlist of a running server.
+func (s *Server) SetAllowedOrigins(origins ...string) {
+	s.origins.setOrigins(origins)
+}
+
 func (s *Server) routes() {
-	s.mux.Use(middleware.Logger)
+	s.mux.Use(s.logRequests)
 	s.mux.Use(middleware.Recoverer)
+	s.mux.Use(s.cors)
 
 	s.mux.Get("/healthz", s.handleHealth)
-	s.mux.Get("/v1/speak", s.handleSpeakWS)
+	s.mux.Get("/metrics", s.handleMetrics)
+	s.mux.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Get("/v1/speak", s.handleSpeakWS)
+		r.Post("/v1/sessions", s.handleCreateSSE)
+		if s.ephemeral != nil {
+			r.Post("/v1/tokens", s.handleMintToken)
+		}
+		r.With(s.requireAdmin).Get("/v1/admin/sessions", s.handleListSessions)
+	})
+	// The connection ID authorizes these; see handleCreateSSE.
+	s.mux.Get("/v1/sessions/{id}/events", s.handleSSEEvents)
+	s.mux.Post("/v1/sessions/{id}/messages", s.handleSSEMessage)
 }
 
 // Handler returns the HTTP handler for the server.
@@ -39,8 +219,18 @@ func (s *Server) Handler() http.Handler {
 	return s.mux
 }
 
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.reapSessions()
+	s.metrics.handler().ServeHTTP(w, r)
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"draining"}`))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(`{"status":"ok"}`))
 }
@@ -0,0 +1,290 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+const (
+	// sseOpenTimeout is how long a connection created with POST
+	// /v1/sessions waits for its event stream before it is dropped.
+	sseOpenTimeout = 30 * time.Second
+	// sseQueue is how many posted messages a connection holds for its
+	// reader before further posts wait.
+	sseQueue = 16
+	// sseMaxPending is how many connections a client, as identified for
+	// its limits, may have created but not opened the event stream of.
+	// Pending connections hold memory but no session slot.
+	sseMaxPending = 8
+)
+
+// sseConnection is the response to POST /v1/sessions.
+type sseConnection struct {
+	ID       string `json:"id"`
+	Events   string `json:"events"`
+	Messages string `json:"messages"`
+}
+
+// sseClose is the data of the close event, the counterpart of a WebSocket
+// close frame.
+type sseClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// sseConn carries the messages of a client on the Server-Sent Events
+// fallback, for networks whose proxies break WebSockets. The server's
+// messages are events on the stream of GET /v1/sessions/{id}/events and the
+// client's are POSTed to /v1/sessions/{id}/messages one per request. {id}
+// names the connection, not a protocol session: setup starts and resumes
+// sessions exactly as on /v1/speak.
+type sseConn struct {
+	id      string
+	created time.Time
+	// key identifies the client to the limits and counts the connection
+	// against its pending connections.
+	key string
+	// req is the request that created the connection, which carries the
+	// principal and trace context the connection is served with.
+	req *http.Request
+	// in holds the posted messages; it stops reading when the event
+	// stream closes.
+	in *inbox
+	// streaming is set once the event stream is open, which it can be
+	// only once, and is guarded by Server.sseMu. w and rc write to the
+	// stream; every write is guarded by writeMu, as pings come from
+	// another goroutine than messages.
+	streaming    bool
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	writeMu      sync.Mutex
+}
+
+// handleCreateSSE creates a connection on the Server-Sent Events fallback
+// for an authenticated client. Its ID is unguessable and the only credential
+// the event stream and message requests need: EventSource cannot send an
+// Authorization header, and an ephemeral token is spent on this request.
+func (s *Server) handleCreateSSE(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	key, _ := limitKey(r)
+	t := &sseConn{
+		id:           rand.Text(),
+		created:      time.Now(),
+		key:          key,
+		req:          r.Clone(context.WithoutCancel(r.Context())),
+		in:           newInbox(sseQueue),
+		writeTimeout: time.Duration(s.keepalive.WriteTimeout),
+	}
+	if !s.addSSE(t) {
+		p, _ := PrincipalFromContext(r.Context())
+		s.logger.Warn("Rejecting connection: too many pending event streams",
+			"principal", principalName(p), "remote", r.RemoteAddr, "max_pending", sseMaxPending)
+		w.Header().Set("Retry-After", strconv.Itoa(int(sseOpenTimeout.Seconds())))
+		http.Error(w, "too many pending connections", http.StatusTooManyRequests)
+		return
+	}
+
+	path := "/v1/sessions/" + t.id
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Location", path+"/events")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(s.mustJSON(sseConnection{ID: t.id, Events: path + "/events", Messages: path + "/messages"}))
+}
+
+// handleSSEEvents streams the server's messages of a connection as events
+// and serves the connection for as long as the stream is open.
+func (s *Server) handleSSEEvents(w http.ResponseWriter, r *http.Request) {
+	t, status := s.openSSE(chi.URLParam(r, "id"))
+	if t == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer s.dropSSE(t)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	t.w, t.rc, t.in.gone = w, http.NewResponseController(w), r.Context().Done()
+	if err := t.rc.Flush(); err != nil {
+		s.logger.Warn("Failed to open event stream", "error", err, "remote", r.RemoteAddr)
+		return
+	}
+	// The stream ending ends reading, which ends ServeConn.
+	s.ServeConn(t.req, t)
+}
+
+// handleSSEMessage queues the message in the request body for the reader of
+// its connection. The request waits while the queue is full, so that a client
+// cannot post faster than it is served. A message the WebSocket reader would
+// reject is queued as the error it would fail with, which ends the
+// connection the same way.
+func (s *Server) handleSSEMessage(w http.ResponseWriter, r *http.Request) {
+	s.sseMu.Lock()
+	t := s.sse[chi.URLParam(r, "id")]
+	s.sseMu.Unlock()
+	if t == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	limit := s.messageLimits.MaxFrameBytes
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		http.Error(w, "failed to read message", http.StatusBadRequest)
+		return
+	}
+	p, status := posted{data: data}, http.StatusAccepted
+	switch {
+	case int64(len(data)) > limit:
+		p, status = posted{err: wsutil.ErrFrameTooLarge}, http.StatusRequestEntityTooLarge
+	case !utf8.Valid(data):
+		p, status = posted{err: wsutil.ErrInvalidUTF8}, http.StatusBadRequest
+	}
+
+	if err := t.in.put(p, r.Context().Done()); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// addSSE registers t unless its client already has sseMaxPending
+// connections waiting for their event streams. Connections whose stream did
+// not open in time are dropped first.
+func (s *Server) addSSE(t *sseConn) bool {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+	pending := 0
+	for id, c := range s.sse {
+		switch {
+		case c.streaming:
+		case time.Since(c.created) > sseOpenTimeout:
+			delete(s.sse, id)
+			_ = c.Close()
+		case c.key == t.key:
+			pending++
+		}
+	}
+	if pending >= sseMaxPending {
+		return false
+	}
+	s.sse[t.id] = t
+	return true
+}
+
+// openSSE marks the connection id as streaming, or returns the status to
+// refuse its event stream with.
+func (s *Server) openSSE(id string) (*sseConn, int) {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+	t := s.sse[id]
+	if t == nil {
+		return nil, http.StatusNotFound
+	}
+	if t.streaming {
+		return nil, http.StatusConflict
+	}
+	t.streaming = true
+	return t, 0
+}
+
+// dropSSE forgets t once its event stream has ended.
+func (s *Server) dropSSE(t *sseConn) {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+	delete(s.sse, t.id)
+}
+
+// ReadMessage returns the next posted message.
+func (t *sseConn) ReadMessage() ([]byte, error) {
+	return t.in.read()
+}
+
+// WriteMessage sends data as a message event.
+func (t *sseConn) WriteMessage(data []byte) error {
+	return t.writeEvent("", data)
+}
+
+// WriteClose sends a close event with the code and reason a WebSocket
+// client would get in its close frame.
+func (t *sseConn) WriteClose(code ws.StatusCode, reason string) error {
+	data, err := json.Marshal(sseClose{Code: int(code), Reason: reason})
+	if err != nil {
+		return err
+	}
+	return t.writeEvent("close", data)
+}
+
+// Ping sends a comment, which keeps proxies from timing out an idle stream.
+// The client cannot answer it: only the stream closing shows it is gone.
+func (t *sseConn) Ping() error {
+	return t.write([]byte(": ping\n\n"))
+}
+
+// writeEvent sends data as an event of the given type, or of the default
+// message type if it is empty. data must not contain newlines, which JSON
+// encoding escapes.
+func (t *sseConn) writeEvent(event string, data []byte) error {
+	var b bytes.Buffer
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	return t.write(b.Bytes())
+}
+
+// write sends p on the event stream within the write timeout. A stream that
+// cannot be written to is broken, so a failed write closes the connection.
+func (t *sseConn) write(p []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	var err error
+	if t.writeTimeout > 0 {
+		if err = t.rc.SetWriteDeadline(time.Now().Add(t.writeTimeout)); errors.Is(err, http.ErrNotSupported) {
+			err = nil
+		}
+	}
+	if err == nil {
+		_, err = t.w.Write(p)
+	}
+	if err == nil {
+		err = t.rc.Flush()
+	}
+	if err != nil {
+		_ = t.Close()
+	}
+	return err
+}
+
+// SetReadDeadline sets the deadline of ReadMessage.
+func (t *sseConn) SetReadDeadline(deadline time.Time) error {
+	return t.in.SetReadDeadline(deadline)
+}
+
+// Close ends the connection and refuses further posts. The event stream
+// ends when its handler returns.
+func (t *sseConn) Close() error {
+	t.in.close()
+	return nil
+}
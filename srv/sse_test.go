@@ -0,0 +1,330 @@
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// sseClient is a client on the Server-Sent Events fallback.
+type sseClient struct {
+	t       *testing.T
+	baseURL string
+	conn    sseConnection
+	stream  io.Closer
+	events  *bufio.Reader
+}
+
+// dialSSE creates a connection on the server at baseURL and opens its event stream.
+func dialSSE(t *testing.T, baseURL string) *sseClient {
+	t.Helper()
+	resp, err := http.Post(baseURL+"/v1/sessions", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to create connection: %v", err)
+	}
+	defer resp.Body.Close()
+	c := &sseClient{t: t, baseURL: baseURL}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.conn); err != nil {
+		t.Fatalf("Failed to decode connection: %v", err)
+	}
+
+	stream, err := http.Get(baseURL + c.conn.Events)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	c.stream = stream.Body
+	if ct := stream.Header.Get("Content-Type"); stream.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		stream.Body.Close()
+		t.Fatalf("Expected an event stream, got %d %s", stream.StatusCode, ct)
+	}
+	c.events = bufio.NewReader(stream.Body)
+	return c
+}
+
+// Close closes the event stream.
+func (c *sseClient) Close() error {
+	return c.stream.Close()
+}
+
+// post sends msg and returns the response status.
+func (c *sseClient) post(msg string) int {
+	c.t.Helper()
+	resp, err := http.Post(c.baseURL+c.conn.Messages, "application/json", strings.NewReader(msg))
+	if err != nil {
+		c.t.Fatalf("Failed to post message: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// next returns the type and data of the next event, skipping comments.
+func (c *sseClient) next() (string, string) {
+	c.t.Helper()
+	var event, data string
+	for {
+		line, err := c.events.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && data != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// message returns the data of the next event, which must be a message.
+func (c *sseClient) message() []byte {
+	c.t.Helper()
+	event, data := c.next()
+	if event != "" {
+		c.t.Fatalf("Expected a message, got %s event %s", event, data)
+	}
+	return []byte(data)
+}
+
+// expectClose reads the close event that must come next and the end of the stream.
+func (c *sseClient) expectClose(expected closeReason) {
+	c.t.Helper()
+	event, data := c.next()
+	var closed sseClose
+	if err := json.Unmarshal([]byte(data), &closed); event != "close" || err != nil {
+		c.t.Fatalf("Expected a close event, got %s event %s", event, data)
+	}
+	if closed.Code != int(expected.code) || closed.Reason != expected.reason {
+		c.t.Errorf("Expected close %d %s, got %d %s", expected.code, expected.reason, closed.Code, closed.Reason)
+	}
+	if rest, err := io.ReadAll(c.events); err != nil || len(rest) > 0 {
+		c.t.Errorf("Expected the stream to end after the close event, got %q, %v", rest, err)
+	}
+}
+
+// TestSSETransport tests a session on the Server-Sent Events fallback from setup to its end
+func TestSSETransport(t *testing.T) {
+	httpServer := httptest.NewServer(New().Handler())
+	defer httpServer.Close()
+	c := dialSSE(t, httpServer.URL)
+	defer c.Close()
+
+	if status := c.post(`{"type": "setup", "model": "gemini-1.5-flash"}`); status != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", status)
+	}
+	var update g.SessionResumptionUpdateJson
+	if err := json.Unmarshal(c.message(), &update); err != nil || update.Handle == "" {
+		t.Fatalf("Expected a resumption update, got %+v, %v", update, err)
+	}
+
+	c.post(`{"type": "input_text", "text": "hello"}`)
+	var output g.ServerOutputTextJson
+	if err := json.Unmarshal(c.message(), &output); err != nil || output.Text != "[echo] hello" {
+		t.Errorf("Expected the echo, got %+v, %v", output, err)
+	}
+
+	c.post(`{"type": "end_session", "reason": "user_requested"}`)
+	c.message()
+	c.expectClose(closeSessionEnded)
+
+	if status := c.post(`{"type": "input_text", "text": "still there?"}`); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a message after the end, got %d", status)
+	}
+}
+
+// TestSSEKeepalive tests that pings are sent on the event stream between messages without corrupting them
+func TestSSEKeepalive(t *testing.T) {
+	httpServer := httptest.NewServer(New(WithKeepalive(fastKeepalive)).Handler())
+	defer httpServer.Close()
+	c := dialSSE(t, httpServer.URL)
+	defer c.Close()
+	c.post(`{"type": "setup", "model": "gemini-1.5-flash"}`)
+	c.message()
+
+	pings := 0
+	for i := range 20 {
+		c.post(fmt.Sprintf(`{"type": "input_text", "text": "message %d"}`, i))
+		// Read up to the echo, counting the pings before it.
+		for {
+			line, err := c.events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			if line == ": ping\n" {
+				pings++
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var output g.ServerOutputTextJson
+				if err := json.Unmarshal([]byte(data), &output); err != nil || output.Text != fmt.Sprintf("[echo] message %d", i) {
+					t.Fatalf("Expected the echo of message %d, got %q, %v", i, data, err)
+				}
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pings == 0 {
+		t.Error("Expected pings on the event stream")
+	}
+}
+
+// TestSSEMessageTooLarge tests that an oversized post is refused and ends the connection as on /v1/speak
+func TestSSEMessageTooLarge(t *testing.T) {
+	server := New(WithMessageLimits(MessageLimits{MaxFrameBytes: 1024}))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	c := dialSSE(t, httpServer.URL)
+	defer c.Close()
+
+	msg := `{"type": "input_text", "text": "` + strings.Repeat("a", 2048) + `"}`
+	if status := c.post(msg); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", status)
+	}
+	var errorResp g.ErrorJson
+	if err := json.Unmarshal(c.message(), &errorResp); err != nil || errorResp.Code != "frame_too_large" {
+		t.Errorf("Expected frame_too_large error, got %+v, %v", errorResp, err)
+	}
+	c.expectClose(closeMessageTooBig)
+}
+
+// TestSSERefused tests the requests the Server-Sent Events endpoints refuse
+func TestSSERefused(t *testing.T) {
+	server := New(WithAuthenticators(NewAPIKeys(map[string]string{"secret-key": "alice"})))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, httpServer.URL+"/v1/sessions", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create connection: %v", err)
+	}
+	var conn sseConnection
+	err = json.NewDecoder(resp.Body).Decode(&conn)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode connection: %v", err)
+	}
+	stream, err := http.Get(httpServer.URL + conn.Events)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the connection ID to authorize the stream, got %d", stream.StatusCode)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		expected int
+	}{
+		{name: "Create without credentials", method: http.MethodPost, path: "/v1/sessions",
+			expected: http.StatusUnauthorized},
+		{name: "Unknown stream", method: http.MethodGet, path: "/v1/sessions/unknown/events", expected: http.StatusNotFound},
+		{name: "Unknown connection", method: http.MethodPost, path: "/v1/sessions/unknown/messages",
+			expected: http.StatusNotFound},
+		{name: "Second stream", method: http.MethodGet, path: conn.Events, expected: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, httpServer.URL+tt.path, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestSSEConnectionIDNotLogged tests that request logs name the route of a connection rather than its ID
+func TestSSEConnectionIDNotLogged(t *testing.T) {
+	var out syncBuffer
+	logger, err := NewLogger(&out, LogConfig{Level: "debug", Format: "json"})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	httpServer := httptest.NewServer(New(WithLogger(logger), WithAllowedOrigins("https://app.example.com")).Handler())
+	defer httpServer.Close()
+	c := dialSSE(t, httpServer.URL)
+
+	c.post(`{"type": "setup", "model": "gemini-1.5-flash"}`)
+	c.message()
+	req, err := http.NewRequest(http.MethodPost, httpServer.URL+c.conn.Messages, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Origin", "https://attacker.test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	c.post(`{"type": "end_session", "reason": "user_requested"}`)
+	c.message()
+	c.expectClose(closeSessionEnded)
+	c.Close()
+	httpServer.Close()
+
+	logs := out.String()
+	if strings.Contains(logs, c.conn.ID) {
+		t.Errorf("Expected the connection ID to be left out of the logs, got %s", logs)
+	}
+	for _, path := range []string{`"path":"/v1/sessions/{id}/events"`, `"path":"/v1/sessions/{id}/messages"`} {
+		if !strings.Contains(logs, path) {
+			t.Errorf("Expected a record with %s, got %s", path, logs)
+		}
+	}
+}
+
+// TestSSEPendingLimit tests that a client cannot create connections without opening them beyond the pending limit
+func TestSSEPendingLimit(t *testing.T) {
+	httpServer := httptest.NewServer(New().Handler())
+	defer httpServer.Close()
+	// A connection whose stream is open is no longer pending.
+	c := dialSSE(t, httpServer.URL)
+	defer c.Close()
+
+	create := func() *http.Response {
+		resp, err := http.Post(httpServer.URL+"/v1/sessions", "application/json", nil)
+		if err != nil {
+			t.Fatalf("Failed to create connection: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for i := range sseMaxPending {
+		if resp := create(); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201 for pending connection %d, got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := create()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected status 429 with Retry-After beyond the limit, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,144 @@
+package srv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// MethodClientCert is reported on principals authenticated by a TLS client certificate.
+const MethodClientCert = "client_cert"
+
+// certCheckInterval bounds how often handshakes look for a rotated certificate.
+const certCheckInterval = time.Second
+
+// CertReloader serves a certificate and key pair from disk, picking up
+// rotated files on the next handshake. Established connections keep the
+// certificate they negotiated, so live sessions are not dropped.
+type CertReloader struct {
+	checked  time.Time
+	modified time.Time
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+}
+
+// NewCertReloader loads the key pair and returns a reloader for it.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the key pair from disk. On error the previous certificate stays in use.
+func (r *CertReloader) Reload() error {
+	modified, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modified = modified
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, fmt.Errorf("stat TLS file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	stale := time.Since(r.checked) >= certCheckInterval
+	if stale {
+		r.checked = time.Now()
+	}
+	modified := r.modified
+	r.mu.Unlock()
+
+	if stale {
+		// The cert and key are usually replaced one after the other, so a
+		// failed load is retried on a later handshake rather than reported.
+		if latest, err := r.lastModified(); err == nil && !latest.Equal(modified) {
+			if err := r.Reload(); err != nil {
+				slog.Warn("Keeping previous TLS certificate", "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// LoadClientCAs reads a PEM bundle of CA certificates trusted to issue client certificates.
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read client CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// TLSConfig returns a server TLS configuration serving certificates from r.
+// With a client CA pool, certificates signed by it are verified when
+// presented; ClientCertificates turns them into principals.
+func TLSConfig(r *CertReloader, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// ClientCertificates authenticates requests by their verified TLS client
+// certificate, using the subject common name as the principal ID.
+type ClientCertificates struct{}
+
+// Authenticate implements Authenticator.
+func (ClientCertificates) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrUnauthenticated
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	id := leaf.Subject.CommonName
+	if id == "" {
+		return nil, fmt.Errorf("client certificate %s has no common name", leaf.Subject)
+	}
+	return &Principal{ID: id, Method: MethodClientCert}, nil
+}
@@ -0,0 +1,195 @@
+package srv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// testCert is a generated certificate with its PEM encodings
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issueCert creates a certificate for template signed by parent, or self-signed if parent is nil
+func issueCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	return pair
+}
+
+// TestMutualTLS tests that a verified client certificate becomes the session principal
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverTemplate := func(name string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			DNSNames:    []string{"localhost"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	serverCert := issueCert(t, serverTemplate("first"), ca)
+	client := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing-service"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	files := map[string][]byte{certFile: serverCert.certPEM, keyFile: serverCert.keyPEM, caFile: ca.certPEM}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	pool, err := LoadClientCAs(caFile)
+	if err != nil {
+		t.Fatalf("Failed to load client CAs: %v", err)
+	}
+
+	server := New(WithAuthenticators(ClientCertificates{}))
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", TLSConfig(reloader, pool))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	httpServer := &http.Server{Handler: server.Handler(), ReadHeaderTimeout: time.Second}
+	go func() { _ = httpServer.Serve(listener) }()
+	defer httpServer.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	wsURL := "wss://localhost:" + port + "/v1/speak"
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) (net.Conn, *x509.Certificate, error) {
+		var state *tls.ConnectionState
+		dialer := ws.Dialer{TLSClient: func(conn net.Conn, hostname string) net.Conn {
+			tlsConn := tls.Client(conn, &tls.Config{
+				RootCAs:      roots,
+				Certificates: certs,
+				ServerName:   hostname,
+				MinVersion:   tls.VersionTLS12,
+			})
+			if err := tlsConn.Handshake(); err == nil {
+				cs := tlsConn.ConnectionState()
+				state = &cs
+			}
+			return tlsConn
+		}}
+		conn, _, _, err := dialer.Dial(context.Background(), wsURL)
+		if state == nil || len(state.PeerCertificates) == 0 {
+			return conn, nil, err
+		}
+		return conn, state.PeerCertificates[0], err
+	}
+
+	var status ws.StatusError
+	if _, _, err := dial(); !errors.As(err, &status) || int(status) != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a client certificate, got %v", err)
+	}
+
+	conn, _, err := dial(client.tlsCertificate(t))
+	if err != nil {
+		t.Fatalf("Failed to connect with client certificate: %v", err)
+	}
+	setupSession(t, conn)
+	sessions := server.Store.List()
+	if len(sessions) != 1 || sessions[0].Principal != "client_cert:billing-service" {
+		t.Errorf("Expected a session for billing-service, got %+v", sessions)
+	}
+
+	rotated := issueCert(t, serverTemplate("second"), ca)
+	if err := os.WriteFile(certFile, rotated.certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to rotate certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, rotated.keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	reloader.mu.Lock()
+	reloader.checked = time.Time{}
+	reloader.mu.Unlock()
+
+	second, peer, err := dial(client.tlsCertificate(t))
+	if err != nil {
+		t.Fatalf("Failed to connect after rotation: %v", err)
+	}
+	defer second.Close()
+	if peer == nil || peer.Subject.CommonName != "second" {
+		t.Errorf("Expected the rotated certificate to be served, got %v", peer)
+	}
+
+	defer conn.Close()
+	input := []byte(`{"type": "input_text", "text": "still here"}`)
+	if err := wsutil.WriteClientMessage(conn, ws.OpText, input); err != nil {
+		t.Fatalf("Failed to send text input: %v", err)
+	}
+	if msg, _, err := wsutil.ReadServerData(conn); err != nil || !strings.Contains(string(msg), "output_text") {
+		t.Errorf("Expected the existing session to survive rotation, got %s (%v)", msg, err)
+	}
+}
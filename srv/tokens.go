@@ -0,0 +1,192 @@
+package srv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MethodEphemeral is reported for principals authenticated with a minted client token.
+const MethodEphemeral = "ephemeral"
+
+const (
+	ephemeralKind       = "ephemeral"
+	defaultEphemeralTTL = time.Minute
+	maxEphemeralTTL     = 10 * time.Minute
+)
+
+// ephemeralClaims is the payload of a minted client token.
+type ephemeralClaims struct {
+	SessionConfig map[string]any `json:"sessionConfig,omitempty"`
+	Kind          string         `json:"kind"`
+	Model         string         `json:"model,omitempty"`
+	// User names the end user the token was minted for, if the minter
+	// named one.
+	User string `json:"usr,omitempty"`
+	Claims
+}
+
+// tokenRequest is the body of POST /v1/tokens.
+type tokenRequest struct {
+	SessionConfig map[string]any `json:"sessionConfig,omitempty"`
+	Model         string         `json:"model,omitempty"`
+	// User names the end user the token is for. Tokens minted for the
+	// same user may resume each other's sessions; without one, every
+	// token is a caller of its own.
+	User       string `json:"user,omitempty"`
+	TTLSeconds int    `json:"ttlSeconds,omitempty"`
+}
+
+// tokenResponse is returned by POST /v1/tokens.
+type tokenResponse struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+	Token     string    `json:"token"`
+}
+
+// EphemeralTokens mints and verifies short-lived, single-use client tokens.
+// Tokens are HMAC-signed so they can be verified without shared state; the
+// replay cache only remembers token IDs until they expire.
+type EphemeralTokens struct {
+	signer *HMACTokens
+	used   map[string]time.Time
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+// NewEphemeralTokens creates a token minter and authenticator using secret.
+func NewEphemeralTokens(secret []byte) *EphemeralTokens {
+	return &EphemeralTokens{
+		signer: NewHMACTokens(secret),
+		used:   make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Mint issues a token on behalf of subject for its end user, optionally
+// pinned to a model and session config.
+func (e *EphemeralTokens) Mint(
+	subject, user, model string, sessionConfig map[string]any, ttl time.Duration,
+) (string, time.Time, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", time.Time{}, err
+	}
+	now := e.now()
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+	token, err := e.signer.Sign(ephemeralClaims{
+		Claims: Claims{
+			Subject:   subject,
+			ID:        hex.EncodeToString(id),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+		Kind:          ephemeralKind,
+		User:          user,
+		Model:         model,
+		SessionConfig: sessionConfig,
+	})
+	return token, expiresAt, err
+}
+
+// Authenticate implements Authenticator. A token is accepted at most once.
+// Its principal is minter/user, or minter/token-id without a user: a browser
+// holding the token is not the backend that minted it, and must not share
+// its sessions or those of the backend's other users.
+func (e *EphemeralTokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := credential(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	var claims ephemeralClaims
+	if err := e.signer.Verify(token, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Kind != ephemeralKind || claims.ID == "" {
+		return nil, fmt.Errorf("%w: not an ephemeral token", ErrUnauthenticated)
+	}
+	now := e.now()
+	// Ephemeral tokens get no clock skew allowance so the replay cache can
+	// forget a token ID as soon as the token expires.
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if err := claims.validate(now, "", ""); err != nil {
+		return nil, err
+	}
+	if !e.consume(claims.ID, time.Unix(claims.ExpiresAt, 0), now) {
+		return nil, errors.New("token already used")
+	}
+	user := claims.User
+	if user == "" {
+		user = claims.ID
+	}
+	return &Principal{
+		ID:            claims.Subject + "/" + user,
+		Method:        MethodEphemeral,
+		Model:         claims.Model,
+		SessionConfig: claims.SessionConfig,
+	}, nil
+}
+
+// consume records id as used and reports whether it was unused before.
+func (e *EphemeralTokens) consume(id string, expiresAt, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for usedID, exp := range e.used {
+		if !now.Before(exp) {
+			delete(e.used, usedID)
+		}
+	}
+	if _, seen := e.used[id]; seen {
+		return false
+	}
+	e.used[id] = expiresAt
+	return true
+}
+
+// handleMintToken issues an ephemeral client token to a server-side caller.
+func (s *Server) handleMintToken(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "server-side credentials required", http.StatusUnauthorized)
+		return
+	}
+	if p.Method == MethodEphemeral {
+		http.Error(w, "ephemeral tokens cannot mint tokens", http.StatusForbidden)
+		return
+	}
+
+	var req tokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid token request", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultEphemeralTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxEphemeralTTL {
+		http.Error(w, fmt.Sprintf("ttlSeconds must be between 1 and %d", int(maxEphemeralTTL.Seconds())),
+			http.StatusBadRequest)
+		return
+	}
+
+	token, expiresAt, err := s.ephemeral.Mint(p.ID, req.User, req.Model, req.SessionConfig, ttl)
+	if err != nil {
+		s.logger.Error("Failed to mint token", "principal", p.ID, "error", err)
+		http.Error(w, "failed to mint token", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("Minted ephemeral token", "principal", p.ID, "model", req.Model, "expires", expiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(s.mustJSON(tokenResponse{Token: token, ExpiresAt: expiresAt}))
+}
@@ -0,0 +1,216 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// mintToken requests an ephemeral token using the given server-side key
+func mintToken(t *testing.T, baseURL, key, body string) (*http.Response, tokenResponse) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/tokens", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to call token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var token tokenResponse
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			t.Fatalf("Failed to decode token response: %v", err)
+		}
+	}
+	return resp, token
+}
+
+// TestEphemeralTokenSingleUse tests that minted tokens authenticate exactly once
+func TestEphemeralTokenSingleUse(t *testing.T) {
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"backend-key": "backend"})),
+		WithEphemeralTokens(NewEphemeralTokens([]byte("ephemeral-secret-ephemeral-secret"))),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+
+	resp, token := mintToken(t, httpServer.URL, "backend-key", `{"ttlSeconds": 30}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	if token.Token == "" || token.ExpiresAt.IsZero() {
+		t.Fatalf("Expected token and expiry, got %+v", token)
+	}
+
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+token.Token)
+	if err != nil {
+		t.Fatalf("Expected minted token to be accepted: %v", err)
+	}
+	defer conn.Close()
+	setupSession(t, conn)
+
+	if _, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+token.Token); err == nil {
+		t.Error("Expected replayed token to be rejected")
+	}
+
+	if resp, _ := mintToken(t, httpServer.URL, token.Token, `{}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected used token to be rejected by the token endpoint, got %d", resp.StatusCode)
+	}
+	if resp, _ := mintToken(t, httpServer.URL, "", `{}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without credentials, got %d", resp.StatusCode)
+	}
+	if resp, _ := mintToken(t, httpServer.URL, "backend-key", `{"ttlSeconds": 86400}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for excessive TTL, got %d", resp.StatusCode)
+	}
+}
+
+// TestEphemeralTokenCannotMint tests that ephemeral tokens cannot mint further tokens
+func TestEphemeralTokenCannotMint(t *testing.T) {
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"backend-key": "backend"})),
+		WithEphemeralTokens(NewEphemeralTokens([]byte("ephemeral-secret-ephemeral-secret"))),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	_, token := mintToken(t, httpServer.URL, "backend-key", `{}`)
+	if resp, _ := mintToken(t, httpServer.URL, token.Token, `{}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", resp.StatusCode)
+	}
+}
+
+// TestEphemeralTokenNotAdmin tests that a token minted by an admin's key cannot use the admin API
+func TestEphemeralTokenNotAdmin(t *testing.T) {
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"ops-key": "ops"})),
+		WithEphemeralTokens(NewEphemeralTokens([]byte("ephemeral-secret-ephemeral-secret"))),
+		WithAdmins("api_key:ops", "ephemeral:ops"),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	status := func(key string) int {
+		req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/v1/admin/sessions", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to call admin endpoint: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	_, token := mintToken(t, httpServer.URL, "ops-key", `{}`)
+	if got := status(token.Token); got != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a minted token, got %d", got)
+	}
+	if got := status("ops-key"); got != http.StatusOK {
+		t.Errorf("Expected status 200 for the admin's key, got %d", got)
+	}
+}
+
+// TestEphemeralTokenPinning tests that pinned model and session config are enforced at setup
+func TestEphemeralTokenPinning(t *testing.T) {
+	server := New(
+		WithAuthenticators(NewAPIKeys(map[string]string{"backend-key": "backend"})),
+		WithEphemeralTokens(NewEphemeralTokens([]byte("ephemeral-secret-ephemeral-secret"))),
+	)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	pinned := `{"model": "gemini-1.5-flash", "sessionConfig": {"temperature": 0.2}}`
+
+	tests := []struct {
+		setup        g.SetupRequestJson
+		name         string
+		expectedType string
+		expectedCode string
+	}{
+		{
+			name:         "Pinned model and config",
+			setup:        g.SetupRequestJson{Type: "setup", Model: "gemini-1.5-flash"},
+			expectedType: "session_resumption_update",
+		},
+		{
+			name:         "Different model",
+			setup:        g.SetupRequestJson{Type: "setup", Model: "gemini-1.5-pro"},
+			expectedType: "error",
+			expectedCode: "forbidden",
+		},
+		{
+			name: "Different session config",
+			setup: g.SetupRequestJson{
+				Type:          "setup",
+				Model:         "gemini-1.5-flash",
+				SessionConfig: map[string]interface{}{"temperature": 1.5},
+			},
+			expectedType: "error",
+			expectedCode: "forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, token := mintToken(t, httpServer.URL, "backend-key", pinned)
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL+"?access_token="+token.Token)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+
+			data, err := json.Marshal(tt.setup)
+			if err != nil {
+				t.Fatalf("Failed to marshal setup request: %v", err)
+			}
+			if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+				t.Fatalf("Failed to send setup message: %v", err)
+			}
+			msg, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatalf("Failed to read setup response: %v", err)
+			}
+
+			var resp g.ErrorJson
+			if err := json.Unmarshal(msg, &resp); err != nil && tt.expectedType == "error" {
+				t.Fatalf("Failed to unmarshal error response: %v", err)
+			}
+			var env envelope
+			if err := json.Unmarshal(msg, &env); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			if env.Type != tt.expectedType {
+				t.Errorf("Expected %s, got %s", tt.expectedType, msg)
+			}
+			if resp.Code != tt.expectedCode {
+				t.Errorf("Expected code %q, got %q", tt.expectedCode, resp.Code)
+			}
+		})
+	}
+
+	for _, sess := range server.Store.List() {
+		if !strings.HasPrefix(sess.Principal, "ephemeral:backend/") {
+			t.Errorf("Expected a session principal minted by backend, got %q", sess.Principal)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"jig.sx/twinspeak/pkg/session"
+)
+
+// tracerName identifies the spans of this package.
+const tracerName = "jig.sx/twinspeak/srv"
+
+// Span names of the stages of handling a message. Message spans are named
+// "twinspeak." plus the message type and parent the stages; they in turn are
+// children of the "twinspeak.session" span of the connection.
+const (
+	spanSession  = "twinspeak.session"
+	spanDecode   = "decode"
+	spanBackend  = "backend"
+	spanEncode   = "encode"
+	spanWrite    = "write"
+	spanToolCall = "tool_call"
+)
+
+// TracingConfig configures the export of OpenTelemetry traces.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP collector URL, for example
+	// http://localhost:4318; /v1/traces is used when it has no path.
+	// Tracing is disabled when it is empty.
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// SampleRatio is the fraction of new traces recorded. Traces started
+	// by the client are sampled as the client decided.
+	SampleRatio float64 `json:"sampleRatio" yaml:"sampleRatio"`
+}
+
+// Validate checks the endpoint URL and sample ratio.
+func (c TracingConfig) Validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1, got %g", c.SampleRatio)
+	}
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("tracing endpoint must be an http or https URL, got %q", c.Endpoint)
+	}
+	return nil
+}
+
+// NewTracerProvider returns a tracer provider exporting to the OTLP endpoint
+// of c, or nil if tracing is disabled. Callers must Shutdown the provider to
+// flush pending spans.
+func NewTracerProvider(ctx context.Context, c TracingConfig) (*sdktrace.TracerProvider, error) {
+	if c.Endpoint == "" {
+		return nil, nil
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(c.Endpoint)
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("twinspeak"))),
+	), nil
+}
+
+// WithTracerProvider records spans with tp instead of the global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// defaultTracer uses the global provider, which does nothing unless the
+// application installs one.
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// traceContext propagates W3C trace context and baggage from the upgrade
+// request, so a session joins the trace of the client that opened it.
+var traceContext = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// context returns the context of the message being handled on the
+// connection, or of the session between messages.
+func (c *clientConn) context() context.Context {
+	return *c.ctx.Load()
+}
+
+// setContext makes ctx the parent of spans started on the connection.
+func (c *clientConn) setContext(ctx context.Context) {
+	c.ctx.Store(&ctx)
+}
+
+// stage starts the span of a stage of handling the current message.
+func (s *Server) stage(conn *clientConn, name string) trace.Span {
+	_, span := s.tracer.Start(conn.context(), name)
+	return span
+}
+
+// sessionAttributes identify sess on the session span.
+func sessionAttributes(sess *session.Session) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("twinspeak.session.id", string(sess.ID)),
+		attribute.String("twinspeak.model", sess.Model),
+	}
+}
+
+// traceToolCall records the round trip of a tool call that was sent at sent.
+func (s *Server) traceToolCall(conn *clientConn, name, callID string, sent time.Time) {
+	_, span := s.tracer.Start(conn.context(), spanToolCall, trace.WithTimestamp(sent),
+		trace.WithAttributes(attribute.String("twinspeak.tool.name", name),
+			attribute.String("twinspeak.tool.call_id", callID)))
+	span.End()
+}
@@ -0,0 +1,84 @@
+package srv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestTracing tests that a session is traced under the client's trace context with a span per stage
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	server := New(WithTracerProvider(tp))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{
+		"Traceparent": []string{"00-" + traceID + "-00f067aa0ba902b7-01"},
+	})}
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := dialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	setupSession(t, conn)
+
+	for _, msg := range []string{`{"type": "input_text", "text": "hello"}`, `{"type": "end_session", "reason": "done"}`} {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte(msg)); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		if _, _, err := wsutil.ReadServerData(conn); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+	if _, _, err := wsutil.ReadServerData(conn); err == nil {
+		t.Fatal("Expected the server to close the connection after end_session")
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("Expected span %s in the client's trace, got %s", span.Name, span.SpanContext.TraceID())
+		}
+		byName[span.Name] = span
+	}
+
+	sessionSpan, ok := byName[spanSession]
+	if !ok {
+		t.Fatalf("Expected a session span, got %d spans", len(spans))
+	}
+	var model bool
+	for _, attr := range sessionSpan.Attributes {
+		model = model || attr.Key == "twinspeak.model" && attr.Value.AsString() == "gemini-1.5-flash"
+	}
+	if !model {
+		t.Errorf("Expected the model on the session span, got %v", sessionSpan.Attributes)
+	}
+
+	turn, ok := byName["twinspeak.input_text"]
+	if !ok || turn.Parent.SpanID() != sessionSpan.SpanContext.SpanID() {
+		t.Fatal("Expected the input_text span to be a child of the session span")
+	}
+	for _, stage := range []string{spanDecode, spanBackend, spanEncode, spanWrite} {
+		var found bool
+		for _, span := range spans {
+			found = found || span.Name == stage && span.Parent.SpanID() == turn.SpanContext.SpanID()
+		}
+		if !found {
+			t.Errorf("Expected a %s span within the input_text span", stage)
+		}
+	}
+}
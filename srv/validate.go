@@ -0,0 +1,161 @@
+package srv
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"jig.sx/twinspeak/pkg/model/schema"
+)
+
+// MessageLimits bounds the size and shape of inbound messages.
+type MessageLimits struct {
+	MaxFrameBytes int64 `json:"maxFrameBytes" yaml:"maxFrameBytes"`
+	MaxAudioBytes int   `json:"maxAudioBytes" yaml:"maxAudioBytes"`
+	MaxTextLength int   `json:"maxTextLength" yaml:"maxTextLength"`
+	MaxDepth      int   `json:"maxDepth" yaml:"maxDepth"`
+	MaxLogBytes   int64 `json:"maxLogBytes" yaml:"maxLogBytes"`
+}
+
+// DefaultMessageLimits are applied unless overridden with WithMessageLimits.
+var DefaultMessageLimits = MessageLimits{
+	MaxFrameBytes: 1 << 20,
+	MaxAudioBytes: 512 << 10,
+	MaxTextLength: 32 << 10,
+	MaxDepth:      32,
+	MaxLogBytes:   16 << 20,
+}
+
+// errTooDeep is returned by checkDepth for documents nested beyond the limit.
+var errTooDeep = errors.New("JSON nesting too deep")
+
+// ReadMessage reads the next data message, answering control frames on the
+// way. Frames and messages larger than the limit are rejected with
+// wsutil.ErrFrameTooLarge before their payload is read, and so are compressed
+// messages that inflate beyond it.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	limit := c.limit
+	for {
+		if err := c.extendDeadline(); err != nil {
+			return nil, err
+		}
+		hdr, err := c.reader.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := c.reader.OnIntermediate(hdr, c.reader); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(c.reader, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > limit {
+			return nil, wsutil.ErrFrameTooLarge
+		}
+		if d := c.deflate; d != nil && d.state.IsCompressed() {
+			compressed := len(data)
+			if data, err = d.inflate(data, limit, hdr.OpCode == ws.OpText); err != nil {
+				return nil, err
+			}
+			c.metrics.observeCompression(directionIn, len(data), compressed)
+		}
+		if hdr.OpCode != ws.OpText {
+			return data, ErrBinaryMessage
+		}
+		return data, nil
+	}
+}
+
+// checkDepth scans a JSON document without decoding it and fails if objects
+// or arrays nest deeper than limit.
+func checkDepth(data []byte, limit int) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > limit {
+				return errTooDeep
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// checkSchema validates a message against the schema of its type, which
+// catches what decoding into the generated types does not: patterns,
+// lengths and base64 content. The error names the path of the offending
+// value. Unknown types are left to handleMessage.
+func (s *Server) checkSchema(conn *clientConn, msgType string, msg []byte) bool {
+	err := schema.Validate(msgType, msg)
+	if err == nil || errors.Is(err, schema.ErrUnknownType) {
+		return true
+	}
+	var v *schema.Violation
+	if errors.As(err, &v) {
+		s.sendError(conn, badMessageCode(msgType), fmt.Sprintf("Message does not match the %s schema at %s", msgType, v))
+		return false
+	}
+	s.sendError(conn, badMessageCode(msgType), "Invalid JSON format")
+	return false
+}
+
+// checkOutbound logs a message the server is about to send that does not
+// match its schema. It is sent anyway: the client is owed a reply, and the
+// log is what points at the backend at fault.
+func (s *Server) checkOutbound(conn *clientConn, v any, data []byte) {
+	msgType := messageType(v)
+	if err := schema.Validate(msgType, data); err != nil {
+		conn.logger().Error("Sent message does not match its schema", "reply_type", msgType, "error", err)
+	}
+}
+
+// checkText rejects text longer than MaxTextLength characters.
+func (s *Server) checkText(conn *clientConn, text string) bool {
+	if n := utf8.RuneCountInString(text); n > s.messageLimits.MaxTextLength {
+		s.sendError(conn, "text_too_long",
+			fmt.Sprintf("Text of %d characters exceeds the limit of %d", n, s.messageLimits.MaxTextLength))
+		return false
+	}
+	return true
+}
+
+// checkAudio rejects audio chunks that would decode to more than MaxAudioBytes.
+func (s *Server) checkAudio(conn *clientConn, chunk string) bool {
+	if n := base64.StdEncoding.DecodedLen(len(chunk)); n > s.messageLimits.MaxAudioBytes {
+		s.sendError(conn, "audio_too_large",
+			fmt.Sprintf("Audio chunk of %d bytes exceeds the limit of %d", n, s.messageLimits.MaxAudioBytes))
+		return false
+	}
+	return true
+}
+
+// record appends a message of the given wire size to the session log,
+// reporting log_full once the session reaches MaxLogBytes.
+func (s *Server) record(conn *clientConn, message any, size int) bool {
+	if err := conn.sess.AppendSized(message, int64(size), s.messageLimits.MaxLogBytes); err != nil {
+		s.sendError(conn, "log_full", "Session log size limit reached")
+		return false
+	}
+	return true
+}
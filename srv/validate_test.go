@@ -0,0 +1,274 @@
+package srv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	g "jig.sx/twinspeak/pkg/model/gemini"
+)
+
+// TestMessageLimits tests that each inbound message limit yields its own error code
+func TestMessageLimits(t *testing.T) {
+	limits := MessageLimits{
+		MaxFrameBytes: 4096,
+		MaxAudioBytes: 64,
+		MaxTextLength: 10,
+		MaxDepth:      4,
+		MaxLogBytes:   2048,
+	}
+	deep := `{"type": "tool_result", "name": "t", "callId": "c", "result": {"a": {"b": {"c": {"d": 1}}}}}`
+
+	tests := []struct {
+		name         string
+		message      string
+		expectedCode string
+	}{
+		{
+			name:         "Text too long",
+			message:      `{"type": "input_text", "text": "more than ten characters"}`,
+			expectedCode: "text_too_long",
+		},
+		{
+			name:         "Text length counts characters",
+			message:      `{"type": "input_text", "text": "ääääääääää"}`,
+			expectedCode: "",
+		},
+		{
+			name: "Audio chunk too large",
+			message: `{"type": "input_audio", "format": "pcm16", "final": false, "chunk": "` +
+				base64.StdEncoding.EncodeToString(make([]byte, 65)) + `"}`,
+			expectedCode: "audio_too_large",
+		},
+		{
+			name:         "Result nested too deep",
+			message:      deep,
+			expectedCode: "too_deep",
+		},
+		{
+			name:         "Brackets inside strings do not count",
+			message:      `{"type": "input_text", "text": "[[[[[{{{{{"}`,
+			expectedCode: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := New(WithMessageLimits(limits))
+			httpServer := httptest.NewServer(server.Handler())
+			defer httpServer.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+
+			setupSession(t, conn)
+
+			if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte(tt.message)); err != nil {
+				t.Fatalf("Failed to send test message: %v", err)
+			}
+			msg, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			var resp g.ErrorJson
+			_ = json.Unmarshal(msg, &resp)
+			if resp.Code != tt.expectedCode {
+				t.Errorf("Expected code %q, got %q (%s)", tt.expectedCode, resp.Code, msg)
+			}
+		})
+	}
+}
+
+// TestFrameSizeLimit tests that oversized messages are rejected and the connection closed
+func TestFrameSizeLimit(t *testing.T) {
+	tests := []struct {
+		send func(conn net.Conn) error
+		name string
+	}{
+		{
+			name: "Single frame",
+			send: func(c net.Conn) error {
+				return wsutil.WriteClientMessage(c, ws.OpText, []byte(strings.Repeat(" ", 2048)))
+			},
+		},
+		{
+			name: "Fragmented message",
+			send: func(c net.Conn) error {
+				chunk := []byte(strings.Repeat(" ", 600))
+				for i := 0; i < 4; i++ {
+					op := ws.OpContinuation
+					if i == 0 {
+						op = ws.OpText
+					}
+					frame := ws.MaskFrame(ws.NewFrame(op, i == 3, chunk))
+					if err := ws.WriteFrame(c, frame); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := New(WithMessageLimits(MessageLimits{MaxFrameBytes: 1024}))
+			httpServer := httptest.NewServer(server.Handler())
+			defer httpServer.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+
+			if err := tt.send(conn); err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+
+			msg, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatalf("Failed to read error response: %v", err)
+			}
+			var errorResp g.ErrorJson
+			if err := json.Unmarshal(msg, &errorResp); err != nil {
+				t.Fatalf("Failed to unmarshal error response: %v", err)
+			}
+			if errorResp.Code != "frame_too_large" {
+				t.Errorf("Expected frame_too_large error code, got %s", errorResp.Code)
+			}
+
+			_, _, err = wsutil.ReadServerData(conn)
+			var closed wsutil.ClosedError
+			if !errors.As(err, &closed) || closed.Code != ws.StatusMessageTooBig {
+				t.Errorf("Expected close code %d, got %v", ws.StatusMessageTooBig, err)
+			}
+		})
+	}
+}
+
+// TestSessionLogLimit tests that messages beyond the session log size are refused
+func TestSessionLogLimit(t *testing.T) {
+	server := New(WithMessageLimits(MessageLimits{MaxLogBytes: 200}))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	setupSession(t, conn)
+
+	data, _ := json.Marshal(g.ClientInputTextJson{Type: "input_text", Text: strings.Repeat("x", 60)})
+	codes := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		if err := wsutil.WriteClientMessage(conn, ws.OpText, data); err != nil {
+			t.Fatalf("Failed to send text input: %v", err)
+		}
+		msg, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		var resp g.ErrorJson
+		_ = json.Unmarshal(msg, &resp)
+		codes = append(codes, resp.Code)
+	}
+
+	if codes[0] != "" || codes[2] != "log_full" {
+		t.Errorf("Expected the log to fill up, got codes %q", codes)
+	}
+}
+
+// TestSchemaViolations tests that messages breaking their schema are refused with the path of the offending value
+func TestSchemaViolations(t *testing.T) {
+	tests := []struct {
+		name         string
+		message      string
+		expectedCode string
+		expectedPath string
+	}{
+		{
+			name:         "Audio chunk not base64",
+			message:      `{"type": "input_audio", "format": "wav", "chunk": "not base64!", "final": true}`,
+			expectedCode: "bad_json",
+			expectedPath: "/chunk",
+		},
+		{
+			name:         "Tool name pattern",
+			message:      `{"type": "tool_result", "name": "no spaces", "callId": "c", "result": {}}`,
+			expectedCode: "bad_json",
+			expectedPath: "/name",
+		},
+		{
+			name:         "Unknown field",
+			message:      `{"type": "end_session", "reason": "done", "extra": true}`,
+			expectedCode: "bad_json",
+			expectedPath: "/",
+		},
+		{
+			name:         "Duplicate setup with empty model",
+			message:      `{"type": "setup", "model": ""}`,
+			expectedCode: "bad_setup",
+			expectedPath: "/model",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(New().Handler())
+			defer httpServer.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/v1/speak"
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), wsURL)
+			if err != nil {
+				t.Fatalf("Failed to connect to WebSocket: %v", err)
+			}
+			defer conn.Close()
+
+			setupSession(t, conn)
+
+			if err := wsutil.WriteClientMessage(conn, ws.OpText, []byte(tt.message)); err != nil {
+				t.Fatalf("Failed to send test message: %v", err)
+			}
+			msg, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			var resp g.ErrorJson
+			if err := json.Unmarshal(msg, &resp); err != nil {
+				t.Fatalf("Failed to unmarshal error response: %v", err)
+			}
+			if resp.Code != tt.expectedCode || !strings.Contains(resp.Message, " at "+tt.expectedPath+":") {
+				t.Errorf("Expected %s at %s, got %s: %s", tt.expectedCode, tt.expectedPath, resp.Code, resp.Message)
+			}
+		})
+	}
+}
+
+// TestOutboundValidation tests that the echo backend's replies pass outbound validation
+func TestOutboundValidation(t *testing.T) {
+	_, records := converse(t, WithOutboundValidation())
+	for _, r := range records {
+		if r["level"] == "ERROR" {
+			t.Errorf("Expected no errors, got %v", r)
+		}
+	}
+}
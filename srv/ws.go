@@ -3,91 +3,384 @@ package srv
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	g "jig.sx/twinspeak/pkg/model/gemini"
+	"jig.sx/twinspeak/pkg/recording"
 	"jig.sx/twinspeak/pkg/session"
 )
 
+// Subprotocol is the WebSocket subprotocol selected when a client offers it.
+const Subprotocol = "twinspeak"
+
 // envelope represents the message envelope for type-based routing
 type envelope struct {
 	Type string `json:"type"`
 }
 
+// clientConn carries the state of a single client connection, whatever its
+// transport. Writes may come from Shutdown as well as the connection's own
+// goroutine, so every message is written under writeMu; turn is held while a
+// message is being handled.
+type clientConn struct {
+	transport Conn
+	principal *Principal
+	sess      *session.Session
+	quota     *quota
+	// base carries the connection's principal; log adds the session and
+	// the message being handled and is read by Shutdown as well.
+	base *slog.Logger
+	log  atomic.Pointer[slog.Logger]
+	// version and capabilities are negotiated by setup.
+	version      version
+	capabilities []string
+	// turnID numbers the turns of the connection; it advances once the
+	// final input of a turn has been answered.
+	turnID int
+	// span is the session span; sessionCtx carries it and ctx the span of
+	// the message being handled.
+	span       trace.Span
+	sessionCtx context.Context
+	ctx        atomic.Pointer[context.Context]
+	// turnStart and pendingCalls time turns and tool calls for metrics
+	// and are guarded by writeMu.
+	turnStart    time.Time
+	pendingCalls map[string]time.Time
+	// sessionEnd is when the maximum session duration is used up, if
+	// there is one.
+	sessionEnd time.Time
+	// recorder archives the frames of a recorded session and is used by
+	// Shutdown as well.
+	recorder atomic.Pointer[recording.Writer]
+	// closeSent is set once the connection was closed by either side's
+	// initiative and is guarded by writeMu.
+	closeSent bool
+	writeMu   sync.Mutex
+	turn      sync.Mutex
+	closing   atomic.Bool
+}
+
+// offeredProtocol picks the subprotocol to select for r: Subprotocol if the
+// client offered it, else the credential of a browser that offered only a
+// bearer. protocol, as browsers fail a handshake that selects none of the
+// protocols they offered. It is empty if the client offered neither.
+func offeredProtocol(r *http.Request) string {
+	selected := ""
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, proto := range strings.Split(h, ",") {
+			proto = strings.TrimSpace(proto)
+			if proto == Subprotocol {
+				return proto
+			}
+			if selected == "" && strings.HasPrefix(proto, bearerProtocolPrefix) {
+				selected = proto
+			}
+		}
+	}
+	return selected
+}
+
 // handleSpeakWS handles WebSocket upgrade and message processing
 func (s *Server) handleSpeakWS(w http.ResponseWriter, r *http.Request) {
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if s.draining.Load() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	c, err := s.upgrade(w, r)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		s.logger.Warn("WebSocket upgrade failed", "error", err, "remote", r.RemoteAddr)
 		return
 	}
+	s.ServeConn(r, c)
+}
+
+// ServeConn runs the protocol on c until either side ends it, and closes
+// c. It registers the connection with the server, so that Shutdown drains
+// it, and holds a session slot of the client's limits for it. r is the
+// request that opened the connection: its context carries the principal,
+// its header the trace context, and its RemoteAddr identifies clients
+// without a principal to the limits. Serving stops with its context.
+func (s *Server) ServeConn(r *http.Request, c Conn) {
+	conn := &clientConn{transport: c, turnID: 1}
+	conn.principal, _ = PrincipalFromContext(r.Context())
+	conn.base = s.logger.With("principal", principalName(conn.principal), "remote", r.RemoteAddr)
+	conn.annotate("")
+	conn.sessionCtx, conn.span = s.tracer.Start(
+		traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), spanSession,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("twinspeak.principal", principalName(conn.principal))))
+	defer conn.span.End()
+	conn.setContext(conn.sessionCtx)
 	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("Error closing WebSocket connection: %v", err)
+		if err := conn.transport.Close(); err != nil {
+			conn.logger().Warn("Failed to close connection", "error", err)
 		}
 	}()
 
+	if !s.register(conn) {
+		s.closeWith(conn, closeShutdown)
+		return
+	}
+	defer s.unregister(conn)
+	// The archive is complete by the time Shutdown sees the connection gone.
+	defer s.stopRecording(conn)
+	s.reapSessions()
+
+	key, principalID := limitKey(r)
+	q, limits, ok := s.limiter.acquire(key, principalID)
+	if !ok {
+		conn.logger().Warn("Rejecting connection: too many concurrent sessions", "max_sessions", limits.MaxSessions)
+		s.rateLimited(conn, "Too many concurrent sessions")
+		return
+	}
+	defer s.limiter.release(q)
+	conn.quota = q
+	if d := time.Duration(limits.MaxSessionDuration); d > 0 {
+		conn.endSession(time.Now().Add(d))
+		if conn.closing.Load() {
+			// Shutdown interrupted the connection, whose deadline this undid.
+			return
+		}
+	}
+
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
+	if s.keepalive.PingInterval > 0 {
+		pinged := make(chan struct{})
+		go func() {
+			defer close(pinged)
+			s.ping(ctx, conn)
+		}()
+		// The transport may not be written to once ServeConn returns,
+		// as an event stream's response is then finished.
+		defer func() {
+			cancel()
+			<-pinged
+		}()
+	}
+	s.serve(ctx, conn)
+}
 
-	var sess *session.Session
-	var sessionID session.ID
+// wsConn adapts a WebSocket connection to Conn. It answers control frames
+// itself and keeps the read deadline within PingInterval plus PongTimeout
+// of the last frame, so that a client that stops answering pings is timed
+// out.
+type wsConn struct {
+	net.Conn
+	reader  *wsutil.Reader
+	control wsutil.FrameHandlerFunc
+	limit   int64
+	// deflate is set if the client negotiated permessage-deflate.
+	deflate      *deflater
+	metrics      *metrics
+	writeTimeout time.Duration
+	// alive is PingInterval plus PongTimeout, or zero without pings.
+	// deadline is the read deadline set with SetReadDeadline, which the
+	// one of the socket never exceeds, and aliveUntil when the client
+	// has to send its next frame; both are guarded by deadlineMu.
+	alive      time.Duration
+	deadline   time.Time
+	aliveUntil time.Time
+	deadlineMu sync.Mutex
+	// closeSent is set once a close frame was sent, by either side's
+	// initiative; it and every write are guarded by writeMu, as control
+	// frames are answered while ServeConn writes.
+	closeSent bool
+	writeMu   sync.Mutex
+}
 
+// upgrade switches r to the WebSocket protocol, negotiating
+// permessage-deflate if it is enabled, and sets up reading from it.
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	var u ws.HTTPUpgrader
+	if selected := offeredProtocol(r); selected != "" {
+		u.Protocol = func(proto string) bool { return proto == selected }
+	}
+	var ext *wsflate.Extension
+	if s.compression.Enabled {
+		ext = s.compression.extension()
+		u.Negotiate = ext.Negotiate
+	}
+	netConn, rw, _, err := u.Upgrade(r, w)
+	if err != nil {
+		return nil, err
+	}
+	c := &wsConn{
+		Conn:         netConn,
+		limit:        s.messageLimits.MaxFrameBytes,
+		metrics:      s.metrics,
+		writeTimeout: time.Duration(s.keepalive.WriteTimeout),
+	}
+	if k := s.keepalive; k.PingInterval > 0 {
+		c.alive = time.Duration(k.PingInterval + k.PongTimeout)
+	}
+	var source io.Reader = netConn
+	if rw != nil {
+		source = rw.Reader
+	}
+	c.control = wsutil.ControlFrameHandler(c, ws.StateServerSide)
+	c.reader = &wsutil.Reader{
+		Source:         source,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		MaxFrameSize:   s.messageLimits.MaxFrameBytes,
+		OnIntermediate: c.handleControl,
+	}
+	if ext != nil {
+		if _, ok := ext.Accepted(); ok {
+			s.acceptCompression(c)
+		}
+	}
+	return c, nil
+}
+
+// serve reads and processes the messages of conn until it is closed or ctx
+// is done. A panic while serving sends an internal error close frame on its
+// way to the recoverer.
+func (s *Server) serve(ctx context.Context, conn *clientConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.closeWith(conn, closeInternalError)
+			panic(r)
+		}
+	}()
 	for {
 		select {
 		case <-ctx.Done():
+			s.closeWith(conn, closeShutdown)
 			return
 		default:
 		}
 
-		msg, op, err := wsutil.ReadClientData(conn)
+		msg, err := conn.transport.ReadMessage()
+		op := ws.OpText
+		if errors.Is(err, ErrBinaryMessage) {
+			op, err = ws.OpBinary, nil
+		}
 		if err != nil {
-			log.Printf("Failed to read WebSocket message: %v", err)
+			s.readFailed(conn, err)
 			return
 		}
 
-		if op != ws.OpText {
-			s.sendError(conn, "bad_json", "Only text messages are supported")
-			continue
+		if s.processMessage(conn, msg, op) {
+			return
 		}
+	}
+}
 
-		var env envelope
-		if err := json.Unmarshal(msg, &env); err != nil {
-			s.sendError(conn, "bad_json", "Invalid JSON format")
-			continue
-		}
+// processMessage handles one inbound message as a turn and returns true if
+// the connection should be closed. A connection closed by Shutdown while the
+// message was read is not processed.
+func (s *Server) processMessage(conn *clientConn, msg []byte, op ws.OpCode) bool {
+	conn.turn.Lock()
+	defer conn.turn.Unlock()
+	if conn.closing.Load() {
+		return true
+	}
+	s.recordFrame(conn, recording.Inbound, msg, op)
+	defer conn.annotate("")
+	ctx, span := s.tracer.Start(conn.sessionCtx, "twinspeak.message")
+	defer span.End()
+	conn.setContext(ctx)
+	defer conn.setContext(conn.sessionCtx)
+
+	if !s.limiter.allowMessage(conn.quota) {
+		conn.logger().Warn("Closing connection: message rate exceeded")
+		s.rateLimited(conn, "Message rate exceeded")
+		return true
+	}
 
-		shouldReturn := s.handleMessage(conn, env.Type, msg, &sess, &sessionID)
-		if shouldReturn {
-			return
-		}
+	if op != ws.OpText {
+		s.sendError(conn, "bad_json", "Only text messages are supported")
+		return false
+	}
+
+	if err := checkDepth(msg, s.messageLimits.MaxDepth); err != nil {
+		s.sendError(conn, "too_deep", fmt.Sprintf("Message nesting exceeds depth %d", s.messageLimits.MaxDepth))
+		return false
+	}
+
+	var env envelope
+	if err := s.decode(conn, msg, &env); err != nil {
+		s.sendError(conn, "bad_json", "Invalid JSON format")
+		return false
 	}
+	s.metrics.messagesIn.WithLabelValues(inboundType(env.Type)).Inc()
+	span.SetName("twinspeak." + inboundType(env.Type))
+	span.SetAttributes(attribute.Int("twinspeak.turn_id", conn.turnID))
+	conn.annotate(inboundType(env.Type))
+	conn.logger().Debug("Received message", "payload", s.payload(msg))
+
+	if !s.checkSchema(conn, env.Type, msg) {
+		return false
+	}
+	return s.handleMessage(conn, env.Type, msg)
 }
 
-// writeJSON writes a JSON message to the WebSocket connection
-func (s *Server) writeJSON(conn net.Conn, v any) error {
+// writeJSON writes a JSON message to the client of conn
+func (s *Server) writeJSON(conn *clientConn, v any) error {
+	encode := s.stage(conn, spanEncode)
 	data := s.mustJSON(v)
-	return wsutil.WriteServerMessage(conn, ws.OpText, data)
+	encode.End()
+	if s.checkReplies {
+		s.checkOutbound(conn, v, data)
+	}
+
+	write := s.stage(conn, spanWrite)
+	defer write.End()
+	s.metrics.writeQueueDepth.Inc()
+	conn.writeMu.Lock()
+	s.metrics.writeQueueDepth.Dec()
+	defer conn.writeMu.Unlock()
+	if err := conn.transport.WriteMessage(data); err != nil {
+		write.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	s.recordFrame(conn, recording.Outbound, data, ws.OpText)
+	msgType := messageType(v)
+	s.metrics.observeOutput(conn, msgType, v)
+	conn.logger().Debug("Sent message", "reply_type", msgType, "payload", s.payload(v))
+	return nil
 }
 
 // sendError sends a structured error message to the client
-func (s *Server) sendError(conn net.Conn, code, message string) {
+func (s *Server) sendError(conn *clientConn, code, message string) {
+	s.metrics.errors.WithLabelValues(code).Inc()
+	trace.SpanFromContext(conn.context()).SetStatus(codes.Error, code)
 	errorMsg := g.ErrorJson{
-		Type:    "error",
+		Type:    g.TypeError,
 		Code:    code,
 		Message: message,
 	}
 	if err := s.writeJSON(conn, errorMsg); err != nil {
-		log.Printf("Failed to send error message: %v", err)
+		conn.logger().Warn("Failed to send error message", "code", code, "error", err)
 	}
 }
 
+// rateLimited reports an exceeded limit to the client and closes the connection
+func (s *Server) rateLimited(conn *clientConn, message string) {
+	s.sendError(conn, "rate_limited", message)
+	s.closeWith(conn, closeRateLimited)
+}
+
 // ensure panics if the error is not nil
 func (s *Server) ensure(err error) {
 	if err != nil {
@@ -95,6 +388,13 @@ func (s *Server) ensure(err error) {
 	}
 }
 
+// decode unmarshals msg into v within a decode span
+func (s *Server) decode(conn *clientConn, msg []byte, v any) error {
+	span := s.stage(conn, spanDecode)
+	defer span.End()
+	return json.Unmarshal(msg, v)
+}
+
 // mustJSON marshals v to JSON, panicking on error
 func (s *Server) mustJSON(v any) []byte {
 	data, err := json.Marshal(v)
@@ -102,158 +402,274 @@ func (s *Server) mustJSON(v any) []byte {
 	return data
 }
 
-// handleMessage processes different message types and returns true if the connection should be closed
-func (s *Server) handleMessage(
-	conn net.Conn, msgType string, msg []byte, sess **session.Session, sessionID *session.ID,
-) bool {
-	switch msgType {
-	case "setup":
-		return s.handleSetup(conn, msg, sess, sessionID)
-	case "input_text":
-		return s.handleInputText(conn, msg, *sess)
-	case "input_audio":
-		return s.handleInputAudio(conn, msg, *sess)
-	case "tool_result":
-		return s.handleToolResult(conn, msg, *sess)
-	case "end_session":
-		return s.handleEndSession(conn, msg, *sess, *sessionID)
-	default:
+// handleMessage decodes a message into its generated type and dispatches it
+// to the clientHandler method for the type. It returns true if the
+// connection should be closed.
+func (s *Server) handleMessage(conn *clientConn, msgType string, data []byte) bool {
+	decode := s.stage(conn, spanDecode)
+	msg, err := g.DecodeClient(msgType, data)
+	decode.End()
+	if errors.Is(err, g.ErrUnknownType) {
 		s.sendError(conn, "unknown_type", fmt.Sprintf("Unknown message type: %s", msgType))
 		return false
 	}
+	if err != nil {
+		s.sendError(conn, badMessageCode(msgType), fmt.Sprintf("Invalid %s message format", msgType))
+		return false
+	}
+	return g.DispatchClient[inbound](clientHandler{s}, inbound{conn: conn, data: data}, msg)
 }
 
-// handleSetup processes setup messages
-func (s *Server) handleSetup(conn net.Conn, msg []byte, sess **session.Session, sessionID *session.ID) bool {
-	if *sess != nil {
+// badMessageCode is the error code for a malformed message of msgType.
+func badMessageCode(msgType string) string {
+	if msgType == g.TypeSetupRequest {
+		return "bad_setup"
+	}
+	return "bad_json"
+}
+
+// inbound is a client message on its way to a clientHandler method.
+type inbound struct {
+	conn *clientConn
+	// data is the message as received, for recording and size accounting.
+	data []byte
+}
+
+// clientHandler implements g.ClientHandler with the echo backend.
+type clientHandler struct {
+	*Server
+}
+
+// SetupRequest processes setup messages
+func (s clientHandler) SetupRequest(in inbound, setupReq g.SetupRequestJson) bool {
+	conn, msg := in.conn, in.data
+	if conn.sess != nil {
 		s.sendError(conn, "already_setup", "Session already configured")
 		return false
 	}
-
-	var setupReq g.SetupRequestJson
-	if err := json.Unmarshal(msg, &setupReq); err != nil {
-		s.sendError(conn, "bad_setup", "Invalid setup request format")
+	if err := s.negotiate(conn, setupReq); err != nil {
+		s.sendError(conn, "bad_setup", fmt.Sprintf("Protocol negotiation failed: %v", err))
 		return false
 	}
 
-	*sess = session.NewSession(setupReq.Model)
-	(*sess).State = session.StateConfigured
-	(*sess).ResumptionHandle = fmt.Sprintf("session_%s", (*sess).ID)
-	*sessionID = (*sess).ID
+	if p := conn.principal; p != nil {
+		if p.Model != "" && setupReq.Model != p.Model {
+			s.sendError(conn, "forbidden", fmt.Sprintf("Credentials do not permit model %s", setupReq.Model))
+			return false
+		}
+		if p.SessionConfig != nil {
+			if setupReq.SessionConfig != nil && !reflect.DeepEqual(setupReq.SessionConfig, p.SessionConfig) {
+				s.sendError(conn, "forbidden", "Session configuration is locked by credentials")
+				return false
+			}
+			setupReq.SessionConfig = p.SessionConfig
+		}
+	}
+
+	if h := setupReq.ResumptionHandle; h != nil && *h != "" {
+		sess := s.resumable(conn, *h, setupReq.Model)
+		if sess == nil {
+			return false
+		}
+		_ = sess.AppendSized(setupReq, int64(len(msg)), 0)
+		s.startRecording(conn, sess, setupReq, msg)
+		s.metrics.sessionsResumed.Inc()
+		conn.annotate("setup")
+		conn.span.SetAttributes(sessionAttributes(sess)...)
+		conn.logger().Info("Session resumed")
+		return s.completeSetup(conn, sess)
+	}
+
+	sess := session.NewSession(setupReq.Model)
+	sess.State = session.StateConfigured
+	sess.ResumptionHandle = fmt.Sprintf("session_%s", sess.ID)
+	sess.Deadline = conn.sessionEnd
+	if conn.principal != nil {
+		sess.Principal = conn.principal.Identity()
+	}
+	s.attach(conn, sess)
+
+	s.Store.Put(sess)
+	_ = sess.AppendSized(setupReq, int64(len(msg)), 0)
+	s.startRecording(conn, sess, setupReq, msg)
+	s.metrics.sessionsCreated.Inc()
+	conn.annotate("setup")
+	conn.span.SetAttributes(sessionAttributes(sess)...)
+	conn.logger().Info("Session configured")
+	return s.completeSetup(conn, sess)
+}
 
-	s.Store.Put(*sess)
-	(*sess).Append(setupReq)
+// resumable attaches the detached session identified by handle to conn. It
+// reports an error and returns nil if the handle is unknown, belongs to
+// another principal or model, or is in use by a live connection.
+func (s *Server) resumable(conn *clientConn, handle, model string) *session.Session {
+	var principal string
+	if conn.principal != nil {
+		principal = conn.principal.Identity()
+	}
+	sess, ok := s.Store.FindByHandle(handle)
+	if !ok || sess.CurrentState() == session.StateClosed || sess.Principal != principal {
+		s.sendError(conn, "invalid_handle", "Unknown or expired resumption handle")
+		return nil
+	}
+	if sess.Model != model {
+		s.sendError(conn, "bad_setup", fmt.Sprintf("Resumed session uses model %s", sess.Model))
+		return nil
+	}
+	if !sess.Deadline.IsZero() && !time.Now().Before(sess.Deadline) {
+		conn.logger().Warn("Refusing resumption: maximum session duration reached")
+		s.rateLimited(conn, "Maximum session duration reached")
+		return nil
+	}
+	if !s.attach(conn, sess) {
+		s.sendError(conn, "invalid_handle", "Session is in use by another connection")
+		return nil
+	}
+	if !sess.Deadline.IsZero() && (conn.sessionEnd.IsZero() || sess.Deadline.Before(conn.sessionEnd)) {
+		// The session's clock kept running while it was detached.
+		conn.endSession(sess.Deadline)
+	}
+	return sess
+}
 
+// sendResumptionUpdate sends the resumption handle of sess to the client
+func (s *Server) sendResumptionUpdate(conn *clientConn, sess *session.Session) bool {
 	resumptionUpdate := g.SessionResumptionUpdateJson{
-		Type:   "session_resumption_update",
-		Handle: (*sess).ResumptionHandle,
+		Type:   g.TypeSessionResumptionUpdate,
+		Handle: sess.ResumptionHandle,
 	}
 	if err := s.writeJSON(conn, resumptionUpdate); err != nil {
-		log.Printf("Failed to send resumption update: %v", err)
+		conn.logger().Warn("Failed to send resumption update", "error", err)
 		return true
 	}
 	return false
 }
 
-// handleInputText processes text input messages
-func (s *Server) handleInputText(conn net.Conn, msg []byte, sess *session.Session) bool {
+// ClientInputText processes text input messages
+func (s clientHandler) ClientInputText(in inbound, textInput g.ClientInputTextJson) bool {
+	conn, msg := in.conn, in.data
+	sess := conn.sess
 	if sess == nil {
 		s.sendError(conn, "no_session", "No active session")
 		return false
 	}
 
-	var textInput g.ClientInputTextJson
-	if err := json.Unmarshal(msg, &textInput); err != nil {
-		s.sendError(conn, "bad_json", "Invalid text input format")
+	if !s.checkText(conn, textInput.Text) || !s.record(conn, textInput, len(msg)) {
 		return false
 	}
-
-	sess.State = session.StateActive
-	sess.Append(textInput)
-
-	echoResponse := g.ServerOutputTextJson{
-		Type:  "output_text",
-		Text:  fmt.Sprintf("[echo] %s", textInput.Text),
-		Final: true,
+	sess.SetState(session.StateActive)
+	s.metrics.startTurn(conn)
+
+	backend := s.stage(conn, spanBackend)
+	reply := fmt.Sprintf("[echo] %s", textInput.Text)
+	deltas := []string{reply}
+	if conn.has(CapabilityStreamingDeltas) {
+		deltas = strings.SplitAfter(reply, " ")
 	}
-	if err := s.writeJSON(conn, echoResponse); err != nil {
-		log.Printf("Failed to send echo response: %v", err)
-		return true
+	backend.End()
+	for i, delta := range deltas {
+		echoResponse := g.ServerOutputTextJson{
+			Type:  g.TypeServerOutputText,
+			Text:  delta,
+			Final: i == len(deltas)-1,
+		}
+		if err := s.writeJSON(conn, echoResponse); err != nil {
+			conn.logger().Warn("Failed to send echo response", "error", err)
+			return true
+		}
 	}
+	conn.turnID++
 	return false
 }
 
-// handleInputAudio processes audio input messages
-func (s *Server) handleInputAudio(conn net.Conn, msg []byte, sess *session.Session) bool {
+// ClientInputAudio processes audio input messages
+func (s clientHandler) ClientInputAudio(in inbound, audioInput g.ClientInputAudioJson) bool {
+	conn, msg := in.conn, in.data
+	sess := conn.sess
 	if sess == nil {
 		s.sendError(conn, "no_session", "No active session")
 		return false
 	}
 
-	var audioInput g.ClientInputAudioJson
-	if err := json.Unmarshal(msg, &audioInput); err != nil {
-		s.sendError(conn, "bad_json", "Invalid audio input format")
+	if !s.checkAudio(conn, audioInput.Chunk) {
 		return false
 	}
+	seconds := audioSeconds(audioInput.Format, audioInput.Chunk)
+	if !s.limiter.allowAudio(conn.quota, seconds) {
+		conn.logger().Warn("Closing session: audio quota exceeded")
+		s.rateLimited(conn, "Audio quota exceeded")
+		return true
+	}
 
-	sess.State = session.StateActive
-	sess.Append(audioInput)
+	if !s.record(conn, audioInput, len(msg)) {
+		return false
+	}
+	sess.SetState(session.StateActive)
+	s.metrics.audioSeconds.WithLabelValues(string(audioInput.Format)).Add(seconds)
+	if audioInput.Final {
+		s.metrics.startTurn(conn)
+	}
 
+	backend := s.stage(conn, spanBackend)
 	ackResponse := g.ServerOutputTextJson{
-		Type:  "output_text",
+		Type:  g.TypeServerOutputText,
 		Text:  fmt.Sprintf("Received audio chunk in %s format (final: %t)", audioInput.Format, audioInput.Final),
 		Final: true,
 	}
+	backend.End()
 	if err := s.writeJSON(conn, ackResponse); err != nil {
-		log.Printf("Failed to send ack response: %v", err)
+		conn.logger().Warn("Failed to send ack response", "error", err)
 		return true
 	}
+	if audioInput.Final {
+		conn.turnID++
+	}
 	return false
 }
 
-// handleToolResult processes tool result messages
-func (s *Server) handleToolResult(conn net.Conn, msg []byte, sess *session.Session) bool {
+// ToolResult processes tool result messages
+func (s clientHandler) ToolResult(in inbound, toolResult g.ToolResultJson) bool {
+	conn, msg := in.conn, in.data
+	sess := conn.sess
 	if sess == nil {
 		s.sendError(conn, "no_session", "No active session")
 		return false
 	}
 
-	var toolResult g.ToolResultJson
-	if err := json.Unmarshal(msg, &toolResult); err != nil {
-		s.sendError(conn, "bad_json", "Invalid tool result format")
+	if !s.record(conn, toolResult, len(msg)) {
 		return false
 	}
-
-	sess.Append(toolResult)
+	if sent, ok := s.metrics.finishToolCall(conn, toolResult.CallId); ok {
+		s.traceToolCall(conn, toolResult.Name, toolResult.CallId, sent)
+	}
 	return false
 }
 
-// handleEndSession processes session end messages
-func (s *Server) handleEndSession(conn net.Conn, msg []byte, sess *session.Session, sessionID session.ID) bool {
+// SessionEnd processes session end messages
+func (s clientHandler) SessionEnd(in inbound, endSession g.SessionEndJson) bool {
+	conn, msg := in.conn, in.data
+	sess := conn.sess
 	if sess == nil {
 		s.sendError(conn, "no_session", "No active session")
 		return false
 	}
 
-	var endSession g.SessionEndJson
-	if err := json.Unmarshal(msg, &endSession); err != nil {
-		s.sendError(conn, "bad_json", "Invalid session end format")
-		return false
-	}
-
-	sess.State = session.StateClosing
-	sess.Append(endSession)
+	sess.SetState(session.StateClosing)
+	_ = sess.AppendSized(endSession, int64(len(msg)), 0)
 
 	goodbyeResponse := g.ServerOutputTextJson{
-		Type:  "output_text",
+		Type:  g.TypeServerOutputText,
 		Text:  "Goodbye! Session ended.",
 		Final: true,
 	}
 	if err := s.writeJSON(conn, goodbyeResponse); err != nil {
-		log.Printf("Failed to send goodbye response: %v", err)
+		conn.logger().Warn("Failed to send goodbye response", "error", err)
 	}
 
-	sess.State = session.StateClosed
-	s.Store.Delete(sessionID)
+	sess.SetState(session.StateClosed)
+	s.Store.Delete(sess.ID)
+	s.metrics.sessionsEnded.Inc()
+	conn.logger().Info("Session ended")
+	s.closeWith(conn, closeSessionEnded)
 	return true
 }